@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/rancher-metadata/config"
+	"gopkg.in/yaml.v2"
+)
+
+func getCommands() []cli.Command {
+	return []cli.Command{
+		{
+			Name:      "decode",
+			Usage:     "Print the metadata objects of an answers file as JSON lines",
+			ArgsUsage: "<file>",
+			Action:    decode,
+		},
+		{
+			Name:      "generate",
+			Usage:     "Print what a client would be answered from an answers file",
+			ArgsUsage: "<file>",
+			Action:    generate,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "version",
+					Value: config.LATEST_KEY,
+					Usage: "Version of the answers",
+				},
+				cli.StringFlag{
+					Name:  "client",
+					Usage: "IP address of the client, the default answers if empty",
+				},
+				cli.StringFlag{
+					Name:  "path",
+					Usage: "Path to answer, below the version",
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Value: "text",
+					Usage: "Format to answer in: text, json or yaml",
+				},
+			},
+		},
+		{
+			Name:      "diff",
+			Usage:     "Print the containers, services, stacks and hosts that differ between two answers files",
+			ArgsUsage: "<file> <file>",
+			Action:    diff,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output",
+					Value: "text",
+					Usage: "Format to print in: text, json or yaml",
+				},
+			},
+		},
+	}
+}
+
+var outputFormats = map[string]int{
+	"text": ContentText,
+	"json": ContentJSON,
+	"yaml": ContentYAML,
+}
+
+func fileArgs(ctx *cli.Context, n int) ([]string, error) {
+	if ctx.NArg() != n {
+		return nil, cli.NewExitError(fmt.Sprintf("Usage: %s %s %s", ctx.App.Name, ctx.Command.Name, ctx.Command.ArgsUsage), 1)
+	}
+	return ctx.Args(), nil
+}
+
+// generateFile generates the answers of an answers file, as the server would
+// serve them
+func generateFile(ctx *cli.Context, file string) (config.Versions, error) {
+	g := config.NewGenerator(true, "", ctx.GlobalBool("strict-schema"), 0)
+	objects, deltaVersion, err := g.DecodeFile(file)
+	if err != nil {
+		return nil, err
+	}
+	versions, _, _, err := g.GenerateAnswers(objects)
+	if err != nil {
+		return nil, err
+	}
+	overlays, err := parseOverlays(ctx.GlobalStringSlice("overlay"))
+	if err != nil {
+		return nil, err
+	}
+	for i, o := range overlays {
+		if overlays[i], err = o.Load(); err != nil {
+			return nil, err
+		}
+	}
+	return config.ApplyOverlays(config.MergeVersions(versions, nil, deltaVersion), overlays), nil
+}
+
+func decode(ctx *cli.Context) error {
+	files, err := fileArgs(ctx, 1)
+	if err != nil {
+		return err
+	}
+	objects, _, err := config.NewGenerator(true, "", false, 0).DecodeFile(files[0])
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	enc := json.NewEncoder(ctx.App.Writer)
+	for _, o := range objects {
+		if err := enc.Encode(o); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+	return nil
+}
+
+func generate(ctx *cli.Context) error {
+	files, err := fileArgs(ctx, 1)
+	if err != nil {
+		return err
+	}
+	if err := setupGeneration(ctx); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	format, ok := outputFormats[ctx.String("output")]
+	if !ok {
+		return cli.NewExitError(fmt.Sprintf("Unknown output format [%s]", ctx.String("output")), 1)
+	}
+
+	versions, err := generateFile(ctx, files[0])
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	aliases, err := parseVersionAliases(ctx.GlobalStringSlice("version-alias"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	version, ok := versions.Resolve(ctx.String("version"), aliases)
+	if !ok {
+		return cli.NewExitError(fmt.Sprintf("Invalid version [%s]", ctx.String("version")), 1)
+	}
+
+	var path []string
+	if trimmed := strings.Trim(ctx.String("path"), "/"); trimmed != "" {
+		path = strings.Split(trimmed, "/")
+	}
+
+	val, ok := versions.MatchingIndexed(nil, ctx.GlobalBool("strict-keys"), version, ctx.String("client"), path)
+	if !ok {
+		return cli.NewExitError("Not found", 1)
+	}
+	if err := writeAnswer(ctx.App.Writer, format, val); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
+// diff exits with 1 if the answers differ, like diff(1), and 2 on errors
+func diff(ctx *cli.Context) error {
+	files, err := fileArgs(ctx, 2)
+	if err != nil {
+		return err
+	}
+	if err := setupGeneration(ctx); err != nil {
+		return cli.NewExitError(err.Error(), 2)
+	}
+	output := ctx.String("output")
+	if _, ok := outputFormats[output]; !ok {
+		return cli.NewExitError(fmt.Sprintf("Unknown output format [%s]", output), 2)
+	}
+
+	from, err := generateFile(ctx, files[0])
+	if err != nil {
+		return cli.NewExitError(err.Error(), 2)
+	}
+	to, err := generateFile(ctx, files[1])
+	if err != nil {
+		return cli.NewExitError(err.Error(), 2)
+	}
+	d := config.AnswersDiff{From: files[0], To: files[1], Versions: config.DiffVersions(from, to)}
+
+	switch output {
+	case "json":
+		content, err := json.MarshalIndent(d, "", "  ")
+		if err != nil {
+			return cli.NewExitError(err.Error(), 2)
+		}
+		fmt.Fprintln(ctx.App.Writer, string(content))
+	case "yaml":
+		content, err := yaml.Marshal(d)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 2)
+		}
+		ctx.App.Writer.Write(content)
+	default:
+		printDiff(ctx.App.Writer, d)
+	}
+	if !d.Empty() {
+		return cli.NewExitError("", 1)
+	}
+	return nil
+}
+
+func printDiff(w io.Writer, d config.AnswersDiff) {
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", d.From, d.To)
+	for _, v := range d.Versions {
+		fmt.Fprintf(w, "%s:\n", v.Version)
+		for _, o := range v.Added {
+			fmt.Fprintf(w, "  + %s\n", describeObject(o))
+		}
+		for _, o := range v.Removed {
+			fmt.Fprintf(w, "  - %s\n", describeObject(o))
+		}
+		for _, o := range v.Changed {
+			fmt.Fprintf(w, "  ~ %s\n", describeObject(o))
+			for _, f := range o.Fields {
+				fmt.Fprintf(w, "      %s: %s -> %s\n", f.Field, describeValue(f.From), describeValue(f.To))
+			}
+		}
+	}
+}
+
+func describeObject(o config.ObjectChange) string {
+	if o.Name == "" {
+		return fmt.Sprintf("%s %s", o.Kind, o.UUID)
+	}
+	return fmt.Sprintf("%s %s (%s)", o.Kind, o.UUID, o.Name)
+}
+
+func describeValue(v interface{}) string {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(content)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codegangsta/cli"
+	"github.com/rancher/rancher-metadata/config"
+)
+
+// compressObjects encodes objects as a delta from Rancher
+func compressObjects(t *testing.T, objects []map[string]interface{}) []byte {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range objects {
+		if err := json.NewEncoder(w).Encode(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+// saveAnswersFile writes an answers file of objects, as the server saves it
+func saveAnswersFile(t *testing.T, path string, objects []map[string]interface{}) {
+	g := config.NewGenerator(true, path, false, 0)
+	delta, err := g.DecodeDelta(bytes.NewReader(compressObjects(t, objects)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := g.GenerateAnswers(delta.Objects); err != nil {
+		t.Fatal(err)
+	}
+	g.ApplyDelta(delta)
+	g.SaveToFile(time.Now())
+}
+
+// runCommand runs the app with args, and returns what it printed and its
+// exit code
+func runCommand(args ...string) (stdout string, stderr string, code int) {
+	var out, errOut bytes.Buffer
+	app := getCliApp()
+	app.Commands = getCommands()
+	app.Name = "rancher-metadata"
+	app.Writer = &out
+
+	savedExiter, savedErrWriter := cli.OsExiter, cli.ErrWriter
+	defer func() {
+		cli.OsExiter, cli.ErrWriter = savedExiter, savedErrWriter
+	}()
+	cli.OsExiter = func(c int) {
+		code = c
+	}
+	cli.ErrWriter = &errOut
+
+	app.Run(append([]string{"rancher-metadata"}, args...))
+	return out.String(), errOut.String(), code
+}
+
+func TestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rancher-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	answers := filepath.Join(dir, "answers")
+	saveAnswersFile(t, answers, testObjects())
+	renamed := testObjects()
+	renamed[3]["name"] = "renamed"
+	renamedAnswers := filepath.Join(dir, "renamed")
+	saveAnswersFile(t, renamedAnswers, renamed)
+
+	renamedHost := ""
+	for _, version := range []string{"2015-07-25", "2015-12-19", "2016-07-29"} {
+		renamedHost += version + ":\n  ~ host host-1 (renamed)\n      name: \"host1\" -> \"renamed\"\n"
+	}
+
+	var decoded []string
+	for _, o := range testObjects() {
+		line, _ := json.Marshal(o)
+		decoded = append(decoded, string(line))
+	}
+
+	tests := []struct {
+		args   []string
+		stdout string
+		stderr string
+		code   int
+	}{
+		{[]string{"decode", answers}, strings.Join(decoded, "\n") + "\n", "", 0},
+		{[]string{"decode"}, "", "Usage: rancher-metadata decode <file>\n", 1},
+		{[]string{"generate", answers, "--path", "stacks"}, "0=stack\n", "", 0},
+		{[]string{"generate", answers, "--path", "/stacks/0/name/"}, "stack", "", 0},
+		{[]string{"generate", answers, "--path", "hosts/0/name", "--output", "json"}, `"host1"`, "", 0},
+		{[]string{"generate", answers, "--path", "stacks/0/name", "--output", "yaml"}, "stack\n", "", 0},
+		{[]string{"generate", answers, "--client", "10.42.0.1", "--path", "self/container/name"}, "stack-web-1", "", 0},
+		{[]string{"generate", answers, "--client", "10.42.0.1", "--path", "self/container/name", "--version", "2015-07-25"},
+			"Stack-Web-1", "", 0},
+		{[]string{"generate", answers, "--client", "10.42.9.9", "--path", "self/container/name"}, "", "Not found\n", 1},
+		{[]string{"generate", answers, "--version", "1999-01-01"}, "", "Invalid version [1999-01-01]\n", 1},
+		{[]string{"generate", answers, "--output", "xml"}, "", "Unknown output format [xml]\n", 1},
+		{[]string{"diff", answers, answers}, "--- " + answers + "\n+++ " + answers + "\n", "", 0},
+		{[]string{"diff", answers, renamedAnswers}, "--- " + answers + "\n+++ " + renamedAnswers + "\n" + renamedHost, "", 1},
+		{[]string{"diff", answers, filepath.Join(dir, "missing")}, "", "", 2},
+	}
+	for _, test := range tests {
+		stdout, stderr, code := runCommand(test.args...)
+		if code != test.code {
+			t.Errorf("%v: expected exit code %d, got %d: %s", test.args, test.code, code, stderr)
+		}
+		if test.code == 0 || test.stdout != "" {
+			if stdout != test.stdout {
+				t.Errorf("%v: expected output %q, got %q", test.args, test.stdout, stdout)
+			}
+		}
+		if test.stderr != "" && stderr != test.stderr {
+			t.Errorf("%v: expected error %q, got %q", test.args, test.stderr, stderr)
+		}
+	}
+}
@@ -3,7 +3,7 @@ package config
 import (
 	"reflect"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/rancher/log"
 )
@@ -17,7 +17,68 @@ func (answers *Versions) Versions() []string {
 	return out
 }
 
+// Resolve returns the version of answers that serves a request for version.
+// Aliases are followed first.  An exact key wins, then for `latest` the
+// ASCII-betically highest version, and for any other date the newest dated
+// version on or before it.
+func (answers *Versions) Resolve(version string, aliases map[string]string) (string, bool) {
+	if target, ok := aliases[version]; ok {
+		version = target
+	}
+
+	if _, ok := (*answers)[version]; ok {
+		return version, true
+	}
+
+	// If a `latest` key is not provided, pick the ASCII-betically highest version and call it that.
+	if version == LATEST_KEY {
+		version = ""
+		for _, k := range answers.Versions() {
+			if k > version {
+				version = k
+			}
+		}
+
+		log.Debugf("Picked %s for latest version because none provided", version)
+		return version, true
+	}
+
+	requested, err := time.Parse(VERSION_DATE_FORMAT, version)
+	if err != nil {
+		return "", false
+	}
+
+	picked := ""
+	var pickedDate time.Time
+	for _, k := range answers.Versions() {
+		date, err := time.Parse(VERSION_DATE_FORMAT, k)
+		if err != nil || date.After(requested) {
+			continue
+		}
+		if picked == "" || date.After(pickedDate) {
+			picked, pickedDate = k, date
+		}
+	}
+
+	if picked == "" {
+		return "", false
+	}
+	log.Debugf("Picked %s for version %s", picked, version)
+	return picked, true
+}
+
 func (answers *Versions) Matching(version string, ip string, path []string) (interface{}, bool) {
+	return answers.MatchingIndexed(nil, false, version, ip, path)
+}
+
+// MatchingIndexed is Matching using idx, which must have been built from
+// answers, to resolve array children and case-insensitive keys.  A nil idx
+// falls back to scanning.
+//
+// Unless strict is set every level of path is resolved ignoring case when
+// there is no exact match.  Of several keys differing only in case the
+// lowercase one wins, then the smallest; of several array children the first.
+func (answers *Versions) MatchingIndexed(idx *PathIndex, strict bool, version string, ip string, path []string) (interface{}, bool) {
 	var out interface{}
 
 	all, ok := (*answers)[version]
@@ -33,7 +94,7 @@ func (answers *Versions) Matching(version string, ip string, path []string) (int
 			return nil, false
 		} else {
 			log.Debugf("No answers for %s, trying %s", ip, DEFAULT_KEY)
-			return answers.Matching(version, DEFAULT_KEY, path)
+			return answers.MatchingIndexed(idx, strict, version, DEFAULT_KEY, path)
 		}
 	}
 
@@ -41,26 +102,15 @@ func (answers *Versions) Matching(version string, ip string, path []string) (int
 		return thisIp, true
 	}
 
-	out, ok = valueForPath(&thisIp, path)
+	out, ok = valueForPath(idx, &thisIp, path, !strict)
 	if ok {
 		return out, true
-	} else {
-		// Try the path all lowercased for case-insensitivity
-		var lowerPath []string
-		for _, k := range path {
-			lowerPath = append(lowerPath, strings.ToLower(k))
-		}
-		log.Debugf("Not found, trying lowercase, %s", lowerPath)
-		out, ok = valueForPath(&thisIp, lowerPath)
-		if ok {
-			return out, true
-		}
 	}
 
 	return nil, false
 }
 
-func valueForPath(in *interface{}, path []string) (interface{}, bool) {
+func valueForPath(idx *PathIndex, in *interface{}, path []string, fold bool) (interface{}, bool) {
 	out := *in
 
 	for _, key := range path {
@@ -68,37 +118,24 @@ func valueForPath(in *interface{}, path []string) (interface{}, bool) {
 
 		switch v := out.(type) {
 		case []interface{}:
-			idx, err := strconv.ParseInt(key, 10, 64)
+			i, err := strconv.ParseInt(key, 10, 64)
 			if err == nil {
 				// If the part is a number, treat it like an array index
-				if idx >= 0 && idx < int64(len(v)) {
-					out = v[idx]
+				if i >= 0 && i < int64(len(v)) {
+					out = v[i]
 					valid = true
 				}
 			} else {
 				// Otherwise maybe it's the name of a child map
-				vAry, _ := out.([]interface{})
-			outer:
-				for childK, childV := range vAry {
-					childMap, ok := childV.(map[string]interface{})
-					if ok {
-						for _, magicKey := range MAGIC_ARRAY_KEYS {
-							if childMap[magicKey] == key {
-								out = vAry[childK]
-								valid = true
-								break outer
-							}
-						}
-					}
-				}
+				out, valid = idx.lookupArray(v, key, fold)
 			}
 
 		case map[string]interface{}:
-			out, valid = v[key]
+			out, valid = idx.lookupMap(v, key, fold)
 
 		default:
 			t := reflect.TypeOf(out)
-			log.Debug("Unknown type %s at /%s", t.String(), path)
+			log.Debugf("Unknown type %s at /%s", t.String(), path)
 		}
 
 		if valid == false {
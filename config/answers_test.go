@@ -0,0 +1,262 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testVersions(n int) Versions {
+	data := []map[string]interface{}{
+		{"metadata_kind": "defaultData", "version": "1"},
+		{"metadata_kind": "stack", "uuid": "stack-1", "name": "Stack"},
+		{"metadata_kind": "service", "uuid": "service-1", "name": "Web", "stack_uuid": "stack-1",
+			"stack_name": "Stack", "primary_service_name": "Web"},
+		{"metadata_kind": "host", "uuid": "host-1", "name": "host", "hostId": 1},
+	}
+	for i := 0; i < n; i++ {
+		data = append(data,
+			map[string]interface{}{
+				"metadata_kind": "container",
+				"uuid":          fmt.Sprintf("container-%d", i),
+				"name":          fmt.Sprintf("Stack-Web-%d", i),
+				"primary_ip":    fmt.Sprintf("10.42.%d.%d", i/250, i%250+1),
+				"host_uuid":     "host-1",
+				"labels":        map[string]interface{}{"io.rancher.Container.Name": fmt.Sprintf("c%d", i)},
+			},
+			map[string]interface{}{
+				"metadata_kind":  "serviceContainerLink",
+				"service_uuid":   "service-1",
+				"service_name":   "Web",
+				"container_uuid": fmt.Sprintf("container-%d", i),
+			})
+	}
+
+	versions, _, _, err := NewGenerator(true, "", false, 0).GenerateAnswers(data)
+	if err != nil {
+		panic(err)
+	}
+	return MergeVersions(versions, nil, "1")
+}
+
+func TestMatchingIndexedAgreesWithScan(t *testing.T) {
+	versions := testVersions(20)
+	idx := NewPathIndex(versions)
+
+	paths := [][]string{
+		{"containers", "stack-web-7", "uuid"},
+		{"containers", "container-3", "name"},
+		{"containers", "STACK-WEB-7"},
+		{"containers", "12", "labels", "io.rancher.container.name"},
+		{"containers", "missing"},
+		{"services", "web", "containers", "stack-web-19", "primary_ip"},
+		{"self", "container", "labels", "IO.RANCHER.CONTAINER.NAME"},
+		{"hosts", "host-1", "hostId"},
+	}
+	for _, version := range []string{METADATA_VERSION1, METADATA_VERSION2, METADATA_VERSION3} {
+		for _, ip := range []string{"10.42.0.5", DEFAULT_KEY} {
+			for _, path := range paths {
+				want, wantOk := versions.Matching(version, ip, path)
+				got, gotOk := versions.MatchingIndexed(idx, false, version, ip, path)
+				if wantOk != gotOk || !reflect.DeepEqual(want, got) {
+					t.Errorf("version=%s ip=%s path=%v: indexed returned %v, %v; scan returned %v, %v",
+						version, ip, path, got, gotOk, want, wantOk)
+				}
+			}
+		}
+	}
+}
+
+func TestMatchingCaseInsensitive(t *testing.T) {
+	versions := Versions{
+		METADATA_VERSION2: Answers{
+			DEFAULT_KEY: map[string]interface{}{
+				"key3": "value3a",
+				"KEY3": "value3b",
+				"Key4": "value4a",
+				"KEY4": "value4b",
+				"self": map[string]interface{}{
+					"container": map[string]interface{}{
+						"labels": map[string]interface{}{"io.Rancher.Foo": "bar"},
+					},
+				},
+				"containers": []interface{}{
+					map[string]interface{}{"name": "Web", "uuid": "1"},
+					map[string]interface{}{"name": "web", "uuid": "2"},
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		path   string
+		strict bool
+		want   interface{}
+	}{
+		{"key3", false, "value3a"},
+		{"KEY3", false, "value3b"},
+		{"Key3", false, "value3a"},
+		{"key4", false, "value4b"},
+		{"kEY4", false, "value4b"},
+		{"Key4", false, "value4a"},
+		{"SELF/container/labels/IO.Rancher.Foo", false, "bar"},
+		{"containers/web/uuid", false, "2"},
+		{"containers/WEB/uuid", false, "1"},
+		{"Key3", true, nil},
+		{"self/container/labels/io.rancher.foo", true, nil},
+		{"containers/WEB/uuid", true, nil},
+		{"KEY3", true, "value3b"},
+	}
+	for _, indexed := range []bool{false, true} {
+		var idx *PathIndex
+		if indexed {
+			idx = NewPathIndex(versions)
+		}
+		for _, test := range tests {
+			got, ok := versions.MatchingIndexed(idx, test.strict, METADATA_VERSION2, DEFAULT_KEY, strings.Split(test.path, "/"))
+			if ok != (test.want != nil) || got != test.want {
+				t.Errorf("indexed=%v strict=%v %s: got %v, %v; want %v", indexed, test.strict, test.path, got, ok, test.want)
+			}
+		}
+	}
+}
+
+func benchmarkMatching(b *testing.B, n int, indexed bool, path []string) {
+	versions := testVersions(n)
+	var idx *PathIndex
+	if indexed {
+		idx = NewPathIndex(versions)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := versions.MatchingIndexed(idx, false, LATEST_KEY, DEFAULT_KEY, path); !ok {
+			b.Fatalf("%v not found", path)
+		}
+	}
+}
+
+func BenchmarkMatchingByName(b *testing.B) {
+	for _, n := range []int{100, 1000, 5000} {
+		path := []string{"containers", fmt.Sprintf("stack-web-%d", n-1), "primary_ip"}
+		b.Run(fmt.Sprintf("scan/%d", n), func(b *testing.B) { benchmarkMatching(b, n, false, path) })
+		b.Run(fmt.Sprintf("indexed/%d", n), func(b *testing.B) { benchmarkMatching(b, n, true, path) })
+	}
+}
+
+func BenchmarkMatchingCaseFolded(b *testing.B) {
+	for _, n := range []int{100, 1000, 5000} {
+		path := []string{"Containers", fmt.Sprintf("Stack-Web-%d", n-1), "Labels", "IO.RANCHER.CONTAINER.NAME"}
+		b.Run(fmt.Sprintf("scan/%d", n), func(b *testing.B) { benchmarkMatching(b, n, false, path) })
+		b.Run(fmt.Sprintf("indexed/%d", n), func(b *testing.B) { benchmarkMatching(b, n, true, path) })
+	}
+}
+
+func BenchmarkNewPathIndex(b *testing.B) {
+	for _, n := range []int{100, 1000, 5000} {
+		versions := testVersions(n)
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				NewPathIndex(versions)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	dated := Versions{
+		METADATA_VERSION1: Answers{},
+		METADATA_VERSION2: Answers{},
+		METADATA_VERSION3: Answers{},
+	}
+	withLatest := Versions{
+		METADATA_VERSION1: Answers{},
+		METADATA_VERSION2: Answers{},
+		LATEST_KEY:        Answers{},
+	}
+	aliases := map[string]string{
+		"stable": METADATA_VERSION2,
+		"newest": LATEST_KEY,
+		"old":    "2015-08-01",
+		"gone":   "2014-01-01",
+	}
+
+	tests := []struct {
+		versions  Versions
+		requested string
+		want      string
+	}{
+		{dated, METADATA_VERSION2, METADATA_VERSION2},
+		{dated, "2016-01-01", METADATA_VERSION2},
+		{dated, "2015-12-18", METADATA_VERSION1},
+		{dated, "2020-01-01", METADATA_VERSION3},
+		{dated, "2015-07-24", ""},
+		{dated, "2015-13-01", ""},
+		{dated, "v1", ""},
+		{dated, LATEST_KEY, METADATA_VERSION3},
+		{withLatest, LATEST_KEY, LATEST_KEY},
+		{dated, "stable", METADATA_VERSION2},
+		{dated, "newest", METADATA_VERSION3},
+		{withLatest, "newest", LATEST_KEY},
+		{dated, "old", METADATA_VERSION1},
+		{dated, "gone", ""},
+	}
+	for _, test := range tests {
+		got, ok := test.versions.Resolve(test.requested, aliases)
+		if test.want == "" {
+			if ok {
+				t.Errorf("%s: expected no version, got %s", test.requested, got)
+			}
+		} else if !ok || got != test.want {
+			t.Errorf("%s: expected %s, got %s", test.requested, test.want, got)
+		}
+	}
+}
+
+func TestSame(t *testing.T) {
+	m := map[string]interface{}{"a": "b"}
+	a := []interface{}{"a", "b"}
+	tests := []struct {
+		a, b interface{}
+		want bool
+	}{
+		{m, m, true},
+		{m, map[string]interface{}{"a": "b"}, false},
+		{a, a, true},
+		{a, a[:1], false},
+		{a, []interface{}{"a", "b"}, false},
+		{[]interface{}{}, []interface{}{}, false},
+		{"a", "a", false},
+		{m, a, false},
+	}
+	for i, test := range tests {
+		if got := Same(test.a, test.b); got != test.want {
+			t.Errorf("%d: expected %v, got %v", i, test.want, got)
+		}
+	}
+
+	// the answers of a generation reuse the maps of the objects that
+	// didn't change since the previous one
+	g := NewGenerator(true, "", false, 0)
+	before, _, _, err := g.GenerateAnswers(testObjects())
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := testObjects()
+	objects[7]["name"] = "renamed"
+	after, _, _, err := g.GenerateAnswers(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := func(versions Versions, ip string, key string) interface{} {
+		val, _ := versions.Matching(METADATA_VERSION3, ip, []string{"self", key})
+		return val
+	}
+	if !Same(self(before, "10.42.0.2", "container"), self(after, "10.42.0.2", "container")) {
+		t.Error("an unchanged container was rendered again")
+	}
+	if Same(self(before, "10.42.0.1", "container"), self(after, "10.42.0.1", "container")) {
+		t.Error("a renamed container is the same map")
+	}
+}
@@ -0,0 +1,216 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// The arrays of the default answers that are compared object by object, and
+// the kind of their objects
+var diffedArrays = []struct {
+	key  string
+	kind string
+}{
+	{"containers", "container"},
+	{"services", "service"},
+	{"stacks", "stack"},
+	{"hosts", "host"},
+}
+
+// AnswersDiff lists the objects that differ between two sets of answers, by
+// version
+type AnswersDiff struct {
+	From     string        `json:"from" yaml:"from"`
+	To       string        `json:"to" yaml:"to"`
+	Versions []VersionDiff `json:"versions" yaml:"versions"`
+}
+
+// VersionDiff lists the objects of a version added, removed or changed
+type VersionDiff struct {
+	Version string         `json:"version" yaml:"version"`
+	Added   []ObjectChange `json:"added,omitempty" yaml:"added,omitempty"`
+	Removed []ObjectChange `json:"removed,omitempty" yaml:"removed,omitempty"`
+	Changed []ObjectChange `json:"changed,omitempty" yaml:"changed,omitempty"`
+}
+
+// ObjectChange names an object, and for a changed object lists the fields
+// that differ
+type ObjectChange struct {
+	Kind   string        `json:"kind" yaml:"kind"`
+	UUID   string        `json:"uuid" yaml:"uuid"`
+	Name   string        `json:"name,omitempty" yaml:"name,omitempty"`
+	Fields []FieldChange `json:"fields,omitempty" yaml:"fields,omitempty"`
+}
+
+// FieldChange is a field of an object, as a path like labels.foo or
+// containers[<uuid>].name, and its values before and after.  A missing value
+// is null.
+type FieldChange struct {
+	Field string      `json:"field" yaml:"field"`
+	From  interface{} `json:"from" yaml:"from"`
+	To    interface{} `json:"to" yaml:"to"`
+}
+
+// Empty returns whether the answers are the same
+func (d *AnswersDiff) Empty() bool {
+	return len(d.Versions) == 0
+}
+
+// DiffVersions compares the containers, services, stacks and hosts of the
+// default answers of each version.  Versions with no difference are left out.
+func DiffVersions(from, to Versions) []VersionDiff {
+	names := make(map[string]bool)
+	for _, versions := range []Versions{from, to} {
+		for name := range versions {
+			if name != LATEST_KEY {
+				names[name] = true
+			}
+		}
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	diffs := []VersionDiff{}
+	for _, name := range sorted {
+		diff := diffAnswers(name, defaultAnswers(from, name), defaultAnswers(to, name))
+		if len(diff.Added)+len(diff.Removed)+len(diff.Changed) > 0 {
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs
+}
+
+func defaultAnswers(versions Versions, name string) map[string]interface{} {
+	answers, _ := versions[name][DEFAULT_KEY].(map[string]interface{})
+	return answers
+}
+
+func diffAnswers(version string, from, to map[string]interface{}) VersionDiff {
+	diff := VersionDiff{Version: version}
+	for _, array := range diffedArrays {
+		fromObjects, fromOrder := objectsByUUID(from[array.key])
+		toObjects, toOrder := objectsByUUID(to[array.key])
+		for _, uuid := range toOrder {
+			o := toObjects[uuid]
+			old, ok := fromObjects[uuid]
+			if !ok {
+				diff.Added = append(diff.Added, newObjectChange(array.kind, uuid, o))
+			} else if fields := diffFields("", old, o); len(fields) > 0 {
+				change := newObjectChange(array.kind, uuid, o)
+				change.Fields = fields
+				diff.Changed = append(diff.Changed, change)
+			}
+		}
+		for _, uuid := range fromOrder {
+			if _, ok := toObjects[uuid]; !ok {
+				diff.Removed = append(diff.Removed, newObjectChange(array.kind, uuid, fromObjects[uuid]))
+			}
+		}
+	}
+	return diff
+}
+
+func newObjectChange(kind, uuid string, o map[string]interface{}) ObjectChange {
+	name, _ := o["name"].(string)
+	return ObjectChange{Kind: kind, UUID: uuid, Name: name}
+}
+
+// objectsByUUID indexes the objects of a list by uuid, and returns their uuids
+// sorted.  It returns nil if the list isn't made of objects with a uuid.
+func objectsByUUID(value interface{}) (map[string]map[string]interface{}, []string) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, nil
+	}
+	objects := make(map[string]map[string]interface{}, len(list))
+	var uuids []string
+	for _, elem := range list {
+		o, ok := elem.(map[string]interface{})
+		if !ok {
+			return nil, nil
+		}
+		uuid, ok := o["uuid"].(string)
+		if !ok {
+			return nil, nil
+		}
+		if _, ok := objects[uuid]; !ok {
+			uuids = append(uuids, uuid)
+		}
+		objects[uuid] = o
+	}
+	sort.Strings(uuids)
+	return objects, uuids
+}
+
+// diffFields compares two objects field by field.  Maps are compared key by
+// key and lists of objects with a uuid object by object, anything else as a
+// whole.
+func diffFields(prefix string, from, to map[string]interface{}) []FieldChange {
+	keys := make(map[string]bool)
+	for key := range from {
+		keys[key] = true
+	}
+	for key := range to {
+		keys[key] = true
+	}
+	var sorted []string
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var changes []FieldChange
+	for _, key := range sorted {
+		changes = append(changes, diffValues(joinField(prefix, key), from[key], to[key])...)
+	}
+	return changes
+}
+
+func diffValues(field string, from, to interface{}) []FieldChange {
+	if reflect.DeepEqual(from, to) {
+		return nil
+	}
+
+	fromMap, fromIsMap := from.(map[string]interface{})
+	toMap, toIsMap := to.(map[string]interface{})
+	if fromIsMap && toIsMap {
+		return diffFields(field, fromMap, toMap)
+	}
+
+	fromObjects, fromOrder := objectsByUUID(from)
+	toObjects, toOrder := objectsByUUID(to)
+	if fromObjects != nil && toObjects != nil {
+		var changes []FieldChange
+		for _, uuid := range toOrder {
+			elem := fmt.Sprintf("%s[%s]", field, uuid)
+			if old, ok := fromObjects[uuid]; ok {
+				changes = append(changes, diffFields(elem, old, toObjects[uuid])...)
+			} else {
+				changes = append(changes, FieldChange{Field: elem, To: toObjects[uuid]})
+			}
+		}
+		for _, uuid := range fromOrder {
+			if _, ok := toObjects[uuid]; !ok {
+				changes = append(changes, FieldChange{Field: fmt.Sprintf("%s[%s]", field, uuid), From: fromObjects[uuid]})
+			}
+		}
+		if len(changes) > 0 {
+			return changes
+		}
+		// only the order of the objects changed
+	}
+
+	return []FieldChange{{Field: field, From: from, To: to}}
+}
+
+func joinField(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return strings.Join([]string{prefix, key}, ".")
+}
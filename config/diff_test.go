@@ -0,0 +1,71 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffVersions(t *testing.T) {
+	from, _, _, err := NewGenerator(true, "", false, 0).GenerateAnswers(testObjects())
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects := testObjects()
+	objects[7]["labels"] = map[string]interface{}{"role": "web"}
+	objects[6]["name"] = "renamed"
+	objects = append(objects[:2], objects[3:]...)
+	to, _, _, err := NewGenerator(true, "", false, 0).GenerateAnswers(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	diffs := DiffVersions(from, to)
+	if len(diffs) != len(SupportedVersions()) {
+		t.Fatalf("got diffs for %d versions, want %d", len(diffs), len(SupportedVersions()))
+	}
+	diff := diffs[0]
+	if diff.Version != METADATA_VERSION1 {
+		t.Errorf("first version is %s", diff.Version)
+	}
+	if len(diff.Added) != 0 || !reflect.DeepEqual(diff.Removed, []ObjectChange{{Kind: "stack", UUID: "stack-2", Name: "Other"}}) {
+		t.Errorf("got added %v, removed %v", diff.Added, diff.Removed)
+	}
+
+	fields := make(map[string]FieldChange)
+	for _, o := range diff.Changed {
+		for _, f := range o.Fields {
+			fields[o.Kind+"/"+o.UUID+" "+f.Field] = f
+		}
+	}
+	if f, ok := fields["container/container-1 labels"]; !ok || f.From != nil {
+		t.Errorf("added labels not reported: %v", f)
+	}
+	if f := fields["host/host-2 name"]; f.From != "host2" || f.To != "renamed" {
+		t.Errorf("renamed host reported as %v", f)
+	}
+
+	if diffs := DiffVersions(to, to); len(diffs) != 0 {
+		t.Errorf("same answers differ: %v", diffs)
+	}
+}
+
+func TestDiffValues(t *testing.T) {
+	from := map[string]interface{}{
+		"labels":     map[string]interface{}{"a": "1", "b": "2"},
+		"ports":      []interface{}{"80:80/tcp"},
+		"containers": []interface{}{map[string]interface{}{"uuid": "c1", "name": "x"}},
+	}
+	to := map[string]interface{}{
+		"labels":     map[string]interface{}{"a": "1", "b": "3"},
+		"ports":      []interface{}{"80:80/tcp", "443:443/tcp"},
+		"containers": []interface{}{map[string]interface{}{"uuid": "c1", "name": "y"}},
+	}
+	want := []FieldChange{
+		{Field: "containers[c1].name", From: "x", To: "y"},
+		{Field: "labels.b", From: "2", To: "3"},
+		{Field: "ports", From: from["ports"], To: to["ports"]},
+	}
+	if got := diffFields("", from, to); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -3,11 +3,11 @@ package config
 import (
 	"bytes"
 	"compress/flate"
-	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"sync"
@@ -25,6 +25,13 @@ type Generator struct {
 	jsonHandle        *codec.JsonHandle
 	decoder           *MetadataDecoder
 	answersFilePath   string
+	state             generatorState
+	history           *History
+	strictSchema      bool
+	unknownKinds      map[string]int
+	invalidObjects    []*ValidationError
+	objectCounts      map[string]int
+	reportLock        sync.Mutex
 }
 
 type MetadataDelta struct {
@@ -38,16 +45,16 @@ type MetadataDecoder struct {
 	sync.Mutex
 }
 
-func NewGenerator(local bool, answersFilePath string) *Generator {
+func NewGenerator(local bool, answersFilePath string, strictSchema bool, historySize int) *Generator {
 	var generator *Generator
 	if local {
 		generator = &Generator{
-			supportedVersions: []string{METADATA_VERSION1, METADATA_VERSION2, METADATA_VERSION3},
+			supportedVersions: SupportedVersions(),
 			local:             true,
 		}
 	} else {
 		generator = &Generator{
-			supportedVersions: []string{METADATA_VERSION3},
+			supportedVersions: EnvironmentVersions(),
 			local:             false,
 		}
 	}
@@ -66,93 +73,182 @@ func NewGenerator(local bool, answersFilePath string) *Generator {
 		Version: "0",
 	}
 	generator.answersFilePath = answersFilePath
+	generator.strictSchema = strictSchema
+	generator.state.hideTokens = local
+	if historySize > 0 {
+		generator.history = NewHistory(answersFilePath+".history", historySize)
+	}
 
 	return generator
 }
 
-func (g *Generator) GenerateAnswers(data []map[string]interface{}) (Versions, []Credential, error) {
+// GenerateAnswers renders data into answers for every supported version.
+// Only what changed since the previous call is rendered again, the rest of
+// the answers reuse what was rendered then.  Objects that don't match the
+// schema of their kind are skipped, or fail the whole generation in strict
+// mode.
+func (g *Generator) GenerateAnswers(data []map[string]interface{}) (Versions, Lookups, []Credential, error) {
+	data, invalid := validateObjects(data)
+	if len(invalid) > 0 && g.strictSchema {
+		return nil, nil, nil, fmt.Errorf("Rejected metadata with %d invalid objects, first: %v", len(invalid), invalid[0])
+	}
+	g.setInvalidObjects(invalid)
+	g.setObjectCounts(data)
+	defer generationDuration.ObserveSince(time.Now())
+
+	g.state.Lock()
+	defer g.state.Unlock()
+
 	versions := make(map[string]Answers)
+	lookups := make(Lookups)
+
+	// 1. update interim data with what changed
+	changes, global := g.state.update(data)
 
 	var creds []Credential
+	var unknownKinds map[string]int
 	for _, v := range g.supportedVersions {
-		// 1. generate interim data
-		interim := &Interim{
-			UUIDToService:                   make(map[string]map[string]interface{}),
-			UUIDToContainer:                 make(map[string]map[string]interface{}),
-			UUIDToStack:                     make(map[string]map[string]interface{}),
-			UUIDToHost:                      make(map[string]map[string]interface{}),
-			StackUUIDToServicesUUID:         make(map[string][]string),
-			ServiceUUIDNameToContainersUUID: make(map[string][]string),
-			ContainerUUIDToContainerLink:    make(map[string]map[string]interface{}),
-			ServiceUUIDToServiceLink:        make(map[string]map[string]interface{}),
-			Networks:                        []interface{}{},
-			Default:                         make(map[string]interface{}),
-			Credentials:                     []Credential{},
-			Environment:                     make(map[string]interface{}),
-		}
-
-		for _, o := range data {
-			no := make(map[string]interface{}, len(o))
-			for k, v := range o {
-				no[k] = v
-			}
-			processMetadataObject(no, interim)
+		vs, err := g.state.versioned(v, global, changes)
+		if err != nil {
+			return nil, nil, nil, err
 		}
-		creds = interim.Credentials
+		creds = vs.interim.Credentials
+		unknownKinds = vs.interim.UnknownKinds
 		// 2. Generate versions from temp data
-		if err := g.generateVersions(interim, v, versions); err != nil {
-			return nil, nil, err
-		}
+		g.addToVersions(versions, v, vs, changes)
+		lookups[v] = newLookupIndex(vs.interim)
 	}
 
+	g.setUnknownKinds(unknownKinds)
+
 	//tag the latest
-	versions[LATEST_KEY] = versions[METADATA_VERSION3]
-	return versions, creds, nil
+	latest := latestVersion(g.supportedVersions)
+	versions[LATEST_KEY] = versions[latest]
+	lookups[LATEST_KEY] = lookups[latest]
+	return versions, lookups, creds, nil
 }
 
-func (g *Generator) generateVersions(interim *Interim, version string, versions Versions) error {
-	versionedData, err := applyVersionToData(*interim, version)
-	if err != nil {
-		return err
+func (g *Generator) setUnknownKinds(unknownKinds map[string]int) {
+	for kind, count := range unknownKinds {
+		log.Warnf("Ignored %d metadata objects of unknown kind [%s]", count, kind)
+	}
+	g.reportLock.Lock()
+	defer g.reportLock.Unlock()
+	g.unknownKinds = unknownKinds
+}
+
+func (g *Generator) setInvalidObjects(invalid []*ValidationError) {
+	for _, err := range invalid {
+		log.Warnf("Skipped %v", err)
+	}
+	g.reportLock.Lock()
+	defer g.reportLock.Unlock()
+	g.invalidObjects = invalid
+}
+
+func (g *Generator) setObjectCounts(data []map[string]interface{}) {
+	counts := make(map[string]int)
+	for _, o := range data {
+		kind, _ := o["metadata_kind"].(string)
+		counts[kind]++
+	}
+	g.reportLock.Lock()
+	defer g.reportLock.Unlock()
+	g.objectCounts = counts
+}
+
+// ObjectCounts returns the number of objects of each metadata_kind the last
+// generation was made from, leaving out invalid objects
+func (g *Generator) ObjectCounts() map[string]int {
+	g.reportLock.Lock()
+	defer g.reportLock.Unlock()
+	out := make(map[string]int, len(g.objectCounts))
+	for kind, count := range g.objectCounts {
+		out[kind] = count
 	}
-	g.addToVersions(versions, version, versionedData)
-	return nil
+	return out
 }
 
-func (g *Generator) addToVersions(versions Versions, version string, versionedData *Interim) {
+// InvalidObjects returns the objects skipped by the last generation because
+// they didn't match the schema of their kind
+func (g *Generator) InvalidObjects() []ValidationError {
+	g.reportLock.Lock()
+	defer g.reportLock.Unlock()
+	out := make([]ValidationError, 0, len(g.invalidObjects))
+	for _, err := range g.invalidObjects {
+		out = append(out, *err)
+	}
+	return out
+}
+
+// UnknownKinds returns the number of objects of each metadata_kind that no
+// kind is registered for, as of the last generation
+func (g *Generator) UnknownKinds() map[string]int {
+	g.reportLock.Lock()
+	defer g.reportLock.Unlock()
+	out := make(map[string]int, len(g.unknownKinds))
+	for kind, count := range g.unknownKinds {
+		out[kind] = count
+	}
+	return out
+}
+
+func (g *Generator) addToVersions(versions Versions, version string, vs *versionState, changes *Changes) {
 	answers := make(map[string]interface{})
-	defaultAnswers := g.addDefaultToAnswers(answers, versionedData)
+	defaultAnswers := g.addDefaultToAnswers(answers, version, vs.interim)
 	if g.local {
-		addClientToAnswers(answers, defaultAnswers, versionedData)
+		addClientToAnswers(answers, defaultAnswers, vs, g.state.base, changes)
 	}
 	versions[version] = answers
 }
 
-func addClientToAnswers(answers Answers, defaultAnswers map[string]interface{}, versionedData *Interim) {
-	for _, c := range versionedData.UUIDToContainer {
-		if c["primary_ip"] == nil {
-			continue
+func addClientToAnswers(answers Answers, defaultAnswers map[string]interface{}, vs *versionState, base *Interim, changes *Changes) {
+	versionedData := vs.interim
+	for cUUID := range vs.clients {
+		if _, ok := versionedData.UUIDToContainer[cUUID]; !ok {
+			delete(vs.clients, cUUID)
 		}
-		clientAnswers := make(map[string]interface{})
-		self := make(map[string]interface{})
-		self["container"] = c
-		if c["stack_uuid"] != nil {
-			self["stack"] = versionedData.UUIDToStack[c["stack_uuid"].(string)]
-			service := versionedData.UUIDToService[getServiceUUID(c["service_uuid"].(string), c["service_name"].(string))]
-			selfService := make(map[string]interface{})
-			// to exclude token from service
-			for k, v := range service {
-				selfService[k] = v
+	}
+
+	for cUUID, c := range versionedData.UUIDToContainer {
+		// the rules of the version may have renamed or removed the fields
+		// clients are found by
+		field := func(key string) string {
+			if value, ok := c[key]; ok {
+				s, _ := value.(string)
+				return s
 			}
-			service["token"] = nil
-			self["service"] = selfService
+			return stringField(base.UUIDToContainer[cUUID], key)
 		}
-		if c["host_uuid"] != nil {
-			self["host"] = versionedData.UUIDToHost[c["host_uuid"].(string)]
+		primaryIP := field("primary_ip")
+		if primaryIP == "" {
+			continue
+		}
+		self, ok := vs.clients[cUUID]
+		sUUID := getServiceUUID(field("service_uuid"), field("service_name"))
+		stackUUID, hostUUID := field("stack_uuid"), field("host_uuid")
+		if !ok || changes.Container(cUUID) || changes.Service(sUUID) || changes.Stack(stackUUID) || changes.Host(hostUUID) {
+			self = make(map[string]interface{})
+			self["container"] = c
+			if stackUUID != "" {
+				self["stack"] = versionedData.UUIDToStack[stackUUID]
+				selfService := copyObject(versionedData.UUIDToService[sUUID])
+				// the token is hidden from the services of the version, only
+				// the containers of the service see it
+				if token := base.UUIDToService[sUUID]["token"]; token != nil {
+					selfService["token"] = token
+				}
+				self["service"] = selfService
+			}
+			if hostUUID != "" {
+				self["host"] = versionedData.UUIDToHost[hostUUID]
+			}
+			vs.clients[cUUID] = self
 		}
+		clientAnswers := make(map[string]interface{})
 		clientAnswers["self"] = self
 		mergeDefaults(clientAnswers, defaultAnswers)
-		answers[c["primary_ip"].(string)] = clientAnswers
+		answers[primaryIP] = clientAnswers
 	}
 }
 
@@ -165,257 +261,188 @@ func mergeDefaults(clientAnswers map[string]interface{}, defaultAnswers map[stri
 	}
 }
 
-func (g *Generator) addDefaultToAnswers(answers Answers, versionedData *Interim) map[string]interface{} {
+func (g *Generator) addDefaultToAnswers(answers Answers, version string, versionedData *Interim) map[string]interface{} {
 	defaultAnswers := make(map[string]interface{})
-	var containers []interface{}
-	for _, c := range versionedData.UUIDToContainer {
-		if _, ok := defaultAnswers["containers"]; ok {
-			containers = defaultAnswers["containers"].([]interface{})
+	ctx := &RenderContext{
+		Version: version,
+		Local:   g.local,
+		Interim: versionedData,
+	}
+	for _, kind := range registeredKinds() {
+		if kind.Render != nil {
+			kind.Render(ctx, defaultAnswers)
 		}
+	}
+	answers[DEFAULT_KEY] = defaultAnswers
+	return defaultAnswers
+}
+
+func renderContainers(ctx *RenderContext, defaultAnswers map[string]interface{}) {
+	var containers []interface{}
+	for _, c := range ctx.Interim.UUIDToContainer {
 		containers = append(containers, c)
 	}
+	sortObjects(containers)
 	defaultAnswers["containers"] = containers
+}
 
+func renderStacks(ctx *RenderContext, defaultAnswers map[string]interface{}) {
 	var stacks []interface{}
-	for _, s := range versionedData.UUIDToStack {
-		if _, ok := defaultAnswers["stacks"]; ok {
-			stacks = defaultAnswers["stacks"].([]interface{})
-		}
+	for _, s := range ctx.Interim.UUIDToStack {
 		stacks = append(stacks, s)
 	}
+	sortObjects(stacks)
 	defaultAnswers["stacks"] = stacks
+}
 
+func renderServices(ctx *RenderContext, defaultAnswers map[string]interface{}) {
 	var services []interface{}
-	for _, s := range versionedData.UUIDToService {
-		if _, ok := defaultAnswers["services"]; ok {
-			services = defaultAnswers["services"].([]interface{})
-		}
+	for _, s := range ctx.Interim.UUIDToService {
 		services = append(services, s)
 	}
+	sortObjects(services)
 	defaultAnswers["services"] = services
+}
 
+func renderHosts(ctx *RenderContext, defaultAnswers map[string]interface{}) {
 	var hosts []interface{}
-	for _, h := range versionedData.UUIDToHost {
-		if _, ok := defaultAnswers["hosts"]; ok {
-			hosts = defaultAnswers["hosts"].([]interface{})
-		}
+	for _, h := range ctx.Interim.UUIDToHost {
 		hosts = append(hosts, h)
 	}
+	sortObjects(hosts)
 	defaultAnswers["hosts"] = hosts
-	defaultAnswers["networks"] = versionedData.Networks
+}
+
+func renderNetworks(ctx *RenderContext, defaultAnswers map[string]interface{}) {
+	networks := append([]interface{}{}, ctx.Interim.Networks...)
+	sortObjects(networks)
+	defaultAnswers["networks"] = networks
+}
 
-	if val, ok := versionedData.Default["version"]; ok {
+func renderDefault(ctx *RenderContext, defaultAnswers map[string]interface{}) {
+	if val, ok := ctx.Interim.Default["version"]; ok {
 		defaultAnswers["version"] = val
 	}
 
-	if g.local {
-		if selfVal, ok := versionedData.Default["self"]; ok {
-			self := selfVal.(map[string]interface{})
-			if hostVal, ok := self["host"]; ok {
-				host := hostVal.(map[string]interface{})
-				self["host"] = versionedData.UUIDToHost[host["uuid"].(string)]
+	if ctx.Local {
+		if defaultSelf, ok := ctx.Interim.Default["self"].(map[string]interface{}); ok {
+			// the default data is shared by every version
+			self := copyObject(defaultSelf)
+			if host, ok := self["host"].(map[string]interface{}); ok {
+				self["host"] = ctx.Interim.UUIDToHost[host["uuid"].(string)]
 			}
 			defaultAnswers["self"] = self
 		}
 	}
-	for key, value := range versionedData.Environment {
+}
+
+func renderEnvironment(ctx *RenderContext, defaultAnswers map[string]interface{}) {
+	for key, value := range ctx.Interim.Environment {
 		if key == "metadata_kind" {
 			continue
 		}
 		defaultAnswers[key] = value
 	}
-	answers[DEFAULT_KEY] = defaultAnswers
-	return defaultAnswers
 }
 
-func applyVersionToData(modified Interim, version string) (*Interim, error) {
-	// 1. Process containers
-	for _, c := range modified.UUIDToContainer {
-		switch version {
-		case METADATA_VERSION3:
-			if c["name"] != nil {
-				c["name"] = strings.ToLower(c["name"].(string))
-			}
-			if c["service_name"] != nil {
-				c["service_name"] = strings.ToLower(c["service_name"].(string))
-			}
-			if c["stack_name"] != nil {
-				c["stack_name"] = strings.ToLower(c["stack_name"].(string))
-			}
-			if _, ok := c["ports"]; ok {
-				// set port ip to 0.0.0.0 if not specified
-				originalPorts := c["ports"].([]interface{})
-				var newPorts []interface{}
-				for _, p := range originalPorts {
-					port := p.(string)
-					splitted := strings.Split(port, ":")
-					if len(splitted) == 3 {
-						newPorts = append(newPorts, port)
-					} else {
-						port = fmt.Sprintf("0.0.0.0:%s", port)
-						newPorts = append(newPorts, port)
-					}
-				}
-				c["ports"] = newPorts
-			}
+func applyVersionToData(modified *Interim, version string, changes *Changes) (*Interim, error) {
+	for _, kind := range registeredKinds() {
+		if kind.ApplyVersion != nil {
+			kind.ApplyVersion(modified, version, changes)
+		}
+	}
+	return modified, nil
+}
 
-		default:
-			if _, ok := c["ports"]; ok {
-				originalPorts := c["ports"].([]interface{})
-				// set port ip to host's ip if not specified
-				if len(originalPorts) > 0 {
-					var newPorts []interface{}
-					for _, p := range originalPorts {
-						port := p.(string)
-						splitted := strings.Split(port, ":")
-						if len(splitted) == 3 && splitted[0] != "0.0.0.0" {
-							newPorts = append(newPorts, port)
-						} else {
-							if len(splitted) == 3 {
-								port = fmt.Sprintf("%s%s", c["host_ip"], strings.TrimPrefix(port, "0.0.0.0"))
-							} else {
-								port = fmt.Sprintf("%s:%s", c["host_ip"], port)
-							}
-
-							newPorts = append(newPorts, port)
-						}
-					}
-					c["ports"] = newPorts
-				}
+func applyVersionToContainers(interim *Interim, version string, changes *Changes) {
+	rules := &lookupVersionSpec(version).Containers
+	// the services of the changed containers changed too, so they haven't
+	// been rewritten for the version yet
+	services := make(map[string]map[string]interface{})
+	for sUUID, cUUIDs := range interim.ServiceUUIDNameToContainersUUID {
+		if s, ok := interim.UUIDToService[sUUID]; ok {
+			for _, cUUID := range cUUIDs {
+				services[cUUID] = s
 			}
 		}
-		c["links"] = modified.ContainerUUIDToContainerLink[c["uuid"].(string)]
+	}
+	for cUUID, c := range interim.UUIDToContainer {
+		if !changes.Container(cUUID) {
+			continue
+		}
+		rules.ports(c)
+		c["links"] = interim.ContainerUUIDToContainerLink[c["uuid"].(string)]
 		//delete helper field (needed for the port)
 		delete(c, "host_ip")
+		// populate stack/service info on container
+		if s, ok := services[cUUID]; ok {
+			c["service_name"] = s["name"]
+			c["service_uuid"] = s["uuid"]
+			c["stack_name"] = s["stack_name"]
+			c["stack_uuid"] = s["stack_uuid"]
+		}
+		rules.apply(c)
 	}
+}
 
-	// 2. Process services
-	for _, s := range modified.UUIDToService {
-		sUUID := getServiceUUID(s["uuid"].(string), s["name"].(string))
-
-		stackUUID := s["stack_uuid"].(string)
-		// add itself to the stack list
-		var svcUUIDs []string
-		if _, ok := modified.StackUUIDToServicesUUID[stackUUID]; ok {
-			svcUUIDs = modified.StackUUIDToServicesUUID[stackUUID]
+func applyVersionToServices(interim *Interim, version string, changes *Changes) {
+	rules := &lookupVersionSpec(version).Services
+	for sUUID, s := range interim.UUIDToService {
+		if !changes.Service(sUUID) {
+			continue
 		}
-		svcUUIDs = append(svcUUIDs, getServiceUUID(s["uuid"].(string), s["name"].(string)))
-		modified.StackUUIDToServicesUUID[stackUUID] = svcUUIDs
+
 		var cs []interface{}
-		var cNames []interface{}
-		cUUIDs := modified.ServiceUUIDNameToContainersUUID[sUUID]
-		if cUUIDs != nil {
-			for _, cUUID := range cUUIDs {
-				if c, ok := modified.UUIDToContainer[cUUID]; ok {
-					cs = append(cs, c)
-					cNames = append(cNames, c["name"].(string))
-				}
+		for _, cUUID := range interim.ServiceUUIDNameToContainersUUID[sUUID] {
+			if c, ok := interim.UUIDToContainer[cUUID]; ok {
+				cs = append(cs, c)
 			}
 		}
+		sortObjects(cs)
 		// add service links
-		s["links"] = modified.ServiceUUIDToServiceLink[s["uuid"].(string)]
-		switch version {
-		case METADATA_VERSION1:
-			s["containers"] = cNames
-		case METADATA_VERSION2:
-			s["containers"] = cs
-		case METADATA_VERSION3:
-			s["containers"] = cs
-			s["name"] = strings.ToLower(s["name"].(string))
-			s["stack_name"] = strings.ToLower(s["stack_name"].(string))
-			s["primary_service_name"] = strings.ToLower(s["primary_service_name"].(string))
-			if s["sidekicks"] != nil {
-				sidekicks := s["sidekicks"].([]interface{})
-				var lowercased []interface{}
-				for _, sidekick := range sidekicks {
-					lowercased = append(lowercased, strings.ToLower(sidekick.(string)))
-				}
-				s["sidekicks"] = lowercased
-			}
-			if s["links"] != nil {
-				links := s["links"].(map[string]interface{})
-				lowercased := make(map[string]interface{})
-				for key, value := range links {
-					lowercased[strings.ToLower(key)] = value
-				}
-				s["links"] = lowercased
-			}
-		}
-
-		// populate stack/service info on container
-		if cUUIDs != nil {
-			for _, cUUID := range cUUIDs {
-				if _, ok := modified.UUIDToContainer[cUUID]; ok {
-					modified.UUIDToContainer[cUUID]["service_name"] = s["name"]
-					modified.UUIDToContainer[cUUID]["service_uuid"] = s["uuid"]
-					modified.UUIDToContainer[cUUID]["stack_name"] = s["stack_name"]
-					modified.UUIDToContainer[cUUID]["stack_uuid"] = stackUUID
-				}
-			}
+		s["links"] = interim.ServiceUUIDToServiceLink[s["uuid"].(string)]
+		if rules.Children != "" {
+			s["containers"] = rules.children(cs)
 		}
+		rules.apply(s)
 	}
+}
 
-	// 3. Process stacks
-	for _, s := range modified.UUIDToStack {
+func applyVersionToStacks(interim *Interim, version string, changes *Changes) {
+	rules := &lookupVersionSpec(version).Stacks
+	for stackUUID, s := range interim.UUIDToStack {
+		if !changes.Stack(stackUUID) {
+			continue
+		}
 		var svcs []interface{}
-		var svcsNames []interface{}
-		svcsUUIDs := modified.StackUUIDToServicesUUID[s["uuid"].(string)]
-		if svcsUUIDs != nil {
-			for _, svcUUID := range svcsUUIDs {
-				if svc, ok := modified.UUIDToService[svcUUID]; ok {
-					svcs = append(svcs, svc)
-					svcsNames = append(svcsNames, svc["name"].(string))
-				}
+		for _, svcUUID := range interim.StackUUIDToServicesUUID[s["uuid"].(string)] {
+			if svc, ok := interim.UUIDToService[svcUUID]; ok {
+				svcs = append(svcs, svc)
 			}
 		}
-		switch version {
-		case METADATA_VERSION1:
-			s["services"] = svcsNames
-		case METADATA_VERSION2:
-			s["services"] = svcs
-		case METADATA_VERSION3:
-			s["services"] = svcs
-			s["name"] = strings.ToLower(s["name"].(string))
+		sortObjects(svcs)
+		if rules.Children != "" {
+			s["services"] = rules.children(svcs)
 		}
+		rules.apply(s)
 	}
+}
 
-	// 4. process hosts
-	for _, h := range modified.UUIDToHost {
-		switch version {
-		case METADATA_VERSION3:
-			delete(h, "hostId")
+func applyVersionToHosts(interim *Interim, version string, changes *Changes) {
+	rules := &lookupVersionSpec(version).Hosts
+	for hostUUID, h := range interim.UUIDToHost {
+		if changes.Host(hostUUID) {
+			rules.apply(h)
 		}
 	}
-
-	return &modified, nil
 }
 
 func processMetadataObject(o map[string]interface{}, interim *Interim) {
-	if val, ok := o["metadata_kind"]; ok {
-		switch val.(string) {
-		case "container":
-			addContainer(o, interim)
-		case "stack":
-			addStack(o, interim)
-		case "network":
-			addNetwork(o, interim)
-		case "host":
-			addHost(o, interim)
-		case "defaultData":
-			addDefault(o, interim)
-		case "serviceContainerLink":
-			addServiceContainerLink(o, interim)
-		case "containerLink":
-			addContainerLink(o, interim)
-		case "serviceLink":
-			addServiceLink(o, interim)
-		case "service":
-			addService(o, interim)
-		case "environment":
-			addEnvironment(o, interim)
-		case "credential":
-			addCredential(o, interim)
-		}
+	name, _ := o["metadata_kind"].(string)
+	if kind, ok := lookupKind(name); ok {
+		kind.Process(o, interim)
+	} else {
+		interim.UnknownKinds[name]++
 	}
 }
 
@@ -437,7 +464,11 @@ func addContainer(container map[string]interface{}, interim *Interim) {
 }
 
 func addService(service map[string]interface{}, interim *Interim) {
-	interim.UUIDToService[getServiceUUID(service["uuid"].(string), service["name"].(string))] = service
+	sUUID := getServiceUUID(service["uuid"].(string), service["name"].(string))
+	interim.UUIDToService[sUUID] = service
+	// add itself to the stack list
+	stackUUID := stringField(service, "stack_uuid")
+	interim.StackUUIDToServicesUUID[stackUUID] = append(interim.StackUUIDToServicesUUID[stackUUID], sUUID)
 }
 
 func addServiceContainerLink(link map[string]interface{}, interim *Interim) {
@@ -452,10 +483,7 @@ func addServiceContainerLink(link map[string]interface{}, interim *Interim) {
 
 func addServiceLink(link map[string]interface{}, interim *Interim) {
 	serviceUUID := link["service_uuid"].(string)
-	links := make(map[string]interface{})
-	if _, ok := interim.ServiceUUIDToServiceLink[serviceUUID]; ok {
-		links = interim.ServiceUUIDToServiceLink[serviceUUID]
-	}
+	links := copyObject(interim.ServiceUUIDToServiceLink[serviceUUID])
 	linkKey := link["key"].(string)
 	links[linkKey] = link["value"].(string)
 
@@ -464,10 +492,7 @@ func addServiceLink(link map[string]interface{}, interim *Interim) {
 
 func addContainerLink(link map[string]interface{}, interim *Interim) {
 	containerUUID := link["container_uuid"].(string)
-	links := make(map[string]interface{})
-	if _, ok := interim.ContainerUUIDToContainerLink[containerUUID]; ok {
-		links = interim.ContainerUUIDToContainerLink[containerUUID]
-	}
+	links := copyObject(interim.ContainerUUIDToContainerLink[containerUUID])
 	linkKey := link["key"].(string)
 	links[linkKey] = link["value"].(string)
 
@@ -494,12 +519,36 @@ func addDefault(def map[string]interface{}, interim *Interim) {
 	interim.Default = def
 }
 
-func (g *Generator) GenerateDelta(body io.Reader) ([]map[string]interface{}, string, error) {
+// Delta is a compressed delta from Rancher, decoded but not applied yet
+type Delta struct {
+	Version string
+	Objects []map[string]interface{}
+	content []byte
+}
+
+// DecodeDelta reads and decodes a compressed delta.  It is only kept, to be
+// saved and reported, once its answers are served: see ApplyDelta.
+func (g *Generator) DecodeDelta(body io.Reader) (*Delta, error) {
 	content, err := ioutil.ReadAll(body)
 	if err != nil {
-		return nil, "", err
+		return nil, err
+	}
+
+	data, version, err := g.decodeDelta(content)
+	if err != nil {
+		return nil, err
 	}
+	return &Delta{Version: version, Objects: data, content: content}, nil
+}
+
+// ApplyDelta keeps the delta whose answers are served, for SaveToFile and
+// RecordSnapshot
+func (g *Generator) ApplyDelta(d *Delta) {
+	g.reloadDelta(d.Version, d.content)
+}
 
+// decodeDelta decodes the metadata objects of a compressed delta
+func (g *Generator) decodeDelta(content []byte) ([]map[string]interface{}, string, error) {
 	r := flate.NewReader(bytes.NewBuffer(content))
 
 	defer r.Close()
@@ -526,11 +575,10 @@ func (g *Generator) GenerateDelta(body io.Reader) ([]map[string]interface{}, str
 			data = append(data, o)
 			kind := o["metadata_kind"]
 			if kind == "defaultData" {
-				version = o["version"].(string)
+				version, _ = o["version"].(string)
 			}
 		}
 	}
-	g.reloadDelta(version, content)
 	return data, version, nil
 }
 
@@ -541,12 +589,20 @@ func (g *Generator) reloadDelta(version string, data []byte) {
 	g.delta.Data = data
 }
 
+// DeltaVersion returns the version of Rancher the answers were last
+// generated from
+func (g *Generator) DeltaVersion() string {
+	g.delta.Lock()
+	defer g.delta.Unlock()
+	return g.delta.Version
+}
+
 func (g *Generator) SaveToFile(t time.Time) {
 	g.delta.Lock()
 	defer g.delta.Unlock()
 	currentVersion := g.delta.Version
 	if g.savedVersion != g.delta.Version && len(g.delta.Data) > 0 {
-		err := g.saveDeltaToFile()
+		err := g.saveDeltaToFile(t)
 		if err != nil {
 			log.Errorf("Failed to save delta to file: [%v]", err)
 		} else {
@@ -556,91 +612,126 @@ func (g *Generator) SaveToFile(t time.Time) {
 	}
 }
 
-func (g *Generator) saveDeltaToFile() error {
-	tempFile := g.answersFilePath + ".temp"
-	out, err := os.Create(tempFile)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		out.Close()
-		os.Remove(tempFile)
-	}()
-
-	err = json.NewEncoder(out).Encode(g.delta)
-	if err != nil {
-		return err
+// saveDeltaToFile writes the delta to the answers file, keeping the file it
+// replaces as the previous snapshot if it is good
+func (g *Generator) saveDeltaToFile(t time.Time) error {
+	if _, err := readSnapshotFile(g.answersFilePath); err == nil {
+		if err := os.Rename(g.answersFilePath, g.previousFilePath()); err != nil {
+			return err
+		}
 	}
+	return writeSnapshotFile(g.answersFilePath, g.delta.Version, t, g.delta.Data)
+}
 
-	os.Rename(tempFile, g.answersFilePath)
-	return nil
+func (g *Generator) previousFilePath() string {
+	return g.answersFilePath + ".previous"
 }
 
-func (g *Generator) readVersionsFromFile() (Versions, []Credential, error) {
-	var v Versions
-	var md MetadataDelta
-	f, err := os.Open(g.answersFilePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			log.Warn("Failed to find: ", g.answersFilePath)
-			return v, nil, nil
+// snapshotFiles returns the files answers can be loaded from, best first:
+// the answers file, the one it replaced and then the history
+func (g *Generator) snapshotFiles() []string {
+	files := []string{g.answersFilePath, g.previousFilePath()}
+	if g.history != nil {
+		g.history.Lock()
+		ids, _ := g.history.ids()
+		g.history.Unlock()
+		for _, id := range ids {
+			files = append(files, filepath.Join(g.history.dir, id+snapshotSuffix))
 		}
-		return nil, nil, err
 	}
-	defer f.Close()
+	return files
+}
 
-	err = json.NewDecoder(f).Decode(&md)
-	if err != nil {
-		return nil, nil, err
-	}
+// readVersionsFromFile generates the answers of the first good snapshot file
+func (g *Generator) readVersionsFromFile() (Versions, Lookups, []Credential, error) {
+	for _, file := range g.snapshotFiles() {
+		md, err := readSnapshotFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			log.Warnf("Skipping snapshot: %v", err)
+			continue
+		}
 
-	delta, _, err := g.GenerateDelta(bytes.NewBuffer(md.Data))
-	if err != nil {
-		return v, nil, err
+		delta, err := g.DecodeDelta(bytes.NewBuffer(md.Data))
+		if err != nil {
+			log.Warnf("Skipping snapshot [%s]: failed to decode delta: %v", file, err)
+			continue
+		}
+		versions, lookups, creds, err := g.GenerateAnswers(delta.Objects)
+		if err != nil {
+			log.Warnf("Skipping snapshot [%s]: %v", file, err)
+			continue
+		}
+		g.ApplyDelta(delta)
+		if file != g.answersFilePath {
+			log.Warnf("Loaded answers from snapshot [%s] of version [%s] instead of %s", file, md.Version, g.answersFilePath)
+		}
+		return versions, lookups, creds, nil
 	}
 
-	v, creds, err := g.GenerateAnswers(delta)
-
-	return v, creds, err
+	log.Errorf("Found no good snapshot to load answers from, starting without answers")
+	return nil, nil, nil, nil
 }
 
-func (g *Generator) LoadVersionsFromFile(ignoreIfMissing bool) (Versions, []Credential, error) {
+func (g *Generator) LoadVersionsFromFile(ignoreIfMissing bool) (Versions, Lookups, []Credential, error) {
 	log.Infof("Loading answers from file %s", g.answersFilePath)
-	if _, err := os.Stat(g.answersFilePath); err == nil {
-		versions, creds, err := g.readVersionsFromFile()
-		if err != nil {
-			return nil, nil, fmt.Errorf("Failed to load answers from file %s: %v", g.answersFilePath, err)
-		}
-		return versions, creds, nil
-	} else {
-		if ignoreIfMissing {
-			return nil, nil, nil
-		}
-		return nil, nil, fmt.Errorf("Failed to load answers from file %s: %v", g.answersFilePath, err)
+	_, err := os.Stat(g.answersFilePath)
+	if err == nil {
+		return g.readVersionsFromFile()
+	}
+	if _, previousErr := os.Stat(g.previousFilePath()); previousErr == nil {
+		log.Warnf("Failed to find %s: %v", g.answersFilePath, err)
+		return g.readVersionsFromFile()
 	}
+	if ignoreIfMissing {
+		return nil, nil, nil, nil
+	}
+	return nil, nil, nil, fmt.Errorf("Failed to load answers from file %s: %v", g.answersFilePath, err)
 }
 
+// MergeVersions returns the local answers with the other environments and the
+// id of the merged answers added for every client.  local is left unchanged,
+// since its answers may be being served.
 func MergeVersions(local Versions, external []Versions, version string) Versions {
 	if len(local.Versions()) == 0 {
 		return local
 	}
-	var environments []interface{}
-	for _, v := range external {
-		if _, ok := v[METADATA_VERSION3][DEFAULT_KEY]; ok {
-			externalData := v[METADATA_VERSION3][DEFAULT_KEY].(map[string]interface{})
-			environments = append(environments, externalData)
-		}
+	merged := make(Versions, len(local))
+	for name, answers := range local {
+		merged[name] = answers
 	}
-	for _, v := range SUPPORTED_VERSIONS {
-		for key, value := range local[v] {
-			localData := value.(map[string]interface{})
-			if v == METADATA_VERSION3 {
+	for _, v := range SupportedVersions() {
+		answers, ok := local[v]
+		if !ok {
+			continue
+		}
+		withEnvironments := lookupVersionSpec(v).Environments
+		// the other environments, rendered in the same version
+		var environments []interface{}
+		for _, e := range external {
+			if externalData, ok := e[v][DEFAULT_KEY].(map[string]interface{}); ok {
+				environments = append(environments, externalData)
+			}
+		}
+		out := make(Answers, len(answers))
+		for key, value := range answers {
+			localData, ok := value.(map[string]interface{})
+			if !ok {
+				out[key] = value
+				continue
+			}
+			localData = copyObject(localData)
+			if withEnvironments {
 				localData[ENVIRONMENT_KEY] = environments
 			}
 			localData[VERSION_KEY] = version
-			local[v][key] = localData
+			out[key] = localData
+		}
+		merged[v] = out
+		if latest, ok := local[LATEST_KEY]; ok && reflect.ValueOf(latest).Pointer() == reflect.ValueOf(answers).Pointer() {
+			merged[LATEST_KEY] = out
 		}
 	}
-
-	return local
+	return merged
 }
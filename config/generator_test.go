@@ -0,0 +1,376 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func testObjects() []map[string]interface{} {
+	return []map[string]interface{}{
+		{"metadata_kind": "defaultData", "version": "1"},
+		{"metadata_kind": "stack", "uuid": "stack-1", "name": "Stack"},
+		{"metadata_kind": "stack", "uuid": "stack-2", "name": "Other"},
+		{"metadata_kind": "service", "uuid": "service-1", "name": "Web", "stack_uuid": "stack-1",
+			"stack_name": "Stack", "primary_service_name": "Web", "token": "secret"},
+		{"metadata_kind": "service", "uuid": "service-2", "name": "DB", "stack_uuid": "stack-2",
+			"stack_name": "Other", "primary_service_name": "DB"},
+		{"metadata_kind": "host", "uuid": "host-1", "name": "host1", "hostId": 1},
+		{"metadata_kind": "host", "uuid": "host-2", "name": "host2", "hostId": 2},
+		{"metadata_kind": "container", "uuid": "container-1", "name": "Stack-Web-1", "primary_ip": "10.42.0.1",
+			"host_uuid": "host-1", "stack_uuid": "stack-1", "service_uuid": "service-1", "service_name": "Web"},
+		{"metadata_kind": "container", "uuid": "container-2", "name": "Other-DB-1", "primary_ip": "10.42.0.2",
+			"host_uuid": "host-2", "stack_uuid": "stack-2", "service_uuid": "service-2", "service_name": "DB"},
+		{"metadata_kind": "serviceContainerLink", "service_uuid": "service-1", "service_name": "Web", "container_uuid": "container-1"},
+		{"metadata_kind": "serviceContainerLink", "service_uuid": "service-2", "service_name": "DB", "container_uuid": "container-2"},
+		{"metadata_kind": "serviceLink", "service_uuid": "service-1", "key": "Other/DB", "value": "db"},
+	}
+}
+
+// canonical round-trips v through JSON, so that answers built from different
+// Go types compare equal.  Arrays keep their order, which the array order
+// makes deterministic.
+func canonical(t *testing.T, v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestIncrementalGenerationMatchesFull(t *testing.T) {
+	objects := testObjects()
+	steps := []func([]map[string]interface{}) []map[string]interface{}{
+		func(data []map[string]interface{}) []map[string]interface{} {
+			data[7] = copyObject(data[7])
+			data[7]["name"] = "Stack-Web-renamed"
+			return data
+		},
+		func(data []map[string]interface{}) []map[string]interface{} {
+			data[8] = copyObject(data[8])
+			data[8]["host_uuid"] = "host-1"
+			return data
+		},
+		func(data []map[string]interface{}) []map[string]interface{} {
+			data[5] = copyObject(data[5])
+			data[5]["name"] = "host1-renamed"
+			return data
+		},
+		func(data []map[string]interface{}) []map[string]interface{} {
+			data[3] = copyObject(data[3])
+			data[3]["token"] = "rotated"
+			return data
+		},
+		func(data []map[string]interface{}) []map[string]interface{} {
+			// drop the service link
+			return data[:len(data)-1]
+		},
+		func(data []map[string]interface{}) []map[string]interface{} {
+			return append(data,
+				map[string]interface{}{"metadata_kind": "container", "uuid": "container-3", "name": "Stack-Web-2",
+					"primary_ip": "10.42.0.3", "host_uuid": "host-2", "stack_uuid": "stack-1", "service_uuid": "service-1",
+					"service_name": "Web"},
+				map[string]interface{}{"metadata_kind": "serviceContainerLink", "service_uuid": "service-1",
+					"service_name": "Web", "container_uuid": "container-3"})
+		},
+		func(data []map[string]interface{}) []map[string]interface{} {
+			// remove the second stack with its service and container
+			var out []map[string]interface{}
+			for _, o := range data {
+				if o["uuid"] == "stack-2" || o["uuid"] == "service-2" || o["uuid"] == "container-2" || o["service_uuid"] == "service-2" {
+					continue
+				}
+				out = append(out, o)
+			}
+			return out
+		},
+	}
+
+	incremental := NewGenerator(true, "", false, 0)
+	if _, _, _, err := incremental.GenerateAnswers(objects); err != nil {
+		t.Fatal(err)
+	}
+	for i, step := range steps {
+		objects = step(append([]map[string]interface{}(nil), objects...))
+		got, _, _, err := incremental.GenerateAnswers(objects)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _, _, err := NewGenerator(true, "", false, 0).GenerateAnswers(objects)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(canonical(t, got), canonical(t, want)) {
+			t.Errorf("step %d: incremental answers differ from a full generation", i)
+		}
+	}
+}
+
+func TestInvalidObjectsAreSkipped(t *testing.T) {
+	objects := append(testObjects(),
+		map[string]interface{}{"metadata_kind": "container", "uuid": "container-9", "primary_ip": "10.42.0.9",
+			"stack_uuid": "stack-1", "ports": []interface{}{"80:80", 443}},
+		map[string]interface{}{"metadata_kind": "host", "name": "nameless"},
+		map[string]interface{}{"metadata_kind": "credential", "url": "http://example.com", "public_value": "key"})
+
+	g := NewGenerator(true, "", false, 0)
+	versions, _, creds, err := g.GenerateAnswers(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := versions[METADATA_VERSION3]["10.42.0.9"]; ok {
+		t.Error("container with an invalid port was rendered")
+	}
+	if len(creds) != 0 {
+		t.Errorf("credential without a secret was rendered: %v", creds)
+	}
+
+	want := []ValidationError{
+		{Kind: "container", UUID: "container-9", Field: "ports[1]", Reason: "is a int, expected a string"},
+		{Kind: "host", Field: "uuid", Reason: "is missing"},
+		{Kind: "credential", Field: "secret_value", Reason: "is missing"},
+	}
+	if got := g.InvalidObjects(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got invalid objects %v, want %v", got, want)
+	}
+
+	if _, _, _, err := NewGenerator(true, "", true, 0).GenerateAnswers(objects); err == nil {
+		t.Error("strict generator accepted invalid objects")
+	}
+}
+
+func TestVersionsDoNotDependOnGenerationOrder(t *testing.T) {
+	objects := testObjects()
+	objects[0]["self"] = map[string]interface{}{"host": map[string]interface{}{"uuid": "host-1"}}
+	objects[7]["ports"] = []interface{}{"8080:80/tcp"}
+	input := canonical(t, objects)
+
+	orders := [][]string{
+		{METADATA_VERSION1, METADATA_VERSION2, METADATA_VERSION3},
+		{METADATA_VERSION3, METADATA_VERSION2, METADATA_VERSION1},
+		{METADATA_VERSION2, METADATA_VERSION3, METADATA_VERSION1},
+	}
+	var first interface{}
+	for _, order := range orders {
+		g := NewGenerator(true, "", false, 0)
+		g.supportedVersions = order
+		versions, _, _, err := g.GenerateAnswers(objects)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(canonical(t, objects), input) {
+			t.Fatalf("generating %v modified the metadata objects", order)
+		}
+
+		v1 := versions[METADATA_VERSION1]["10.42.0.1"].(map[string]interface{})
+		v3 := versions[METADATA_VERSION3]["10.42.0.1"].(map[string]interface{})
+		if name := v1["self"].(map[string]interface{})["container"].(map[string]interface{})["name"]; name != "Stack-Web-1" {
+			t.Errorf("order %v: %s container name is %v", order, METADATA_VERSION1, name)
+		}
+		if name := v3["self"].(map[string]interface{})["container"].(map[string]interface{})["name"]; name != "stack-web-1" {
+			t.Errorf("order %v: %s container name is %v", order, METADATA_VERSION3, name)
+		}
+		if _, ok := v1["self"].(map[string]interface{})["host"].(map[string]interface{})["hostId"]; !ok {
+			t.Errorf("order %v: %s self host lost its hostId", order, METADATA_VERSION1)
+		}
+		defaultSelf := versions[METADATA_VERSION1][DEFAULT_KEY].(map[string]interface{})["self"].(map[string]interface{})
+		if _, ok := defaultSelf["host"].(map[string]interface{})["hostId"]; !ok {
+			t.Errorf("order %v: %s default self host lost its hostId", order, METADATA_VERSION1)
+		}
+		if token := v3["self"].(map[string]interface{})["service"].(map[string]interface{})["token"]; token != "secret" {
+			t.Errorf("order %v: self service token is %v", order, token)
+		}
+		for _, s := range v3["services"].([]interface{}) {
+			if token := s.(map[string]interface{})["token"]; token != nil {
+				t.Errorf("order %v: service token %v is visible to every client", order, token)
+			}
+		}
+
+		got := canonical(t, versions)
+		if first == nil {
+			first = got
+		} else if !reflect.DeepEqual(got, first) {
+			t.Errorf("generating versions in order %v changed the answers", order)
+		}
+	}
+}
+
+// restoreVersionSpecs returns a function restoring the version specs
+// registered now
+func restoreVersionSpecs() func() {
+	specs.Lock()
+	defer specs.Unlock()
+	saved := make(map[string]*VersionSpec, len(specs.byName))
+	for name, spec := range specs.byName {
+		saved[name] = spec
+	}
+	return func() {
+		specs.Lock()
+		defer specs.Unlock()
+		specs.byName = saved
+	}
+}
+
+func TestVersionSpecs(t *testing.T) {
+	parsed, err := ParseVersionSpecs([]byte(`
+versions:
+- name: 2017-06-01
+  containers:
+    lowercase: [name]
+    rename: {primary_ip: ip}
+  services:
+    children: names
+  hosts:
+    remove: [hostId, name]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restoreVersionSpecs()()
+	RegisterVersionSpec(parsed[0])
+
+	versions, _, _, err := NewGenerator(true, "", false, 0).GenerateAnswers(testObjects())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.ValueOf(versions[LATEST_KEY]).Pointer() != reflect.ValueOf(versions["2017-06-01"]).Pointer() {
+		t.Error("latest isn't the newest version")
+	}
+	self := versions["2017-06-01"]["10.42.0.1"].(map[string]interface{})["self"].(map[string]interface{})
+	container := self["container"].(map[string]interface{})
+	if container["name"] != "stack-web-1" || container["ip"] != "10.42.0.1" || container["primary_ip"] != nil {
+		t.Errorf("container wasn't rewritten: %v", container)
+	}
+	if containers := self["service"].(map[string]interface{})["containers"]; !reflect.DeepEqual(containers, []interface{}{"stack-web-1"}) {
+		t.Errorf("service containers are %v", containers)
+	}
+	if host := self["host"].(map[string]interface{}); host["name"] != nil || host["hostId"] != nil || host["uuid"] != "host-1" {
+		t.Errorf("host wasn't rewritten: %v", host)
+	}
+
+	for _, bad := range []string{"versions: [{name: latest}]", "versions: [{name: 2017-06-01, containers: {ports: all}}]"} {
+		if _, err := ParseVersionSpecs([]byte(bad)); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+func TestEnvironmentsFollowVersionSpecs(t *testing.T) {
+	defer restoreVersionSpecs()()
+	RegisterVersionSpec(VersionSpec{Name: "2017-06-01", Environments: true})
+
+	external, _, _, err := NewGenerator(false, "", false, 0).GenerateAnswers(testObjects())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := external[METADATA_VERSION2]; ok {
+		t.Errorf("other environment rendered in %s, which doesn't show environments", METADATA_VERSION2)
+	}
+	local, _, _, err := NewGenerator(true, "", false, 0).GenerateAnswers(testObjects())
+	if err != nil {
+		t.Fatal(err)
+	}
+	merged := MergeVersions(local, []Versions{external}, "1")
+	for version, want := range map[string]int{METADATA_VERSION2: 0, METADATA_VERSION3: 1, "2017-06-01": 1} {
+		environments, _ := merged[version][DEFAULT_KEY].(map[string]interface{})[ENVIRONMENT_KEY].([]interface{})
+		if len(environments) != want {
+			t.Errorf("%s has %d environments, want %d", version, len(environments), want)
+		}
+	}
+}
+
+func TestMergeVersionsLeavesLocalUnchanged(t *testing.T) {
+	local, _, _, err := NewGenerator(true, "", false, 0).GenerateAnswers(testObjects())
+	if err != nil {
+		t.Fatal(err)
+	}
+	external, _, _, err := NewGenerator(false, "", false, 0).GenerateAnswers(testObjects())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := MergeVersions(local, nil, "1")
+	second := MergeVersions(local, []Versions{external}, "2")
+
+	for _, client := range []string{DEFAULT_KEY, "10.42.0.1"} {
+		answers := local[METADATA_VERSION3][client].(map[string]interface{})
+		if _, ok := answers[ENVIRONMENT_KEY]; ok {
+			t.Errorf("%s: the environments were added to the local answers", client)
+		}
+		if v := first[METADATA_VERSION3][client].(map[string]interface{})[VERSION_KEY]; v != "1" {
+			t.Errorf("%s: a later merge changed the version of an earlier one to %v", client, v)
+		}
+		environments, _ := second[METADATA_VERSION3][client].(map[string]interface{})[ENVIRONMENT_KEY].([]interface{})
+		if len(environments) != 1 {
+			t.Errorf("%s: expected an environment, got %v", client, environments)
+		}
+	}
+	if reflect.ValueOf(second[LATEST_KEY]).Pointer() != reflect.ValueOf(second[latestVersion(SupportedVersions())]).Pointer() {
+		t.Error("latest isn't the merged answers of the latest version")
+	}
+}
+
+func TestArraysAreSorted(t *testing.T) {
+	objects := testObjects()
+	objects[7]["create_index"] = 2
+	objects[8]["create_index"] = 1
+	objects = append(objects,
+		map[string]interface{}{"metadata_kind": "container", "uuid": "container-3", "name": "A", "primary_ip": "10.42.0.3",
+			"service_uuid": "service-1", "service_name": "Web", "stack_uuid": "stack-1"},
+		map[string]interface{}{"metadata_kind": "serviceContainerLink", "service_uuid": "service-1", "service_name": "Web",
+			"container_uuid": "container-3"},
+		map[string]interface{}{"metadata_kind": "container", "uuid": "container-0", "name": "A", "primary_ip": "10.42.0.4"},
+		map[string]interface{}{"metadata_kind": "network", "uuid": "network-2", "name": "managed"},
+		map[string]interface{}{"metadata_kind": "network", "uuid": "network-1", "name": "ipsec"})
+
+	var first []byte
+	for i := 0; i < 10; i++ {
+		versions, _, _, err := NewGenerator(true, "", false, 0).GenerateAnswers(objects)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(versions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = b
+		} else if string(b) != string(first) {
+			t.Fatal("answers changed between generations")
+		}
+
+		var uuids []interface{}
+		for _, c := range versions[METADATA_VERSION2][DEFAULT_KEY].(map[string]interface{})["containers"].([]interface{}) {
+			uuids = append(uuids, c.(map[string]interface{})["uuid"])
+		}
+		if want := []interface{}{"container-2", "container-1", "container-0", "container-3"}; !reflect.DeepEqual(uuids, want) {
+			t.Fatalf("containers are in order %v, want %v", uuids, want)
+		}
+		service := versions[METADATA_VERSION1]["10.42.0.1"].(map[string]interface{})["self"].(map[string]interface{})["service"]
+		if names := service.(map[string]interface{})["containers"]; !reflect.DeepEqual(names, []interface{}{"Stack-Web-1", "A"}) {
+			t.Fatalf("service containers are in order %v", names)
+		}
+		networks := versions[METADATA_VERSION3][DEFAULT_KEY].(map[string]interface{})["networks"].([]interface{})
+		if len(networks) != 2 || networks[0].(map[string]interface{})["name"] != "ipsec" {
+			t.Fatalf("networks are in order %v", networks)
+		}
+	}
+
+	kind := NewObjectKind("volume", "volumes")
+	interim := newInterim()
+	for _, name := range []string{"c", "a", "b"} {
+		kind.Process(map[string]interface{}{"metadata_kind": "volume", "name": name}, interim)
+	}
+	answers := make(map[string]interface{})
+	kind.Render(&RenderContext{Interim: interim}, answers)
+	var names []interface{}
+	for _, v := range answers["volumes"].([]interface{}) {
+		names = append(names, v.(map[string]interface{})["name"])
+	}
+	if want := []interface{}{"a", "b", "c"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("objects of a registered kind are in order %v, want %v", names, want)
+	}
+}
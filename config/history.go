@@ -0,0 +1,284 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/log"
+)
+
+const (
+	SNAPSHOT_ID_FORMAT = "20060102T150405.000000000Z"
+	snapshotSuffix     = ".json"
+	pinFile            = "pinned"
+)
+
+// Snapshot describes a delta kept in the history
+type Snapshot struct {
+	ID      string    `json:"id" yaml:"id"`
+	Version string    `json:"version" yaml:"version"`
+	Time    time.Time `json:"time" yaml:"time"`
+	Pinned  bool      `json:"pinned" yaml:"pinned"`
+}
+
+// History keeps the newest deltas in a directory, one file each.  A pinned
+// snapshot is never pruned.
+type History struct {
+	sync.Mutex
+	dir         string
+	size        int
+	lastVersion string
+}
+
+func NewHistory(dir string, size int) *History {
+	return &History{
+		dir:  dir,
+		size: size,
+	}
+}
+
+// Add writes delta to the history unless it is the version added last, and
+// prunes the oldest snapshots beyond the size of the history
+func (h *History) Add(version string, data []byte, t time.Time) error {
+	h.Lock()
+	defer h.Unlock()
+	if h.lastVersion == "" {
+		// carry on from the history of a previous run
+		if ids, err := h.ids(); err == nil && len(ids) > 0 {
+			if s, err := h.read(ids[0]); err == nil {
+				h.lastVersion = s.Version
+			}
+		}
+	}
+	if version == h.lastVersion || len(data) == 0 {
+		return nil
+	}
+
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		return err
+	}
+	id := t.UTC().Format(SNAPSHOT_ID_FORMAT)
+	if err := writeSnapshotFile(filepath.Join(h.dir, id+snapshotSuffix), version, t, data); err != nil {
+		return err
+	}
+	h.lastVersion = version
+
+	return h.prune()
+}
+
+func (h *History) prune() error {
+	ids, err := h.ids()
+	if err != nil {
+		return err
+	}
+	pinned, _ := h.pinned()
+	count := len(ids)
+	for i := len(ids) - 1; i >= 0 && count > h.size; i-- {
+		id := ids[i]
+		if id == pinned {
+			continue
+		}
+		count--
+		if err := os.Remove(filepath.Join(h.dir, id+snapshotSuffix)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ids returns the ids of the snapshots, newest first
+func (h *History) ids() ([]string, error) {
+	files, err := ioutil.ReadDir(h.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(name, snapshotSuffix)
+		if _, err := time.Parse(SNAPSHOT_ID_FORMAT, id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	return ids, nil
+}
+
+// List returns the snapshots, newest first
+func (h *History) List() ([]Snapshot, error) {
+	h.Lock()
+	defer h.Unlock()
+	ids, err := h.ids()
+	if err != nil {
+		return nil, err
+	}
+	pinned, _ := h.pinned()
+	snapshots := []Snapshot{}
+	for _, id := range ids {
+		s, err := h.read(id)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, Snapshot{ID: id, Version: s.Version, Time: s.Time, Pinned: id == pinned})
+	}
+	return snapshots, nil
+}
+
+func (h *History) read(id string) (*snapshotFile, error) {
+	if _, err := time.Parse(SNAPSHOT_ID_FORMAT, id); err != nil {
+		return nil, fmt.Errorf("Invalid snapshot id [%s]", id)
+	}
+	return readSnapshotFile(filepath.Join(h.dir, id+snapshotSuffix))
+}
+
+// Get returns the delta of a snapshot
+func (h *History) Get(id string) (Snapshot, []byte, error) {
+	h.Lock()
+	defer h.Unlock()
+	s, err := h.read(id)
+	if err != nil {
+		return Snapshot{}, nil, err
+	}
+	pinned, _ := h.pinned()
+	return Snapshot{ID: id, Version: s.Version, Time: s.Time, Pinned: id == pinned}, s.Data, nil
+}
+
+// Pin marks a snapshot as the one to serve until Unpin
+func (h *History) Pin(id string) error {
+	h.Lock()
+	defer h.Unlock()
+	if _, err := h.read(id); err != nil {
+		return err
+	}
+	return WriteFileAtomic(filepath.Join(h.dir, pinFile), []byte(id), 0666)
+}
+
+func (h *History) Unpin() error {
+	h.Lock()
+	defer h.Unlock()
+	if err := os.Remove(filepath.Join(h.dir, pinFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Pinned returns the id of the pinned snapshot, if any
+func (h *History) Pinned() (string, bool) {
+	h.Lock()
+	defer h.Unlock()
+	return h.pinned()
+}
+
+func (h *History) pinned() (string, bool) {
+	content, err := ioutil.ReadFile(filepath.Join(h.dir, pinFile))
+	if err != nil {
+		return "", false
+	}
+	id := strings.TrimSpace(string(content))
+	return id, id != ""
+}
+
+// RecordSnapshot adds the current delta to the history, if it is kept
+func (g *Generator) RecordSnapshot(t time.Time) {
+	if g.history == nil {
+		return
+	}
+	g.delta.Lock()
+	version, data := g.delta.Version, g.delta.Data
+	g.delta.Unlock()
+	if err := g.history.Add(version, data, t); err != nil {
+		log.Errorf("Failed to add version [%s] to the history: %v", version, err)
+	}
+}
+
+func (g *Generator) getHistory() (*History, error) {
+	if g.history == nil {
+		return nil, fmt.Errorf("No history is kept")
+	}
+	return g.history, nil
+}
+
+// Snapshots returns the snapshots in the history, newest first
+func (g *Generator) Snapshots() ([]Snapshot, error) {
+	h, err := g.getHistory()
+	if err != nil {
+		return nil, err
+	}
+	return h.List()
+}
+
+// Pinned returns the id of the pinned snapshot, if any.  Deltas from Rancher
+// shouldn't be applied while a snapshot is pinned.
+func (g *Generator) Pinned() (string, bool) {
+	if g.history == nil {
+		return "", false
+	}
+	return g.history.Pinned()
+}
+
+// Rollback generates the answers of a snapshot and pins it
+func (g *Generator) Rollback(id string) (Versions, Lookups, []Credential, string, error) {
+	h, err := g.getHistory()
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+	_, content, err := h.Get(id)
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+	delta, err := g.DecodeDelta(bytes.NewReader(content))
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+	versions, lookups, creds, err := g.GenerateAnswers(delta.Objects)
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+	if err := h.Pin(id); err != nil {
+		return nil, nil, nil, "", err
+	}
+	g.ApplyDelta(delta)
+	return versions, lookups, creds, delta.Version, nil
+}
+
+func (g *Generator) Unpin() error {
+	h, err := g.getHistory()
+	if err != nil {
+		return err
+	}
+	return h.Unpin()
+}
+
+// SnapshotVersions generates the answers of a snapshot, apart from the live
+// answers
+func (g *Generator) SnapshotVersions(id string) (Versions, error) {
+	h, err := g.getHistory()
+	if err != nil {
+		return nil, err
+	}
+	snapshot, content, err := h.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := g.decodeDelta(content)
+	if err != nil {
+		return nil, err
+	}
+	versions, _, _, err := NewGenerator(g.local, "", g.strictSchema, 0).GenerateAnswers(data)
+	if err != nil {
+		return nil, err
+	}
+	return MergeVersions(versions, nil, snapshot.Version), nil
+}
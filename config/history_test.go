@@ -0,0 +1,64 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistoryKeepsNewestSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := NewHistory(dir, 3)
+	start := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i, version := range []string{"1", "1", "2", "3", "4"} {
+		if err := h.Add(version, []byte(version), start.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if version == "2" {
+			if err := h.Pin(start.Add(time.Duration(i) * time.Second).Format(SNAPSHOT_ID_FORMAT)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := h.Add("5", []byte("5"), start.Add(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err := h.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var versions []string
+	for _, s := range snapshots {
+		versions = append(versions, s.Version)
+		if s.Pinned != (s.Version == "2") {
+			t.Errorf("snapshot of version %s pinned=%v", s.Version, s.Pinned)
+		}
+	}
+	// the pinned snapshot survives pruning
+	if want := []string{"5", "4", "2"}; !reflect.DeepEqual(versions, want) {
+		t.Errorf("kept versions %v, want %v", versions, want)
+	}
+
+	// a new run carries on from the newest snapshot
+	if err := NewHistory(dir, 3).Add("5", []byte("5"), start.Add(20*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if snapshots, _ := h.List(); len(snapshots) != 3 {
+		t.Errorf("re-adding the newest version added a snapshot: %v", snapshots)
+	}
+
+	if err := h.Unpin(); err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := h.Pinned(); ok {
+		t.Errorf("%s still pinned", id)
+	}
+}
@@ -0,0 +1,375 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Changes names what changed since the previous generation by the keys of the
+// Interim maps the objects are kept in.  A nil *Changes means everything did.
+type Changes struct {
+	Containers map[string]bool
+	Services   map[string]bool
+	Stacks     map[string]bool
+	Hosts      map[string]bool
+}
+
+func newChanges() *Changes {
+	return &Changes{
+		Containers: make(map[string]bool),
+		Services:   make(map[string]bool),
+		Stacks:     make(map[string]bool),
+		Hosts:      make(map[string]bool),
+	}
+}
+
+func (c *Changes) Container(uuid string) bool {
+	return c == nil || c.Containers[uuid]
+}
+
+func (c *Changes) Service(serviceUUID string) bool {
+	return c == nil || c.Services[serviceUUID]
+}
+
+func (c *Changes) Stack(uuid string) bool {
+	return c == nil || c.Stacks[uuid]
+}
+
+func (c *Changes) Host(uuid string) bool {
+	return c == nil || c.Hosts[uuid]
+}
+
+func (c *Changes) Empty() bool {
+	return c != nil && len(c.Containers) == 0 && len(c.Services) == 0 && len(c.Stacks) == 0 && len(c.Hosts) == 0
+}
+
+// propagate marks everything rendered from a changed object.  A service
+// embeds its containers and sets their service and stack fields, and a stack
+// embeds its services.
+func (c *Changes) propagate(interim *Interim) {
+	for {
+		grown := false
+		for sUUID, cUUIDs := range interim.ServiceUUIDNameToContainersUUID {
+			serviceChanged := c.Services[sUUID]
+			for _, cUUID := range cUUIDs {
+				if c.Containers[cUUID] && !serviceChanged {
+					c.Services[sUUID], serviceChanged, grown = true, true, true
+				}
+			}
+			if serviceChanged {
+				for _, cUUID := range cUUIDs {
+					if !c.Containers[cUUID] {
+						c.Containers[cUUID], grown = true, true
+					}
+				}
+			}
+		}
+		if !grown {
+			break
+		}
+	}
+
+	for sUUID := range c.Services {
+		if s, ok := interim.UUIDToService[sUUID]; ok {
+			c.Stacks[stringField(s, "stack_uuid")] = true
+		}
+	}
+}
+
+// generatorState is what a Generator keeps between generations
+type generatorState struct {
+	sync.Mutex
+	// objects of kinds with a Remove, by objectKey
+	objects map[string]map[string]interface{}
+	// interim data of kinds with a Remove, as received
+	base *Interim
+	// interim data of each version, with the objects rewritten for it
+	versions map[string]*versionState
+	// hide service tokens from everyone but the containers of the service
+	hideTokens bool
+}
+
+type versionState struct {
+	interim *Interim
+	// self answers of each client by container uuid
+	clients map[string]map[string]interface{}
+}
+
+func newInterim() *Interim {
+	return &Interim{
+		UUIDToService:                   make(map[string]map[string]interface{}),
+		UUIDToContainer:                 make(map[string]map[string]interface{}),
+		UUIDToStack:                     make(map[string]map[string]interface{}),
+		UUIDToHost:                      make(map[string]map[string]interface{}),
+		StackUUIDToServicesUUID:         make(map[string][]string),
+		ServiceUUIDNameToContainersUUID: make(map[string][]string),
+		ContainerUUIDToContainerLink:    make(map[string]map[string]interface{}),
+		ServiceUUIDToServiceLink:        make(map[string]map[string]interface{}),
+		Networks:                        []interface{}{},
+		Default:                         make(map[string]interface{}),
+		Credentials:                     []Credential{},
+		Environment:                     make(map[string]interface{}),
+		Objects:                         make(map[string][]map[string]interface{}),
+		UnknownKinds:                    make(map[string]int),
+	}
+}
+
+func copyObject(o map[string]interface{}) map[string]interface{} {
+	no := make(map[string]interface{}, len(o))
+	for k, v := range o {
+		no[k] = v
+	}
+	return no
+}
+
+// objectKey identifies an object across generations, by uuid if it has one
+// and otherwise by its whole content.
+func objectKey(kind string, o map[string]interface{}) string {
+	if uuid, ok := o["uuid"].(string); ok {
+		return kind + "/" + uuid
+	}
+	return kind + "/" + fmt.Sprint(o)
+}
+
+// update diffs data against the objects of the previous generation and
+// updates the base interim data with the difference.  It returns what
+// changed, nil if this is the first generation, along with the objects of
+// kinds without a Remove, which are processed again for every version.
+func (s *generatorState) update(data []map[string]interface{}) (*Changes, []map[string]interface{}) {
+	var global []map[string]interface{}
+	var keys []string
+	objects := make(map[string]map[string]interface{})
+	for _, o := range data {
+		name, _ := o["metadata_kind"].(string)
+		kind, ok := lookupKind(name)
+		if !ok || kind.Remove == nil {
+			global = append(global, o)
+			continue
+		}
+		key := objectKey(name, o)
+		if _, ok := objects[key]; !ok {
+			keys = append(keys, key)
+		}
+		objects[key] = o
+	}
+
+	var changes *Changes
+	var added []map[string]interface{}
+	if s.objects == nil {
+		s.base = newInterim()
+		for _, key := range keys {
+			added = append(added, objects[key])
+		}
+	} else {
+		changes = newChanges()
+		var removed []map[string]interface{}
+		for key, old := range s.objects {
+			if o, ok := objects[key]; !ok || !reflect.DeepEqual(old, o) {
+				removed = append(removed, old)
+			}
+		}
+		for _, o := range removed {
+			kind, _ := lookupKind(o["metadata_kind"].(string))
+			kind.Touch(o, s.base, changes)
+		}
+		for _, o := range removed {
+			kind, _ := lookupKind(o["metadata_kind"].(string))
+			kind.Remove(o, s.base)
+		}
+		for _, key := range keys {
+			if old, ok := s.objects[key]; !ok || !reflect.DeepEqual(old, objects[key]) {
+				added = append(added, objects[key])
+			}
+		}
+	}
+
+	for _, o := range added {
+		kind, _ := lookupKind(o["metadata_kind"].(string))
+		kind.Process(o, s.base)
+	}
+	if changes != nil {
+		for _, o := range added {
+			kind, _ := lookupKind(o["metadata_kind"].(string))
+			kind.Touch(o, s.base, changes)
+		}
+		changes.propagate(s.base)
+	}
+
+	s.objects = objects
+	return changes, global
+}
+
+// versioned returns the interim data of version, with everything in changes
+// copied again from the base data and the objects in global processed anew.
+func (s *generatorState) versioned(version string, global []map[string]interface{}, changes *Changes) (*versionState, error) {
+	if s.versions == nil {
+		s.versions = make(map[string]*versionState)
+	}
+	vs, ok := s.versions[version]
+	if !ok || changes == nil {
+		vs = &versionState{
+			interim: newInterim(),
+			clients: make(map[string]map[string]interface{}),
+		}
+		s.versions[version] = vs
+		changes = nil
+	}
+
+	interim := newInterim()
+	for _, o := range global {
+		processMetadataObject(copyObject(o), interim)
+	}
+
+	if changes == nil {
+		interim.UUIDToContainer = copyObjects(s.base.UUIDToContainer)
+		interim.UUIDToService = copyObjects(s.base.UUIDToService)
+		interim.UUIDToStack = copyObjects(s.base.UUIDToStack)
+		interim.UUIDToHost = copyObjects(s.base.UUIDToHost)
+	} else {
+		interim.UUIDToContainer = refreshObjects(vs.interim.UUIDToContainer, s.base.UUIDToContainer, changes.Containers)
+		interim.UUIDToService = refreshObjects(vs.interim.UUIDToService, s.base.UUIDToService, changes.Services)
+		interim.UUIDToStack = refreshObjects(vs.interim.UUIDToStack, s.base.UUIDToStack, changes.Stacks)
+		interim.UUIDToHost = refreshObjects(vs.interim.UUIDToHost, s.base.UUIDToHost, changes.Hosts)
+	}
+	if s.hideTokens {
+		for sUUID, service := range interim.UUIDToService {
+			if changes.Service(sUUID) && service["token"] != nil {
+				service["token"] = nil
+			}
+		}
+	}
+	interim.StackUUIDToServicesUUID = s.base.StackUUIDToServicesUUID
+	interim.ServiceUUIDNameToContainersUUID = s.base.ServiceUUIDNameToContainersUUID
+	interim.ContainerUUIDToContainerLink = s.base.ContainerUUIDToContainerLink
+	interim.ServiceUUIDToServiceLink = s.base.ServiceUUIDToServiceLink
+
+	if _, err := applyVersionToData(interim, version, changes); err != nil {
+		return nil, err
+	}
+	vs.interim = interim
+	return vs, nil
+}
+
+func copyObjects(base map[string]map[string]interface{}) map[string]map[string]interface{} {
+	versioned := make(map[string]map[string]interface{}, len(base))
+	for key, o := range base {
+		versioned[key] = copyObject(o)
+	}
+	return versioned
+}
+
+// refreshObjects replaces the changed objects of versioned with copies of
+// those in base.  The map itself is updated in place since only the objects
+// in it are ever served.
+func refreshObjects(versioned, base map[string]map[string]interface{}, changed map[string]bool) map[string]map[string]interface{} {
+	for key := range changed {
+		if o, ok := base[key]; ok {
+			versioned[key] = copyObject(o)
+		} else {
+			delete(versioned, key)
+		}
+	}
+	return versioned
+}
+
+func removeString(values []string, value string) []string {
+	for i, v := range values {
+		if v == value {
+			return append(values[:i:i], values[i+1:]...)
+		}
+	}
+	return values
+}
+
+func removeContainer(container map[string]interface{}, interim *Interim) {
+	delete(interim.UUIDToContainer, container["uuid"].(string))
+}
+
+func touchContainer(container map[string]interface{}, interim *Interim, changes *Changes) {
+	changes.Containers[container["uuid"].(string)] = true
+}
+
+func removeService(service map[string]interface{}, interim *Interim) {
+	sUUID := getServiceUUID(service["uuid"].(string), service["name"].(string))
+	delete(interim.UUIDToService, sUUID)
+	stackUUID := stringField(service, "stack_uuid")
+	interim.StackUUIDToServicesUUID[stackUUID] = removeString(interim.StackUUIDToServicesUUID[stackUUID], sUUID)
+	if len(interim.StackUUIDToServicesUUID[stackUUID]) == 0 {
+		delete(interim.StackUUIDToServicesUUID, stackUUID)
+	}
+}
+
+func touchService(service map[string]interface{}, interim *Interim, changes *Changes) {
+	changes.Services[getServiceUUID(service["uuid"].(string), service["name"].(string))] = true
+	changes.Stacks[stringField(service, "stack_uuid")] = true
+}
+
+func removeStack(stack map[string]interface{}, interim *Interim) {
+	delete(interim.UUIDToStack, stack["uuid"].(string))
+}
+
+func touchStack(stack map[string]interface{}, interim *Interim, changes *Changes) {
+	changes.Stacks[stack["uuid"].(string)] = true
+}
+
+func removeHost(host map[string]interface{}, interim *Interim) {
+	delete(interim.UUIDToHost, host["uuid"].(string))
+}
+
+func touchHost(host map[string]interface{}, interim *Interim, changes *Changes) {
+	changes.Hosts[host["uuid"].(string)] = true
+}
+
+func removeServiceContainerLink(link map[string]interface{}, interim *Interim) {
+	UUID := getServiceUUID(link["service_uuid"].(string), link["service_name"].(string))
+	interim.ServiceUUIDNameToContainersUUID[UUID] = removeString(interim.ServiceUUIDNameToContainersUUID[UUID], link["container_uuid"].(string))
+	if len(interim.ServiceUUIDNameToContainersUUID[UUID]) == 0 {
+		delete(interim.ServiceUUIDNameToContainersUUID, UUID)
+	}
+}
+
+func touchServiceContainerLink(link map[string]interface{}, interim *Interim, changes *Changes) {
+	changes.Services[getServiceUUID(link["service_uuid"].(string), link["service_name"].(string))] = true
+	changes.Containers[link["container_uuid"].(string)] = true
+}
+
+// Link maps are served as they are, so they are replaced rather than modified
+func removeLink(links map[string]map[string]interface{}, uuid string, key string) {
+	existing, ok := links[uuid]
+	if !ok {
+		return
+	}
+	updated := make(map[string]interface{}, len(existing))
+	for k, v := range existing {
+		if k != key {
+			updated[k] = v
+		}
+	}
+	if len(updated) == 0 {
+		delete(links, uuid)
+	} else {
+		links[uuid] = updated
+	}
+}
+
+func removeContainerLink(link map[string]interface{}, interim *Interim) {
+	removeLink(interim.ContainerUUIDToContainerLink, link["container_uuid"].(string), link["key"].(string))
+}
+
+func touchContainerLink(link map[string]interface{}, interim *Interim, changes *Changes) {
+	changes.Containers[link["container_uuid"].(string)] = true
+}
+
+func removeServiceLink(link map[string]interface{}, interim *Interim) {
+	removeLink(interim.ServiceUUIDToServiceLink, link["service_uuid"].(string), link["key"].(string))
+}
+
+func touchServiceLink(link map[string]interface{}, interim *Interim, changes *Changes) {
+	serviceUUID := link["service_uuid"].(string)
+	for sUUID, s := range interim.UUIDToService {
+		if s["uuid"] == serviceUUID {
+			changes.Services[sUUID] = true
+		}
+	}
+}
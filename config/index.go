@@ -0,0 +1,217 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// PathIndex holds lookup tables for one generated snapshot so that resolving a
+// path costs O(depth) instead of scanning arrays at every level.  Nodes are
+// identified by the address of their underlying storage, so an index is only
+// valid for the exact Versions value it was built from and must be rebuilt
+// whenever that value is replaced or mutated.
+type PathIndex struct {
+	arrays map[arrayID]*arrayIndex
+	folded map[uintptr]map[string]string
+}
+
+type arrayID struct {
+	head *interface{}
+	len  int
+}
+
+// Same returns whether a and b are the same map or array, rather than equal
+// ones.  Answers aren't changed once generated, so the same map or array
+// holds the same values.
+func Same(a, b interface{}) bool {
+	switch va := a.(type) {
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		return ok && va != nil && reflect.ValueOf(va).Pointer() == reflect.ValueOf(vb).Pointer()
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		return ok && len(va) > 0 && len(va) == len(vb) && &va[0] == &vb[0]
+	}
+	return false
+}
+
+// arrayIndex maps the magic keys of an array's children to their position.
+// exact is keyed by the value as stored, folded by its lowercased form.
+type arrayIndex struct {
+	exact  map[string]int
+	folded map[string]int
+}
+
+// NewPathIndex walks every version, client and value in answers once and
+// returns an index for it.  Values shared between versions or clients are
+// only indexed once.
+func NewPathIndex(answers Versions) *PathIndex {
+	idx := &PathIndex{
+		arrays: make(map[arrayID]*arrayIndex),
+		folded: make(map[uintptr]map[string]string),
+	}
+	visited := make(map[uintptr]bool)
+	for _, all := range answers {
+		idx.add(map[string]interface{}(all), visited)
+	}
+	return idx
+}
+
+func (idx *PathIndex) add(node interface{}, visited map[uintptr]bool) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			return
+		}
+		p := reflect.ValueOf(v).Pointer()
+		if visited[p] {
+			return
+		}
+		visited[p] = true
+
+		var folded map[string]string
+		for k, child := range v {
+			// Only keys that differ from their lowercased form need an
+			// entry, everything else is found by a plain map lookup.
+			if lower := strings.ToLower(k); lower != k {
+				if folded == nil {
+					folded = make(map[string]string)
+				}
+				// Prefer the smallest key so that keys differing only in
+				// case resolve the same way on every reload.
+				if existing, ok := folded[lower]; !ok || k < existing {
+					folded[lower] = k
+				}
+			}
+			idx.add(child, visited)
+		}
+		if folded != nil {
+			idx.folded[p] = folded
+		}
+	case Answers:
+		idx.add(map[string]interface{}(v), visited)
+	case []interface{}:
+		if len(v) == 0 {
+			return
+		}
+		id := arrayID{head: &v[0], len: len(v)}
+		if _, ok := idx.arrays[id]; ok {
+			return
+		}
+		ai := &arrayIndex{
+			exact:  make(map[string]int),
+			folded: make(map[string]int),
+		}
+		idx.arrays[id] = ai
+		for i, child := range v {
+			if childMap, ok := child.(map[string]interface{}); ok {
+				for _, magicKey := range MAGIC_ARRAY_KEYS {
+					if name, ok := childMap[magicKey].(string); ok {
+						ai.set(name, i)
+					}
+				}
+			}
+			idx.add(child, visited)
+		}
+	}
+}
+
+func (ai *arrayIndex) set(name string, i int) {
+	// Keep the first child carrying a value, which is what a linear scan
+	// over the array would have returned.
+	if _, ok := ai.exact[name]; !ok {
+		ai.exact[name] = i
+	}
+	lower := strings.ToLower(name)
+	if _, ok := ai.folded[lower]; !ok {
+		ai.folded[lower] = i
+	}
+}
+
+// lookupArray finds the child of v whose magic key equals key, falling back to
+// ignoring case if fold is set.  A nil index or an array that isn't indexed is
+// scanned.
+func (idx *PathIndex) lookupArray(v []interface{}, key string, fold bool) (interface{}, bool) {
+	if len(v) == 0 {
+		return nil, false
+	}
+	var ai *arrayIndex
+	if idx != nil {
+		ai = idx.arrays[arrayID{head: &v[0], len: len(v)}]
+	}
+	if ai == nil {
+		if out, ok := lookupArrayScan(v, key, false); ok || !fold {
+			return out, ok
+		}
+		return lookupArrayScan(v, key, true)
+	}
+
+	i, ok := ai.exact[key]
+	if !ok && fold {
+		i, ok = ai.folded[strings.ToLower(key)]
+	}
+	if !ok {
+		return nil, false
+	}
+	return v[i], true
+}
+
+// lookupMap finds key in v.  If fold is set and there is no exact match, a
+// lowercase key is preferred, then the smallest key equal under case folding.
+func (idx *PathIndex) lookupMap(v map[string]interface{}, key string, fold bool) (interface{}, bool) {
+	if out, ok := v[key]; ok || !fold {
+		return out, ok
+	}
+
+	lower := strings.ToLower(key)
+	if out, ok := v[lower]; ok {
+		return out, true
+	}
+	if idx == nil {
+		return lookupMapScan(v, lower)
+	}
+	if folded, ok := idx.folded[reflect.ValueOf(v).Pointer()]; ok {
+		if k, ok := folded[lower]; ok {
+			return v[k], true
+		}
+	}
+	return nil, false
+}
+
+func lookupArrayScan(v []interface{}, key string, fold bool) (interface{}, bool) {
+	if fold {
+		key = strings.ToLower(key)
+	}
+	for _, child := range v {
+		childMap, ok := child.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, magicKey := range MAGIC_ARRAY_KEYS {
+			name, ok := childMap[magicKey].(string)
+			if !ok {
+				continue
+			}
+			if fold {
+				name = strings.ToLower(name)
+			}
+			if name == key {
+				return child, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func lookupMapScan(v map[string]interface{}, lower string) (interface{}, bool) {
+	found, ok := "", false
+	for k := range v {
+		if strings.ToLower(k) == lower && (!ok || k < found) {
+			found, ok = k, true
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+	return v[found], true
+}
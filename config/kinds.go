@@ -0,0 +1,145 @@
+package config
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ProcessFunc adds an object of a kind to the interim data
+type ProcessFunc func(o map[string]interface{}, interim *Interim)
+
+// ApplyVersionFunc rewrites the interim data of a kind for a version.  It
+// runs once per version, after every object has been processed, and only
+// needs to rewrite what changes reports as changed.
+type ApplyVersionFunc func(interim *Interim, version string, changes *Changes)
+
+// TouchFunc marks in changes what adding or removing an object affects
+type TouchFunc func(o map[string]interface{}, interim *Interim, changes *Changes)
+
+// RenderFunc adds the interim data of a kind to the default answers of a version
+type RenderFunc func(ctx *RenderContext, defaultAnswers map[string]interface{})
+
+type RenderContext struct {
+	Version string
+	Local   bool
+	Interim *Interim
+}
+
+// Kind handles the objects of one metadata_kind.  Only Process is required.
+// Objects that don't match Schema are dropped before they reach Process.
+// ApplyVersion and Render run in the order the kinds were registered.
+//
+// Kinds with a Remove keep their interim data between generations: objects
+// that are gone or changed are removed, new or changed ones processed, and
+// Touch is called for both.  All other kinds are processed from scratch on
+// every generation.
+type Kind struct {
+	Name         string
+	Schema       Schema
+	Process      ProcessFunc
+	Remove       ProcessFunc
+	Touch        TouchFunc
+	ApplyVersion ApplyVersionFunc
+	Render       RenderFunc
+}
+
+var kinds = struct {
+	sync.RWMutex
+	byName  map[string]*Kind
+	ordered []*Kind
+}{
+	byName: make(map[string]*Kind),
+}
+
+// RegisterKind adds a metadata_kind to every generator.  Registering the same
+// name twice is an error.
+func RegisterKind(kind Kind) error {
+	if kind.Name == "" || kind.Process == nil {
+		return fmt.Errorf("A metadata kind needs a name and a process function")
+	}
+	if (kind.Remove == nil) != (kind.Touch == nil) {
+		return fmt.Errorf("Metadata kind [%s] needs both or neither of a remove and a touch function", kind.Name)
+	}
+
+	kinds.Lock()
+	defer kinds.Unlock()
+	if _, ok := kinds.byName[kind.Name]; ok {
+		return fmt.Errorf("Metadata kind [%s] is already registered", kind.Name)
+	}
+	k := kind
+	kinds.byName[k.Name] = &k
+	kinds.ordered = append(kinds.ordered, &k)
+	return nil
+}
+
+// RegisteredKinds returns the names of the registered kinds in registration order
+func RegisteredKinds() []string {
+	kinds.RLock()
+	defer kinds.RUnlock()
+	names := make([]string, 0, len(kinds.ordered))
+	for _, k := range kinds.ordered {
+		names = append(names, k.Name)
+	}
+	return names
+}
+
+func registeredKinds() []*Kind {
+	kinds.RLock()
+	defer kinds.RUnlock()
+	return append([]*Kind(nil), kinds.ordered...)
+}
+
+func lookupKind(name string) (*Kind, bool) {
+	kinds.RLock()
+	defer kinds.RUnlock()
+	k, ok := kinds.byName[name]
+	return k, ok
+}
+
+// NewObjectKind returns a Kind that keeps its objects in Interim.Objects and
+// serves them as an array under answersKey of the default answers, sorted by
+// the array order.
+func NewObjectKind(name string, answersKey string) Kind {
+	return Kind{
+		Name: name,
+		Process: func(o map[string]interface{}, interim *Interim) {
+			interim.Objects[name] = append(interim.Objects[name], o)
+		},
+		Render: func(ctx *RenderContext, defaultAnswers map[string]interface{}) {
+			objects := ctx.Interim.Objects[name]
+			out := make([]interface{}, 0, len(objects))
+			for _, o := range objects {
+				out = append(out, o)
+			}
+			sortObjects(out)
+			defaultAnswers[answersKey] = out
+		},
+	}
+}
+
+func mustRegisterKind(kind Kind) {
+	if err := RegisterKind(kind); err != nil {
+		panic(err)
+	}
+}
+
+func init() {
+	mustRegisterKind(Kind{Name: "container", Schema: containerSchema, Process: addContainer, Remove: removeContainer,
+		Touch: touchContainer, ApplyVersion: applyVersionToContainers, Render: renderContainers})
+	mustRegisterKind(Kind{Name: "service", Schema: serviceSchema, Process: addService, Remove: removeService,
+		Touch: touchService, ApplyVersion: applyVersionToServices, Render: renderServices})
+	mustRegisterKind(Kind{Name: "stack", Schema: stackSchema, Process: addStack, Remove: removeStack,
+		Touch: touchStack, ApplyVersion: applyVersionToStacks, Render: renderStacks})
+	mustRegisterKind(Kind{Name: "host", Schema: hostSchema, Process: addHost, Remove: removeHost,
+		Touch: touchHost, ApplyVersion: applyVersionToHosts, Render: renderHosts})
+	mustRegisterKind(Kind{Name: "network", Process: addNetwork, Render: renderNetworks})
+	mustRegisterKind(Kind{Name: "defaultData", Schema: defaultDataSchema, Process: addDefault, Render: renderDefault})
+	mustRegisterKind(Kind{Name: "environment", Process: addEnvironment, Render: renderEnvironment})
+	mustRegisterKind(Kind{Name: "serviceContainerLink", Schema: serviceContainerLinkSchema, Process: addServiceContainerLink,
+		Remove: removeServiceContainerLink, Touch: touchServiceContainerLink})
+	mustRegisterKind(Kind{Name: "containerLink", Schema: containerLinkSchema, Process: addContainerLink,
+		Remove: removeContainerLink, Touch: touchContainerLink})
+	mustRegisterKind(Kind{Name: "serviceLink", Schema: serviceLinkSchema, Process: addServiceLink,
+		Remove: removeServiceLink, Touch: touchServiceLink})
+	mustRegisterKind(Kind{Name: "credential", Schema: credentialSchema, Process: addCredential})
+}
@@ -0,0 +1,134 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+// restoreKinds returns a function that unregisters the kinds registered
+// since it was called
+func restoreKinds() func() {
+	kinds.Lock()
+	defer kinds.Unlock()
+	byName := make(map[string]*Kind, len(kinds.byName))
+	for name, k := range kinds.byName {
+		byName[name] = k
+	}
+	ordered := append([]*Kind(nil), kinds.ordered...)
+	return func() {
+		kinds.Lock()
+		defer kinds.Unlock()
+		kinds.byName = byName
+		kinds.ordered = ordered
+	}
+}
+
+func TestRegisterKindRejectsInvalidKinds(t *testing.T) {
+	defer restoreKinds()()
+
+	process := func(o map[string]interface{}, interim *Interim) {}
+	touch := func(o map[string]interface{}, interim *Interim, changes *Changes) {}
+	tests := []struct {
+		name string
+		kind Kind
+	}{
+		{"no name", Kind{Process: process}},
+		{"no process", Kind{Name: "volume"}},
+		{"remove without touch", Kind{Name: "volume", Process: process, Remove: process}},
+		{"touch without remove", Kind{Name: "volume", Process: process, Touch: touch}},
+		{"built-in name", Kind{Name: "container", Process: process}},
+	}
+	for _, test := range tests {
+		if err := RegisterKind(test.kind); err == nil {
+			t.Errorf("%s: registered", test.name)
+		}
+	}
+	if err := RegisterKind(NewObjectKind("volume", "volumes")); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterKind(NewObjectKind("volume", "volumes")); err == nil {
+		t.Error("registered volume twice")
+	}
+	names := RegisteredKinds()
+	if names[len(names)-1] != "volume" {
+		t.Errorf("volume isn't registered last, %v", names)
+	}
+}
+
+func TestRegisteredKindIsRenderedPerVersion(t *testing.T) {
+	defer restoreKinds()()
+
+	if err := RegisterKind(NewObjectKind("volume", "volumes")); err != nil {
+		t.Fatal(err)
+	}
+	err := RegisterKind(Kind{
+		Name: "secret",
+		Process: func(o map[string]interface{}, interim *Interim) {
+			interim.Objects["secret"] = append(interim.Objects["secret"], o)
+		},
+		ApplyVersion: func(interim *Interim, version string, changes *Changes) {
+			for _, o := range interim.Objects["secret"] {
+				o["version"] = version
+			}
+		},
+		Render: func(ctx *RenderContext, defaultAnswers map[string]interface{}) {
+			var names []interface{}
+			for _, o := range ctx.Interim.Objects["secret"] {
+				if o["version"] == ctx.Version {
+					names = append(names, o["name"])
+				}
+			}
+			defaultAnswers["secrets"] = names
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	objects := append(testObjects(),
+		map[string]interface{}{"metadata_kind": "volume", "name": "b"},
+		map[string]interface{}{"metadata_kind": "volume", "name": "a"},
+		map[string]interface{}{"metadata_kind": "secret", "name": "s"})
+	versions, _, _, err := NewGenerator(true, "", false, 0).GenerateAnswers(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, version := range SupportedVersions() {
+		answers := versions[version][DEFAULT_KEY].(map[string]interface{})
+		var volumes []interface{}
+		for _, v := range answers["volumes"].([]interface{}) {
+			volumes = append(volumes, v.(map[string]interface{})["name"])
+		}
+		if want := []interface{}{"a", "b"}; !reflect.DeepEqual(volumes, want) {
+			t.Errorf("%s: expected volumes %v, got %v", version, want, volumes)
+		}
+		if want := []interface{}{"s"}; !reflect.DeepEqual(answers["secrets"], want) {
+			t.Errorf("%s: expected secrets %v, got %v", version, want, answers["secrets"])
+		}
+	}
+}
+
+func TestUnknownKindsAreCounted(t *testing.T) {
+	g := NewGenerator(true, "", false, 0)
+	objects := append(testObjects(),
+		map[string]interface{}{"metadata_kind": "volume", "name": "a"},
+		map[string]interface{}{"metadata_kind": "volume", "name": "b"},
+		map[string]interface{}{"metadata_kind": "storagePool", "name": "pool"})
+	versions, _, _, err := g.GenerateAnswers(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"volume": 2, "storagePool": 1}; !reflect.DeepEqual(g.UnknownKinds(), want) {
+		t.Errorf("expected unknown kinds %v, got %v", want, g.UnknownKinds())
+	}
+	if _, ok := versions[METADATA_VERSION3][DEFAULT_KEY].(map[string]interface{})["volumes"]; ok {
+		t.Error("objects of an unknown kind were rendered")
+	}
+
+	if _, _, _, err := g.GenerateAnswers(testObjects()); err != nil {
+		t.Fatal(err)
+	}
+	if unknown := g.UnknownKinds(); len(unknown) != 0 {
+		t.Errorf("unknown kinds outlived their objects, %v", unknown)
+	}
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	KIND_CONTAINER = "container"
+	KIND_SERVICE   = "service"
+	KIND_STACK     = "stack"
+	KIND_HOST      = "host"
+)
+
+// Lookups holds the reverse lookup index of each generated version
+type Lookups map[string]*LookupIndex
+
+// LookupResult is an object found by a reverse lookup along with its metadata_kind
+type LookupResult struct {
+	Kind   string                 `json:"kind" yaml:"kind"`
+	Object map[string]interface{} `json:"object" yaml:"object"`
+}
+
+// LookupIndex finds containers, services, stacks and hosts by IP, UUID or
+// stack/service/container name.  Names are matched case-insensitively.
+type LookupIndex struct {
+	byIP   map[string]LookupResult
+	byUUID map[string]LookupResult
+	byName map[string]LookupResult
+}
+
+func (l *LookupIndex) IP(ip string) (LookupResult, bool) {
+	if l == nil {
+		return LookupResult{}, false
+	}
+	r, ok := l.byIP[ip]
+	return r, ok
+}
+
+func (l *LookupIndex) UUID(uuid string) (LookupResult, bool) {
+	if l == nil {
+		return LookupResult{}, false
+	}
+	r, ok := l.byUUID[uuid]
+	return r, ok
+}
+
+// Name looks up a stack, a service or a container by one, two or three
+// path segments: stack[/service[/container]]
+func (l *LookupIndex) Name(names ...string) (LookupResult, bool) {
+	if l == nil || len(names) == 0 || len(names) > 3 {
+		return LookupResult{}, false
+	}
+	r, ok := l.byName[nameKey(names...)]
+	return r, ok
+}
+
+func nameKey(names ...string) string {
+	return strings.ToLower(strings.Join(names, "/"))
+}
+
+func stringField(o map[string]interface{}, key string) string {
+	s, _ := o[key].(string)
+	return s
+}
+
+// newLookupIndex indexes the objects of interim once a version has been
+// applied to it, so the results are the same maps served under that version.
+func newLookupIndex(interim *Interim) *LookupIndex {
+	l := &LookupIndex{
+		byIP:   make(map[string]LookupResult),
+		byUUID: make(map[string]LookupResult),
+		byName: make(map[string]LookupResult),
+	}
+
+	for _, h := range interim.UUIDToHost {
+		l.byUUID[stringField(h, "uuid")] = LookupResult{KIND_HOST, h}
+		if ip := stringField(h, "agent_ip"); ip != "" {
+			l.byIP[ip] = LookupResult{KIND_HOST, h}
+		}
+	}
+
+	// Containers sharing an IP (host networking) or a host's IP resolve to
+	// the container with the lowest uuid so the answer is stable.
+	cUUIDs := make([]string, 0, len(interim.UUIDToContainer))
+	for cUUID := range interim.UUIDToContainer {
+		cUUIDs = append(cUUIDs, cUUID)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(cUUIDs)))
+	for _, cUUID := range cUUIDs {
+		c := interim.UUIDToContainer[cUUID]
+		l.byUUID[cUUID] = LookupResult{KIND_CONTAINER, c}
+		if ip := stringField(c, "primary_ip"); ip != "" {
+			l.byIP[ip] = LookupResult{KIND_CONTAINER, c}
+		}
+	}
+
+	for _, st := range interim.UUIDToStack {
+		l.byUUID[stringField(st, "uuid")] = LookupResult{KIND_STACK, st}
+		l.byName[nameKey(stringField(st, "name"))] = LookupResult{KIND_STACK, st}
+	}
+
+	for sUUID, s := range interim.UUIDToService {
+		l.byUUID[stringField(s, "uuid")] = LookupResult{KIND_SERVICE, s}
+		st, ok := interim.UUIDToStack[stringField(s, "stack_uuid")]
+		if !ok {
+			continue
+		}
+		stackName := stringField(st, "name")
+		serviceName := stringField(s, "name")
+		l.byName[nameKey(stackName, serviceName)] = LookupResult{KIND_SERVICE, s}
+		for _, cUUID := range interim.ServiceUUIDNameToContainersUUID[sUUID] {
+			if c, ok := interim.UUIDToContainer[cUUID]; ok {
+				l.byName[nameKey(stackName, serviceName, stringField(c, "name"))] = LookupResult{KIND_CONTAINER, c}
+			}
+		}
+	}
+
+	return l
+}
+
+// NewLookups indexes the default answers of each version, for answers that
+// were not generated here, such as those mirrored from another server
+func NewLookups(versions Versions) Lookups {
+	lookups := make(Lookups, len(versions))
+	for version, answers := range versions {
+		defaults, _ := answers[DEFAULT_KEY].(map[string]interface{})
+		lookups[version] = newAnswersLookupIndex(defaults)
+	}
+	return lookups
+}
+
+func answersObjects(defaults map[string]interface{}, key string) []map[string]interface{} {
+	array, _ := defaults[key].([]interface{})
+	objects := make([]map[string]interface{}, 0, len(array))
+	for _, o := range array {
+		if m, ok := o.(map[string]interface{}); ok {
+			objects = append(objects, m)
+		}
+	}
+	return objects
+}
+
+// newAnswersLookupIndex indexes the containers, services, stacks and hosts
+// of default answers like newLookupIndex does the interim objects
+func newAnswersLookupIndex(defaults map[string]interface{}) *LookupIndex {
+	l := &LookupIndex{
+		byIP:   make(map[string]LookupResult),
+		byUUID: make(map[string]LookupResult),
+		byName: make(map[string]LookupResult),
+	}
+
+	for _, h := range answersObjects(defaults, "hosts") {
+		l.byUUID[stringField(h, "uuid")] = LookupResult{KIND_HOST, h}
+		if ip := stringField(h, "agent_ip"); ip != "" {
+			l.byIP[ip] = LookupResult{KIND_HOST, h}
+		}
+	}
+
+	containers := answersObjects(defaults, "containers")
+	sort.Slice(containers, func(i, j int) bool {
+		return stringField(containers[i], "uuid") > stringField(containers[j], "uuid")
+	})
+	for _, c := range containers {
+		l.byUUID[stringField(c, "uuid")] = LookupResult{KIND_CONTAINER, c}
+		if ip := stringField(c, "primary_ip"); ip != "" {
+			l.byIP[ip] = LookupResult{KIND_CONTAINER, c}
+		}
+	}
+
+	for _, st := range answersObjects(defaults, "stacks") {
+		l.byUUID[stringField(st, "uuid")] = LookupResult{KIND_STACK, st}
+		l.byName[nameKey(stringField(st, "name"))] = LookupResult{KIND_STACK, st}
+	}
+
+	for _, s := range answersObjects(defaults, "services") {
+		l.byUUID[stringField(s, "uuid")] = LookupResult{KIND_SERVICE, s}
+		if stackName := stringField(s, "stack_name"); stackName != "" {
+			l.byName[nameKey(stackName, stringField(s, "name"))] = LookupResult{KIND_SERVICE, s}
+		}
+	}
+	for _, c := range containers {
+		stackName, serviceName := stringField(c, "stack_name"), stringField(c, "service_name")
+		if stackName != "" && serviceName != "" {
+			l.byName[nameKey(stackName, serviceName, stringField(c, "name"))] = LookupResult{KIND_CONTAINER, c}
+		}
+	}
+
+	return l
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestLookupIndex(t *testing.T) {
+	objects := append(testObjects(),
+		// shares the IP of container-1, and the host of container-2 uses it
+		// too, as with host networking
+		map[string]interface{}{"metadata_kind": "container", "uuid": "container-0", "name": "Stack-Web-2",
+			"primary_ip": "10.42.0.2", "host_uuid": "host-1", "stack_uuid": "stack-1", "service_uuid": "service-1",
+			"service_name": "Web"},
+		map[string]interface{}{"metadata_kind": "serviceContainerLink", "service_uuid": "service-1", "service_name": "Web",
+			"container_uuid": "container-0"})
+	objects[5] = copyObject(objects[5])
+	objects[5]["agent_ip"] = "10.42.0.2"
+	objects[6] = copyObject(objects[6])
+	objects[6]["agent_ip"] = "10.42.1.2"
+
+	_, lookups, _, err := NewGenerator(true, "", false, 0).GenerateAnswers(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := lookups[METADATA_VERSION3]
+
+	tests := []struct {
+		name   string
+		lookup func() (LookupResult, bool)
+		kind   string
+		uuid   string
+	}{
+		{"ip of a container", func() (LookupResult, bool) { return l.IP("10.42.0.1") }, KIND_CONTAINER, "container-1"},
+		{"ip shared by containers and a host", func() (LookupResult, bool) { return l.IP("10.42.0.2") }, KIND_CONTAINER, "container-0"},
+		{"ip of a host", func() (LookupResult, bool) { return l.IP("10.42.1.2") }, KIND_HOST, "host-2"},
+		{"uuid of a host", func() (LookupResult, bool) { return l.UUID("host-1") }, KIND_HOST, "host-1"},
+		{"uuid of a stack", func() (LookupResult, bool) { return l.UUID("stack-2") }, KIND_STACK, "stack-2"},
+		{"uuid of a service", func() (LookupResult, bool) { return l.UUID("service-2") }, KIND_SERVICE, "service-2"},
+		{"uuid of a container", func() (LookupResult, bool) { return l.UUID("container-2") }, KIND_CONTAINER, "container-2"},
+		{"name of a stack", func() (LookupResult, bool) { return l.Name("stack") }, KIND_STACK, "stack-1"},
+		{"name of a service", func() (LookupResult, bool) { return l.Name("Other", "DB") }, KIND_SERVICE, "service-2"},
+		{"name of a container", func() (LookupResult, bool) { return l.Name("Stack", "web", "Stack-Web-2") }, KIND_CONTAINER, "container-0"},
+		{"unknown ip", func() (LookupResult, bool) { return l.IP("10.42.9.9") }, "", ""},
+		{"unknown uuid", func() (LookupResult, bool) { return l.UUID("container-9") }, "", ""},
+		{"unknown name", func() (LookupResult, bool) { return l.Name("Stack", "DB") }, "", ""},
+		{"too many names", func() (LookupResult, bool) { return l.Name("Stack", "Web", "Stack-Web-1", "x") }, "", ""},
+		{"no index", func() (LookupResult, bool) { return (*LookupIndex)(nil).IP("10.42.0.1") }, "", ""},
+	}
+	for _, test := range tests {
+		r, ok := test.lookup()
+		if test.kind == "" {
+			if ok {
+				t.Errorf("%s: expected nothing, found %v", test.name, r)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: found nothing", test.name)
+		} else if r.Kind != test.kind || r.Object["uuid"] != test.uuid {
+			t.Errorf("%s: expected %s %s, found %s %v", test.name, test.kind, test.uuid, r.Kind, r.Object["uuid"])
+		}
+	}
+}
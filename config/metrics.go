@@ -0,0 +1,8 @@
+package config
+
+import "github.com/rancher/rancher-metadata/pkg/metrics"
+
+var (
+	generationDuration = metrics.NewHistogram("rancher_metadata_generation_duration_seconds",
+		"Time taken to generate the answers of every version from the metadata objects.", nil)
+)
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DEFAULT_ARRAY_ORDER is the order of the objects in generated arrays
+var DEFAULT_ARRAY_ORDER = []string{"create_index", "name", "uuid"}
+
+var arrayOrder = struct {
+	sync.RWMutex
+	keys []string
+}{
+	keys: DEFAULT_ARRAY_ORDER,
+}
+
+// SetArrayOrder sets the fields the objects of generated arrays are sorted
+// by, most significant first.  Objects missing a field sort after those that
+// have it, and ties are broken by uuid.
+func SetArrayOrder(keys []string) error {
+	var order []string
+	hasUUID := false
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			return fmt.Errorf("Invalid array order %v: empty field name", keys)
+		}
+		hasUUID = hasUUID || key == "uuid"
+		order = append(order, key)
+	}
+	if !hasUUID {
+		order = append(order, "uuid")
+	}
+
+	arrayOrder.Lock()
+	defer arrayOrder.Unlock()
+	arrayOrder.keys = order
+	return nil
+}
+
+// ArrayOrder returns the fields the objects of generated arrays are sorted by
+func ArrayOrder() []string {
+	arrayOrder.RLock()
+	defer arrayOrder.RUnlock()
+	return append([]string(nil), arrayOrder.keys...)
+}
+
+type byArrayOrder struct {
+	objects []interface{}
+	keys    []string
+}
+
+func (s byArrayOrder) Len() int      { return len(s.objects) }
+func (s byArrayOrder) Swap(i, j int) { s.objects[i], s.objects[j] = s.objects[j], s.objects[i] }
+func (s byArrayOrder) Less(i, j int) bool {
+	a, _ := s.objects[i].(map[string]interface{})
+	b, _ := s.objects[j].(map[string]interface{})
+	for _, key := range s.keys {
+		if c := compareValues(a[key], b[key]); c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
+// sortObjects sorts objects in place by the array order
+func sortObjects(objects []interface{}) {
+	sort.Stable(byArrayOrder{objects: objects, keys: ArrayOrder()})
+}
+
+// compareValues orders numbers before strings before anything else, and
+// missing values last
+func compareValues(a, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return 1
+		}
+		return -1
+	}
+
+	af, aIsNumber := toFloat(a)
+	bf, bIsNumber := toFloat(b)
+	switch {
+	case aIsNumber && bIsNumber:
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		}
+		return 0
+	case aIsNumber:
+		return -1
+	case bIsNumber:
+		return 1
+	}
+
+	as, aIsString := a.(string)
+	bs, bIsString := b.(string)
+	switch {
+	case aIsString && bIsString:
+		return strings.Compare(as, bs)
+	case aIsString:
+		return -1
+	case bIsString:
+		return 1
+	}
+	return 0
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
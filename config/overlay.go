@@ -0,0 +1,206 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Overlay is a file of static answers merged on top of the generated ones.
+// Maps are merged key by key, any other value replaces the generated one.
+type Overlay struct {
+	File string
+	// Mount is the path the content of the file is merged at in the default
+	// answers of every version.  Without one the file holds answers by
+	// version then client, like an answers file.
+	Mount []string
+	// the answers of the file by version, then client or default
+	answers map[string]map[string]interface{}
+}
+
+// ParseOverlay parses an overlay option, [path=]file.  The file is read by
+// Load.
+func ParseOverlay(value string) (*Overlay, error) {
+	o := &Overlay{File: value}
+	if parts := strings.SplitN(value, "=", 2); len(parts) == 2 {
+		o.File = parts[1]
+		for _, key := range strings.Split(parts[0], "/") {
+			if key != "" {
+				o.Mount = append(o.Mount, key)
+			}
+		}
+		if len(o.Mount) == 0 {
+			return nil, fmt.Errorf("Invalid overlay [%s], expected [path=]file", value)
+		}
+	}
+	if o.File == "" {
+		return nil, fmt.Errorf("Invalid overlay [%s], expected [path=]file", value)
+	}
+	return o, nil
+}
+
+// Load reads the file of the overlay, JSON if its name ends with .json and
+// YAML otherwise, into a new overlay
+func (o *Overlay) Load() (*Overlay, error) {
+	content, err := ioutil.ReadFile(o.File)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read overlay [%s]: %v", o.File, err)
+	}
+	var parsed interface{}
+	if strings.ToLower(filepath.Ext(o.File)) == ".json" {
+		err = json.Unmarshal(content, &parsed)
+	} else {
+		err = yaml.Unmarshal(content, &parsed)
+		parsed = stringKeys(parsed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse overlay [%s]: %v", o.File, err)
+	}
+
+	loaded := &Overlay{
+		File:    o.File,
+		Mount:   o.Mount,
+		answers: make(map[string]map[string]interface{}),
+	}
+	if len(o.Mount) > 0 {
+		for i := len(o.Mount) - 1; i >= 0; i-- {
+			parsed = map[string]interface{}{o.Mount[i]: parsed}
+		}
+		loaded.answers[""] = map[string]interface{}{DEFAULT_KEY: parsed}
+		return loaded, nil
+	}
+
+	versions, ok := parsed.(map[string]interface{})
+	if !ok && parsed != nil {
+		return nil, fmt.Errorf("Failed to parse overlay [%s]: the top-level must be a map of versions", o.File)
+	}
+	for version, value := range versions {
+		clients, ok := value.(map[string]interface{})
+		if !ok && value != nil {
+			return nil, fmt.Errorf("Failed to parse overlay [%s]: version [%s] must be a map of clients", o.File, version)
+		}
+		loaded.answers[version] = clients
+	}
+	return loaded, nil
+}
+
+// apply merges the overlay into the answers of a version, which latest is
+// set if they are also the latest answers
+func (o *Overlay) apply(answers Answers, version string, latest bool) Answers {
+	answers = overlayAnswers(answers, o.answers[""])
+	answers = overlayAnswers(answers, o.answers[version])
+	if latest {
+		answers = overlayAnswers(answers, o.answers[LATEST_KEY])
+	}
+	return answers
+}
+
+// ApplyOverlays returns versions with the overlays merged in order.  versions
+// itself is left untouched, the maps the overlays change are copied.
+func ApplyOverlays(versions Versions, overlays []*Overlay) Versions {
+	if len(overlays) == 0 {
+		return versions
+	}
+
+	// the version tagged latest, whose answers are shared with latest
+	aliased := ""
+	if latest, ok := versions[LATEST_KEY]; ok {
+		for name, answers := range versions {
+			if name != LATEST_KEY && reflect.ValueOf(answers).Pointer() == reflect.ValueOf(latest).Pointer() {
+				aliased = name
+			}
+		}
+	}
+
+	out := make(Versions, len(versions))
+	for name, answers := range versions {
+		if name == LATEST_KEY && aliased != "" {
+			continue
+		}
+		for _, o := range overlays {
+			answers = o.apply(answers, name, name == aliased || name == LATEST_KEY)
+		}
+		out[name] = answers
+	}
+	if aliased != "" {
+		out[LATEST_KEY] = out[aliased]
+	}
+	return out
+}
+
+// overlayAnswers merges an overlay by client into answers.  The default
+// overlay is merged into every client too since clients answer with the
+// default keys they don't have, and a client without answers of its own
+// starts from the default ones.
+func overlayAnswers(answers Answers, overlay map[string]interface{}) Answers {
+	if len(overlay) == 0 {
+		return answers
+	}
+	out := make(Answers, len(answers))
+	for key, value := range answers {
+		out[key] = value
+	}
+	if defaults, ok := overlay[DEFAULT_KEY]; ok {
+		for key, value := range out {
+			out[key] = mergeValue(value, defaults)
+		}
+		if _, ok := out[DEFAULT_KEY]; !ok {
+			out[DEFAULT_KEY] = defaults
+		}
+	}
+	for client, value := range overlay {
+		if client == DEFAULT_KEY {
+			continue
+		}
+		existing, ok := out[client]
+		if !ok {
+			existing = out[DEFAULT_KEY]
+		}
+		out[client] = mergeValue(existing, value)
+	}
+	return out
+}
+
+// mergeValue merges src into dst: maps key by key, anything else is replaced
+// by src.  dst is copied rather than changed, since its maps may be shared
+// with other answers.
+func mergeValue(dst, src interface{}) interface{} {
+	srcMap, ok := src.(map[string]interface{})
+	if !ok {
+		return src
+	}
+	dstMap, ok := dst.(map[string]interface{})
+	if !ok {
+		return src
+	}
+	merged := copyObject(dstMap)
+	for key, value := range srcMap {
+		merged[key] = mergeValue(merged[key], value)
+	}
+	return merged
+}
+
+// stringKeys converts the maps decoded from YAML to the maps decoded from
+// JSON
+func stringKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			out[fmt.Sprint(key)] = stringKeys(child)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, child := range v {
+			out[i] = stringKeys(child)
+		}
+		return out
+	}
+	return value
+}
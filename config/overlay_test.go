@@ -0,0 +1,102 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func loadTestOverlay(t *testing.T, dir, option, name, content string) *Overlay {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if option != "" {
+		option += "="
+	}
+	o, err := ParseOverlay(option + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := o.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loaded
+}
+
+func TestApplyOverlays(t *testing.T) {
+	dir, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	versions, _, _, err := NewGenerator(true, "", false, 0).GenerateAnswers(testObjects())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientIP := ""
+	for key := range versions[METADATA_VERSION3] {
+		if key != DEFAULT_KEY {
+			clientIP = key
+		}
+	}
+	if clientIP == "" {
+		t.Fatal("no client answers generated")
+	}
+
+	overlays := []*Overlay{
+		loadTestOverlay(t, dir, "site/proxy", "proxy.yaml", "http: http://proxy:3128\nports: [3128]\n"),
+		loadTestOverlay(t, dir, "", "answers.json", `{
+			"latest": {"default": {"site": {"datacenter": "dc1"}}},
+			"`+METADATA_VERSION1+`": {"10.99.0.1": {"site": {"rack": "r1"}}}
+		}`),
+	}
+	out := ApplyOverlays(versions, overlays)
+
+	site := func(version, ip string) interface{} {
+		val, _ := out.Matching(version, ip, []string{"site"})
+		return val
+	}
+	want := map[string]interface{}{
+		"datacenter": "dc1",
+		"proxy":      map[string]interface{}{"http": "http://proxy:3128", "ports": []interface{}{3128}},
+	}
+	if got := site(LATEST_KEY, clientIP); !reflect.DeepEqual(got, want) {
+		t.Errorf("latest client got %v, want %v", got, want)
+	}
+	if got := site(METADATA_VERSION3, DEFAULT_KEY); !reflect.DeepEqual(got, want) {
+		t.Errorf("tagged latest got %v, want %v", got, want)
+	}
+	if val, _ := out.Matching(METADATA_VERSION3, clientIP, []string{"self", "container", "name"}); val == nil {
+		t.Error("the generated answers of the client were lost")
+	}
+	if got, ok := site(METADATA_VERSION1, DEFAULT_KEY).(map[string]interface{}); !ok || got["datacenter"] != nil || got["proxy"] == nil {
+		t.Errorf("older version got %v", got)
+	}
+	if got, _ := out.Matching(METADATA_VERSION1, "10.99.0.1", []string{"site", "rack"}); got != "r1" {
+		t.Errorf("new client got rack %v", got)
+	}
+	if got, _ := out.Matching(METADATA_VERSION1, "10.99.0.1", []string{"containers"}); got == nil {
+		t.Error("new client doesn't start from the default answers")
+	}
+
+	if _, ok := versions[LATEST_KEY][DEFAULT_KEY].(map[string]interface{})["site"]; ok {
+		t.Error("overlays changed the generated answers")
+	}
+}
+
+func TestParseOverlay(t *testing.T) {
+	o, err := ParseOverlay("a/b=/etc/site.yaml")
+	if err != nil || o.File != "/etc/site.yaml" || !reflect.DeepEqual(o.Mount, []string{"a", "b"}) {
+		t.Errorf("got %v, %v", o, err)
+	}
+	for _, invalid := range []string{"", "=file", "a="} {
+		if _, err := ParseOverlay(invalid); err == nil {
+			t.Errorf("accepted [%s]", invalid)
+		}
+	}
+}
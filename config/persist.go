@@ -0,0 +1,191 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// SNAPSHOT_FORMAT is the format version of the snapshot files written.
+// Files without one predate checksums and are read unchecked.
+const SNAPSHOT_FORMAT = 2
+
+// snapshotFile is a delta from Rancher as written to disk
+type snapshotFile struct {
+	Format   int    `json:",omitempty"`
+	Checksum string `json:",omitempty"`
+	Version  string
+	Time     time.Time
+	Data     []byte
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// writeSnapshotFile durably replaces path with a checksummed delta
+func writeSnapshotFile(path string, version string, t time.Time, data []byte) error {
+	content, err := json.Marshal(snapshotFile{
+		Format:   SNAPSHOT_FORMAT,
+		Checksum: checksum(data),
+		Version:  version,
+		Time:     t,
+		Data:     data,
+	})
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, content, 0666)
+}
+
+// readSnapshotFile reads a delta, verifying its checksum
+func readSnapshotFile(path string) (*snapshotFile, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s snapshotFile
+	if err := json.Unmarshal(content, &s); err != nil {
+		return nil, fmt.Errorf("Failed to parse snapshot [%s]: %v", path, err)
+	}
+	if s.Format > SNAPSHOT_FORMAT {
+		return nil, fmt.Errorf("Snapshot [%s] has unknown format %d", path, s.Format)
+	}
+	if s.Format > 0 && s.Checksum != checksum(s.Data) {
+		return nil, fmt.Errorf("Snapshot [%s] doesn't match its checksum", path)
+	}
+	return &s, nil
+}
+
+// WriteFileAtomic replaces path with content, never leaving a partial file.
+// Both the file and its directory are synced before returning.
+func WriteFileAtomic(path string, content []byte, perm os.FileMode) error {
+	tempFile := path + ".temp"
+	// a temporary file left by a crash may have other permissions
+	os.Remove(tempFile)
+	out, err := os.OpenFile(tempFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		out.Close()
+		os.Remove(tempFile)
+	}()
+
+	if _, err := out.Write(content); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// DecodeFile returns the metadata objects of a snapshot file, such as the
+// answers file, and the version of Rancher they are from
+func (g *Generator) DecodeFile(path string) ([]map[string]interface{}, string, error) {
+	s, err := readSnapshotFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	data, _, err := g.decodeDelta(s.Data)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to decode delta in [%s]: %v", path, err)
+	}
+	return data, s.Version, nil
+}
+
+// Mirror is the answers of another metadata server, and the id it serves
+// them under
+type Mirror struct {
+	Version  string   `json:"version"`
+	Versions Versions `json:"versions"`
+}
+
+// WriteMirrorFile durably replaces path with a mirror, readable only by the
+// owner since it includes the service tokens
+func WriteMirrorFile(path string, m *Mirror) error {
+	content, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(path, content, 0600); err != nil {
+		return fmt.Errorf("Failed to save mirror to [%s]: %v", path, err)
+	}
+	return nil
+}
+
+// ReadMirrorFile reads a mirror written by WriteMirrorFile
+func ReadMirrorFile(path string) (*Mirror, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeMirror(content)
+}
+
+// DecodeMirror parses a mirror.  The answers of latest are shared with the
+// version they are the latest of, as they are when generated.
+func DecodeMirror(content []byte) (*Mirror, error) {
+	var m Mirror
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, fmt.Errorf("Failed to parse mirror: %v", err)
+	}
+	shareLatest(m.Versions)
+	return &m, nil
+}
+
+// DecodeVersions parses a JSON answers document: answers by version, then by
+// client IP or default
+func DecodeVersions(content []byte) (Versions, error) {
+	var versions Versions
+	if err := json.Unmarshal(content, &versions); err != nil {
+		return nil, fmt.Errorf("Failed to parse answers: %v", err)
+	}
+	for version, answers := range versions {
+		for client, value := range answers {
+			if _, ok := value.(map[string]interface{}); !ok {
+				return nil, fmt.Errorf("Failed to parse answers: client [%s] of version [%s] must be a map", client, version)
+			}
+		}
+	}
+	shareLatest(versions)
+	return versions, nil
+}
+
+// shareLatest makes latest share the answers of the version it is the latest
+// of, as they do when generated
+func shareLatest(versions Versions) {
+	latest, ok := versions[LATEST_KEY]
+	if !ok {
+		return
+	}
+	for name, answers := range versions {
+		if name != LATEST_KEY && reflect.DeepEqual(answers, latest) {
+			versions[LATEST_KEY] = answers
+			return
+		}
+	}
+}
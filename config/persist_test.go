@@ -0,0 +1,156 @@
+package config
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func compressObjects(t *testing.T, objects []map[string]interface{}) []byte {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range objects {
+		if err := json.NewEncoder(w).Encode(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestLoadFallsBackToPreviousSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	answersFile := filepath.Join(dir, "answers.json")
+
+	g := NewGenerator(true, answersFile, false, 0)
+	for _, version := range []string{"1", "2"} {
+		objects := testObjects()
+		objects[0]["version"] = version
+		g.reloadDelta(version, compressObjects(t, objects))
+		g.SaveToFile(time.Now())
+	}
+
+	// a torn write of the newest snapshot
+	content, err := ioutil.ReadFile(answersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s snapshotFile
+	if err := json.Unmarshal(content, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Format != SNAPSHOT_FORMAT || s.Version != "2" || s.Checksum != checksum(s.Data) {
+		t.Fatalf("unexpected header %d %s %s", s.Format, s.Version, s.Checksum)
+	}
+	s.Data = s.Data[:len(s.Data)/2]
+	content, _ = json.Marshal(s)
+	if err := ioutil.WriteFile(answersFile, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, _, _, err := NewGenerator(true, answersFile, false, 0).LoadVersionsFromFile(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := versions[LATEST_KEY][DEFAULT_KEY].(map[string]interface{})["version"]; version != "1" {
+		t.Errorf("loaded version %v, want the previous snapshot", version)
+	}
+
+	// nothing good to load is not fatal
+	os.Remove(filepath.Join(dir, "answers.json.previous"))
+	versions, _, _, err = NewGenerator(true, answersFile, false, 0).LoadVersionsFromFile(false)
+	if err != nil || versions != nil {
+		t.Errorf("got %v, %v loading a corrupt snapshot", versions, err)
+	}
+}
+
+func TestMirrorFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	versions, lookups, _, err := NewGenerator(true, "", false, 0).GenerateAnswers(testObjects())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "answers.json.mirror")
+	if err := WriteMirrorFile(path, &Mirror{Version: "v1", Versions: MergeVersions(versions, nil, "v1")}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadMirrorFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != "v1" {
+		t.Errorf("got version %s", m.Version)
+	}
+	if reflect.ValueOf(m.Versions[LATEST_KEY]).Pointer() != reflect.ValueOf(m.Versions[METADATA_VERSION3]).Pointer() {
+		t.Error("latest isn't shared with the version it is the latest of")
+	}
+
+	mirrored := NewLookups(m.Versions)
+	for _, keys := range [][]string{{"ip", "10.42.0.1"}, {"uuid", "host-2"}, {"name", "Stack", "Web"}, {"name", "stack", "web", "stack-web-1"}} {
+		var want, got LookupResult
+		var ok bool
+		switch keys[0] {
+		case "ip":
+			want, _ = lookups[LATEST_KEY].IP(keys[1])
+			got, ok = mirrored[LATEST_KEY].IP(keys[1])
+		case "uuid":
+			want, _ = lookups[LATEST_KEY].UUID(keys[1])
+			got, ok = mirrored[LATEST_KEY].UUID(keys[1])
+		case "name":
+			want, _ = lookups[LATEST_KEY].Name(keys[1:]...)
+			got, ok = mirrored[LATEST_KEY].Name(keys[1:]...)
+		}
+		if !ok || got.Kind != want.Kind || got.Object["uuid"] != want.Object["uuid"] {
+			t.Errorf("lookup %v got %v %v, want %v %v", keys, got.Kind, got.Object["uuid"], want.Kind, want.Object["uuid"])
+		}
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "secret")
+
+	// left by a crash, readable by everyone
+	if err := ioutil.WriteFile(path+".temp", []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(path, []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil || string(content) != "content" {
+		t.Fatalf("read %q, %v", content, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("expected mode 0600, got %v", mode)
+	}
+	if _, err := os.Stat(path + ".temp"); !os.IsNotExist(err) {
+		t.Errorf("the temporary file was left, %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+type FieldType int
+
+const (
+	StringField FieldType = iota
+	MapField
+	ListField
+)
+
+func (t FieldType) String() string {
+	switch t {
+	case StringField:
+		return "string"
+	case MapField:
+		return "map"
+	case ListField:
+		return "list"
+	}
+	return "unknown"
+}
+
+// Field declares a field of a metadata object.  Optional fields may be
+// missing or null.  Elem is the type of the elements of a list, Fields the
+// schema of a map.
+type Field struct {
+	Name     string
+	Type     FieldType
+	Required bool
+	Elem     *FieldType
+	Fields   Schema
+}
+
+// Schema lists the fields of a metadata_kind that the generator relies on.
+// Fields that aren't declared are passed through unchecked.
+type Schema []Field
+
+// ValidationError names the object and field that don't match the schema of
+// their kind
+type ValidationError struct {
+	Kind   string
+	UUID   string
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid metadata object of kind [%s] uuid [%s]: field [%s] %s", e.Kind, e.UUID, e.Field, e.Reason)
+}
+
+func required(name string, t FieldType) Field {
+	return Field{Name: name, Type: t, Required: true}
+}
+
+func optional(name string, t FieldType) Field {
+	return Field{Name: name, Type: t}
+}
+
+func stringList(name string) Field {
+	elem := StringField
+	return Field{Name: name, Type: ListField, Elem: &elem}
+}
+
+// Validate checks o against the schema and returns the first mismatch
+func (s Schema) Validate(kind string, o map[string]interface{}) *ValidationError {
+	uuid, _ := o["uuid"].(string)
+	if reason, field := s.validate(o); reason != "" {
+		return &ValidationError{Kind: kind, UUID: uuid, Field: field, Reason: reason}
+	}
+	return nil
+}
+
+func (s Schema) validate(o map[string]interface{}) (string, string) {
+	for _, f := range s {
+		value := o[f.Name]
+		if value == nil {
+			if f.Required {
+				return "is missing", f.Name
+			}
+			continue
+		}
+		if !f.Type.matches(value) {
+			return fmt.Sprintf("is a %T, expected a %s", value, f.Type), f.Name
+		}
+		switch f.Type {
+		case ListField:
+			if f.Elem == nil {
+				continue
+			}
+			for i, elem := range value.([]interface{}) {
+				if !f.Elem.matches(elem) {
+					return fmt.Sprintf("is a %T, expected a %s", elem, *f.Elem), fmt.Sprintf("%s[%d]", f.Name, i)
+				}
+			}
+		case MapField:
+			if reason, field := f.Fields.validate(value.(map[string]interface{})); reason != "" {
+				return reason, strings.Join([]string{f.Name, field}, ".")
+			}
+		}
+	}
+	return "", ""
+}
+
+func (t FieldType) matches(value interface{}) bool {
+	switch t {
+	case StringField:
+		_, ok := value.(string)
+		return ok
+	case MapField:
+		_, ok := value.(map[string]interface{})
+		return ok
+	case ListField:
+		_, ok := value.([]interface{})
+		return ok
+	}
+	return false
+}
+
+var (
+	containerSchema = Schema{
+		required("uuid", StringField),
+		optional("name", StringField),
+		optional("primary_ip", StringField),
+		optional("host_uuid", StringField),
+		optional("stack_uuid", StringField),
+		optional("stack_name", StringField),
+		optional("service_uuid", StringField),
+		optional("service_name", StringField),
+		optional("labels", MapField),
+		stringList("ports"),
+	}
+	serviceSchema = Schema{
+		required("uuid", StringField),
+		required("name", StringField),
+		required("stack_uuid", StringField),
+		required("stack_name", StringField),
+		required("primary_service_name", StringField),
+		stringList("sidekicks"),
+	}
+	stackSchema = Schema{
+		required("uuid", StringField),
+		required("name", StringField),
+	}
+	hostSchema = Schema{
+		required("uuid", StringField),
+	}
+	defaultDataSchema = Schema{
+		optional("version", StringField),
+		{Name: "self", Type: MapField, Fields: Schema{
+			{Name: "host", Type: MapField, Fields: Schema{required("uuid", StringField)}},
+		}},
+	}
+	serviceContainerLinkSchema = Schema{
+		required("service_uuid", StringField),
+		required("service_name", StringField),
+		required("container_uuid", StringField),
+	}
+	containerLinkSchema = Schema{
+		required("container_uuid", StringField),
+		required("key", StringField),
+		required("value", StringField),
+	}
+	serviceLinkSchema = Schema{
+		required("service_uuid", StringField),
+		required("key", StringField),
+		required("value", StringField),
+	}
+	credentialSchema = Schema{
+		required("url", StringField),
+		required("public_value", StringField),
+		required("secret_value", StringField),
+	}
+)
+
+// validateObjects returns the objects of data that match the schema of their
+// kind, and the errors for those that don't.  Objects of unknown kinds are
+// left for the generator to count.
+func validateObjects(data []map[string]interface{}) ([]map[string]interface{}, []*ValidationError) {
+	var errs []*ValidationError
+	valid := make([]map[string]interface{}, 0, len(data))
+	for _, o := range data {
+		name, _ := o["metadata_kind"].(string)
+		if kind, ok := lookupKind(name); ok && kind.Schema != nil {
+			if err := kind.Schema.Validate(name, o); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		valid = append(valid, o)
+	}
+	return valid, errs
+}
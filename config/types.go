@@ -9,7 +9,9 @@ const METADATA_VERSION1 = "2015-07-25"
 const METADATA_VERSION2 = "2015-12-19"
 const METADATA_VERSION3 = "2016-07-29"
 
-var SUPPORTED_VERSIONS = []string{METADATA_VERSION1, METADATA_VERSION2, METADATA_VERSION3}
+// Versions are ISO-8601 dates
+const VERSION_DATE_FORMAT = "2006-01-02"
+
 var MAGIC_ARRAY_KEYS = []string{"name", "uuid"}
 
 type Versions map[string]Answers
@@ -28,6 +30,10 @@ type Interim struct {
 	Default                         map[string]interface{}
 	Environment                     map[string]interface{}
 	Credentials                     []Credential
+	// Objects of registered kinds that keep no dedicated field, by metadata_kind
+	Objects map[string][]map[string]interface{}
+	// Number of objects of each metadata_kind no kind was registered for
+	UnknownKinds map[string]int
 }
 
 type Credential struct {
@@ -0,0 +1,315 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// port normalizations
+	PORTS_HOST_IP = "host_ip"
+	PORTS_ANY_IP  = "any_ip"
+	// how a service lists its containers and a stack its services
+	CHILDREN_NAMES   = "names"
+	CHILDREN_OBJECTS = "objects"
+)
+
+// VersionSpec declares how the answers of a metadata version are rendered
+type VersionSpec struct {
+	Name string `yaml:"name"`
+	// Environments adds the answers of the other environments to the version
+	Environments bool        `yaml:"environments"`
+	Containers   ObjectRules `yaml:"containers"`
+	Services     ObjectRules `yaml:"services"`
+	Stacks       ObjectRules `yaml:"stacks"`
+	Hosts        ObjectRules `yaml:"hosts"`
+}
+
+// ObjectRules rewrite the objects of a kind.  Fields are lowercased first,
+// then renamed, then removed.
+type ObjectRules struct {
+	// Lowercase lowercases string fields and the strings of list fields
+	Lowercase []string `yaml:"lowercase"`
+	// LowercaseKeys lowercases the keys of map fields
+	LowercaseKeys []string          `yaml:"lowercase_keys"`
+	Rename        map[string]string `yaml:"rename"`
+	Remove        []string          `yaml:"remove"`
+	// Ports fills in the IP of container ports published without one, either
+	// with the IP of the host (host_ip) or with 0.0.0.0 (any_ip)
+	Ports string `yaml:"ports"`
+	// Children lists the containers of a service, or the services of a stack,
+	// by name (names) or as whole objects (objects).  They aren't listed if
+	// it is empty.
+	Children string `yaml:"children"`
+}
+
+type versionSpecs struct {
+	Versions []VersionSpec `yaml:"versions"`
+}
+
+// The versions served unless redefined by --versions
+const defaultVersionSpecs = `
+versions:
+- name: 2015-07-25
+  containers:
+    ports: host_ip
+  services:
+    children: names
+  stacks:
+    children: names
+- name: 2015-12-19
+  containers:
+    ports: host_ip
+  services:
+    children: objects
+  stacks:
+    children: objects
+- name: 2016-07-29
+  environments: true
+  containers:
+    lowercase: [name, service_name, stack_name]
+    ports: any_ip
+  services:
+    children: objects
+    lowercase: [name, stack_name, primary_service_name, sidekicks]
+    lowercase_keys: [links]
+  stacks:
+    children: objects
+    lowercase: [name]
+  hosts:
+    remove: [hostId]
+`
+
+var specs = struct {
+	sync.RWMutex
+	byName map[string]*VersionSpec
+}{
+	byName: make(map[string]*VersionSpec),
+}
+
+// ParseVersionSpecs parses and checks a YAML list of version specs
+func ParseVersionSpecs(content []byte) ([]VersionSpec, error) {
+	var parsed versionSpecs
+	if err := yaml.Unmarshal(content, &parsed); err != nil {
+		return nil, fmt.Errorf("Failed to parse version specs: %v", err)
+	}
+	for _, spec := range parsed.Versions {
+		if err := spec.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return parsed.Versions, nil
+}
+
+// LoadVersionSpecs adds the versions declared in a YAML file, replacing the
+// built-in ones of the same name
+func LoadVersionSpecs(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read version specs from [%s]: %v", path, err)
+	}
+	parsed, err := ParseVersionSpecs(content)
+	if err != nil {
+		return err
+	}
+	for _, spec := range parsed {
+		RegisterVersionSpec(spec)
+	}
+	return nil
+}
+
+// RegisterVersionSpec serves a version from every generator created after
+func RegisterVersionSpec(spec VersionSpec) {
+	specs.Lock()
+	defer specs.Unlock()
+	s := spec
+	specs.byName[s.Name] = &s
+}
+
+// SupportedVersions returns the names of the versions with a spec, oldest first
+func SupportedVersions() []string {
+	specs.RLock()
+	defer specs.RUnlock()
+	names := make([]string, 0, len(specs.byName))
+	for name := range specs.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// EnvironmentVersions returns the names of the versions that add the answers
+// of the other environments, which are rendered in those versions only.
+// Without any, they are rendered in the latest version.
+func EnvironmentVersions() []string {
+	var names []string
+	for _, name := range SupportedVersions() {
+		if lookupVersionSpec(name).Environments {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		names = []string{latestVersion(SupportedVersions())}
+	}
+	return names
+}
+
+func latestVersion(versions []string) string {
+	var latest string
+	for _, v := range versions {
+		if v > latest {
+			latest = v
+		}
+	}
+	return latest
+}
+
+func lookupVersionSpec(name string) *VersionSpec {
+	specs.RLock()
+	defer specs.RUnlock()
+	if spec, ok := specs.byName[name]; ok {
+		return spec
+	}
+	return &VersionSpec{Name: name}
+}
+
+func (spec *VersionSpec) validate() error {
+	if _, err := time.Parse(VERSION_DATE_FORMAT, spec.Name); err != nil {
+		return fmt.Errorf("Invalid version [%s]: names must be dates (yyyy-mm-dd)", spec.Name)
+	}
+	for kind, rules := range map[string]ObjectRules{
+		"containers": spec.Containers, "services": spec.Services, "stacks": spec.Stacks, "hosts": spec.Hosts} {
+		switch rules.Ports {
+		case "", PORTS_HOST_IP, PORTS_ANY_IP:
+		default:
+			return fmt.Errorf("Invalid version [%s]: unknown ports [%s] for %s", spec.Name, rules.Ports, kind)
+		}
+		switch rules.Children {
+		case "", CHILDREN_NAMES, CHILDREN_OBJECTS:
+		default:
+			return fmt.Errorf("Invalid version [%s]: unknown children [%s] for %s", spec.Name, rules.Children, kind)
+		}
+	}
+	return nil
+}
+
+// children returns objects by name or as is, depending on the rules
+func (r *ObjectRules) children(objects []interface{}) []interface{} {
+	switch r.Children {
+	case CHILDREN_NAMES:
+		var names []interface{}
+		for _, o := range objects {
+			names = append(names, stringField(o.(map[string]interface{}), "name"))
+		}
+		return names
+	case CHILDREN_OBJECTS:
+		return objects
+	}
+	return nil
+}
+
+func (r *ObjectRules) lowercase(o map[string]interface{}) {
+	for _, field := range r.Lowercase {
+		switch value := o[field].(type) {
+		case string:
+			o[field] = strings.ToLower(value)
+		case []interface{}:
+			var lowercased []interface{}
+			for _, v := range value {
+				if s, ok := v.(string); ok {
+					lowercased = append(lowercased, strings.ToLower(s))
+				} else {
+					lowercased = append(lowercased, v)
+				}
+			}
+			o[field] = lowercased
+		}
+	}
+	for _, field := range r.LowercaseKeys {
+		if value, ok := o[field].(map[string]interface{}); ok {
+			lowercased := make(map[string]interface{})
+			for key, v := range value {
+				lowercased[strings.ToLower(key)] = v
+			}
+			o[field] = lowercased
+		}
+	}
+}
+
+func (r *ObjectRules) reshape(o map[string]interface{}) {
+	for from, to := range r.Rename {
+		if value, ok := o[from]; ok {
+			delete(o, from)
+			o[to] = value
+		}
+	}
+	for _, field := range r.Remove {
+		delete(o, field)
+	}
+}
+
+func (r *ObjectRules) apply(o map[string]interface{}) {
+	r.lowercase(o)
+	r.reshape(o)
+}
+
+// ports fills in the IP of the ports of container c published without one
+func (r *ObjectRules) ports(c map[string]interface{}) {
+	originalPorts, ok := c["ports"].([]interface{})
+	if !ok {
+		return
+	}
+	switch r.Ports {
+	case PORTS_ANY_IP:
+		// set port ip to 0.0.0.0 if not specified
+		var newPorts []interface{}
+		for _, p := range originalPorts {
+			port := p.(string)
+			splitted := strings.Split(port, ":")
+			if len(splitted) == 3 {
+				newPorts = append(newPorts, port)
+			} else {
+				port = fmt.Sprintf("0.0.0.0:%s", port)
+				newPorts = append(newPorts, port)
+			}
+		}
+		c["ports"] = newPorts
+	case PORTS_HOST_IP:
+		// set port ip to host's ip if not specified
+		if len(originalPorts) > 0 {
+			var newPorts []interface{}
+			for _, p := range originalPorts {
+				port := p.(string)
+				splitted := strings.Split(port, ":")
+				if len(splitted) == 3 && splitted[0] != "0.0.0.0" {
+					newPorts = append(newPorts, port)
+				} else {
+					if len(splitted) == 3 {
+						port = fmt.Sprintf("%s%s", c["host_ip"], strings.TrimPrefix(port, "0.0.0.0"))
+					} else {
+						port = fmt.Sprintf("%s:%s", c["host_ip"], port)
+					}
+
+					newPorts = append(newPorts, port)
+				}
+			}
+			c["ports"] = newPorts
+		}
+	}
+}
+
+func init() {
+	parsed, err := ParseVersionSpecs([]byte(defaultVersionSpecs))
+	if err != nil {
+		panic(err)
+	}
+	for _, spec := range parsed {
+		RegisterVersionSpec(spec)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -10,6 +12,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -23,6 +26,9 @@ import (
 	"github.com/rancher/log"
 	logserver "github.com/rancher/log/server"
 	"github.com/rancher/rancher-metadata/config"
+	"github.com/rancher/rancher-metadata/pkg/filewatch"
+	"github.com/rancher/rancher-metadata/pkg/metrics"
+	"github.com/rancher/rancher-metadata/pkg/selector"
 	"github.com/rancher/rancher-metadata/server"
 	"gopkg.in/yaml.v2"
 )
@@ -40,6 +46,12 @@ var (
 	// Both ../things/0/stuff and ../things/asdf/stuff will return 42 because 'asdf' matched the 'anme' field of one of the 'things'.
 )
 
+// How long the answers files must be left unchanged before reloading them
+const ANSWERS_WATCH_DEBOUNCE = time.Second
+
+// Where the default mux, for debugging, is served
+const DEBUG_LISTEN = ":6060"
+
 // ServerConfig specifies the configuration for the metadata server
 type ServerConfig struct {
 	sync.Mutex
@@ -48,17 +60,39 @@ type ServerConfig struct {
 
 	listen       string
 	listenReload string
+	listenMirror string
+	mirrorToken  string
 	enableXff    bool
 
+	versionAliases     map[string]string
+	deprecatedVersions map[string]time.Time
+
 	router       *mux.Router
 	reloadRouter *mux.Router
+	mirrorRouter *mux.Router
 	reloadChan   chan chan error
+
+	// reload when the answers files change
+	answersFile  string
+	watchAnswers bool
+
+	pidFile         string
+	shutdownTimeout time.Duration
+	server          *http.Server
+	reloadServer    *http.Server
+	mirrorServer    *http.Server
+	debugServer     *http.Server
+	// the background goroutines run until ctx is done
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
 }
 
 func main() {
 	logserver.StartServerWithDefaults()
 	app := getCliApp()
 	app.Action = appMain
+	app.Commands = getCommands()
 	app.Run(os.Args)
 }
 
@@ -84,6 +118,15 @@ func getCliApp() *cli.App {
 			Value: "127.0.0.1:8112",
 			Usage: "Address to listen to for reload requests (TCP)",
 		},
+		cli.StringFlag{
+			Name:  "listenMirror",
+			Usage: "Address to serve the answers to mirror on, for the caches using --upstream (TCP)",
+		},
+		cli.StringFlag{
+			Name:   "mirror-token",
+			EnvVar: "RANCHER_METADATA_MIRROR_TOKEN",
+			Usage:  "Token the caches authenticate with to --listenMirror, and a cache sends to its --upstream",
+		},
 		cli.StringFlag{
 			Name:  "answers",
 			Value: "./answers.json",
@@ -99,15 +142,75 @@ func getCliApp() *cli.App {
 			Value: "",
 			Usage: "PID to write to",
 		},
+		cli.DurationFlag{
+			Name:  "shutdown-timeout",
+			Value: 10 * time.Second,
+			Usage: "Time to finish answering requests and save the answers in on SIGTERM, before exiting anyway",
+		},
 		cli.BoolFlag{
 			Name:  "subscribe",
 			Usage: "Subscribe to Rancher events",
 		},
+		cli.StringFlag{
+			Name:  "upstream",
+			Usage: "URL of the --listenMirror address of another rancher-metadata to mirror the answers of, instead of subscribing to Rancher",
+		},
+		cli.StringFlag{
+			Name:  "poll",
+			Usage: "URL to download the answers from every poll interval, instead of subscribing to Rancher",
+		},
+		cli.DurationFlag{
+			Name:  "poll-interval",
+			Value: 30 * time.Second,
+			Usage: "Time between downloads of the --poll URL",
+		},
+		cli.StringFlag{
+			Name:  "poll-format",
+			Value: server.POLL_FORMAT_DELTA,
+			Usage: "Format of the --poll URL: delta (like Rancher's) or answers (JSON answers by version then client)",
+		},
+		cli.BoolFlag{
+			Name:  "watch-answers",
+			Usage: "Reload when the answers files change on disk",
+		},
 		cli.Int64Flag{
 			Name:  "reload-interval-limit",
 			Usage: "Limits reload to 1 per interval (milliseconds)",
 			Value: 1000,
 		},
+		cli.BoolFlag{
+			Name:  "strict-keys",
+			Usage: "Match answer keys case-sensitively",
+		},
+		cli.BoolFlag{
+			Name:  "strict-schema",
+			Usage: "Reject the whole metadata delta if any object doesn't match its schema, instead of skipping the object",
+		},
+		cli.IntFlag{
+			Name:  "history",
+			Usage: "Number of deltas from Rancher to keep for rollback, none by default",
+		},
+		cli.StringFlag{
+			Name:  "array-order",
+			Value: strings.Join(config.DEFAULT_ARRAY_ORDER, ","),
+			Usage: "Comma separated fields to sort the containers, services, stacks and hosts arrays by",
+		},
+		cli.StringFlag{
+			Name:  "versions",
+			Usage: "YAML file declaring metadata versions to serve in addition to, or instead of, the built-in ones",
+		},
+		cli.StringSliceFlag{
+			Name:  "version-alias",
+			Usage: "Serve a version under another name (alias=version)",
+		},
+		cli.StringSliceFlag{
+			Name:  "overlay",
+			Usage: "JSON or YAML file of answers to merge on top of the generated ones, or to merge at a path of the default answers ([path=]file)",
+		},
+		cli.StringSliceFlag{
+			Name:  "deprecated-version",
+			Usage: "Send a Deprecation header for a version, and optionally a Sunset header (version[=yyyy-mm-dd])",
+		},
 	}
 
 	return app
@@ -135,14 +238,60 @@ func appMain(ctx *cli.Context) error {
 		}
 	}
 
-	sc := NewServerConfig(
-		ctx.GlobalString("listen"),
-		ctx.GlobalString("listenReload"),
-		ctx.GlobalBool("xff"),
-		ctx.GlobalBool("subscribe"),
-		ctx.GlobalString("answers"),
-		ctx.Int64("reload-interval-limit"),
-	)
+	if err := setupGeneration(ctx); err != nil {
+		return err
+	}
+
+	versionAliases, err := parseVersionAliases(ctx.GlobalStringSlice("version-alias"))
+	if err != nil {
+		return err
+	}
+
+	deprecatedVersions, err := parseDeprecatedVersions(ctx.GlobalStringSlice("deprecated-version"))
+	if err != nil {
+		return err
+	}
+
+	overlays, err := parseOverlays(ctx.GlobalStringSlice("overlay"))
+	if err != nil {
+		return err
+	}
+
+	newLocal, err := localSource(ctx)
+	if err != nil {
+		return err
+	}
+
+	if ctx.GlobalString("listenMirror") != "" && ctx.GlobalString("mirror-token") == "" {
+		return fmt.Errorf("--listenMirror requires a --mirror-token for the caches to authenticate with")
+	}
+
+	if ctx.GlobalBool("watch-answers") && ctx.GlobalBool("subscribe") {
+		return fmt.Errorf("Can't watch the answers files when subscribing to Rancher, which writes them")
+	}
+
+	sc := NewServerConfig(ServerOptions{
+		Listen:             ctx.GlobalString("listen"),
+		ListenReload:       ctx.GlobalString("listenReload"),
+		ListenMirror:       ctx.GlobalString("listenMirror"),
+		MirrorToken:        ctx.GlobalString("mirror-token"),
+		EnableXff:          ctx.GlobalBool("xff"),
+		VersionAliases:     versionAliases,
+		DeprecatedVersions: deprecatedVersions,
+		PidFile:            pidFile,
+		ShutdownTimeout:    ctx.GlobalDuration("shutdown-timeout"),
+		WatchAnswers:       ctx.GlobalBool("watch-answers"),
+		Controller: server.ControllerOptions{
+			Subscribe:      ctx.GlobalBool("subscribe"),
+			Answers:        ctx.GlobalString("answers"),
+			ReloadInterval: ctx.Int64("reload-interval-limit"),
+			StrictKeys:     ctx.GlobalBool("strict-keys"),
+			StrictSchema:   ctx.GlobalBool("strict-schema"),
+			HistorySize:    ctx.GlobalInt("history"),
+			Overlays:       overlays,
+			NewLocal:       newLocal,
+		},
+	})
 
 	if err := sc.StartServer(); err != nil {
 		return err
@@ -154,91 +303,360 @@ func appMain(ctx *cli.Context) error {
 	return nil
 }
 
+// setupGeneration applies the flags that change how answers are generated
+func setupGeneration(ctx *cli.Context) error {
+	if versionSpecs := ctx.GlobalString("versions"); versionSpecs != "" {
+		if err := config.LoadVersionSpecs(versionSpecs); err != nil {
+			return err
+		}
+	}
+
+	return config.SetArrayOrder(strings.Split(ctx.GlobalString("array-order"), ","))
+}
+
+func parseVersionAliases(values []string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid version alias [%s], expected alias=version", value)
+		}
+		aliases[parts[0]] = parts[1]
+	}
+	return aliases, nil
+}
+
+// localSource returns how to make the source of the local answers, or nil
+// for the local Rancher environment
+func localSource(ctx *cli.Context) (server.NewSourceFunc, error) {
+	upstream := ctx.GlobalString("upstream")
+	poll := ctx.GlobalString("poll")
+	answers := ctx.GlobalString("answers")
+	if (upstream != "" || poll != "") && ctx.GlobalBool("subscribe") || upstream != "" && poll != "" {
+		return nil, fmt.Errorf("Only one of --subscribe, --upstream and --poll can be used")
+	}
+
+	if upstream != "" {
+		return func(update server.SourceUpdateFunc) server.Source {
+			return server.NewUpstream(upstream, ctx.GlobalString("mirror-token"), answers, update)
+		}, nil
+	}
+	if poll != "" {
+		format := ctx.GlobalString("poll-format")
+		if format != server.POLL_FORMAT_DELTA && format != server.POLL_FORMAT_ANSWERS {
+			return nil, fmt.Errorf("Unknown poll format [%s], expected %s or %s", format, server.POLL_FORMAT_DELTA, server.POLL_FORMAT_ANSWERS)
+		}
+		interval := ctx.GlobalDuration("poll-interval")
+		if interval <= 0 {
+			return nil, fmt.Errorf("Invalid poll interval [%v]", interval)
+		}
+		strictSchema := ctx.GlobalBool("strict-schema")
+		return func(update server.SourceUpdateFunc) server.Source {
+			return server.NewPollSource(poll, format, interval, answers, strictSchema, update)
+		}, nil
+	}
+	return nil, nil
+}
+
+func parseOverlays(values []string) ([]*config.Overlay, error) {
+	var overlays []*config.Overlay
+	for _, value := range values {
+		o, err := config.ParseOverlay(value)
+		if err != nil {
+			return nil, err
+		}
+		overlays = append(overlays, o)
+	}
+	return overlays, nil
+}
+
+func parseDeprecatedVersions(values []string) (map[string]time.Time, error) {
+	deprecated := make(map[string]time.Time)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		var sunset time.Time
+		if len(parts) == 2 {
+			var err error
+			if sunset, err = time.Parse(config.VERSION_DATE_FORMAT, parts[1]); err != nil {
+				return nil, fmt.Errorf("Invalid sunset date for deprecated version [%s]: %v", value, err)
+			}
+		}
+		deprecated[parts[0]] = sunset
+	}
+	return deprecated, nil
+}
+
 func (sc *ServerConfig) StartServer() error {
-	if err := sc.metadataController.Start(); err != nil {
+	if err := sc.metadataController.Start(sc.ctx); err != nil {
 		return err
 	}
+	if sc.watchAnswers {
+		sc.watchAnswersFiles()
+	}
 	go func() {
-		log.Info(http.ListenAndServe(":6060", nil))
+		if err := sc.debugServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Failed to listen for debugging on %s: %v", DEBUG_LISTEN, err)
+		}
 	}()
 	return nil
 }
 
-func NewServerConfig(listen, listenReload string, enableXff bool, subscribe bool, answers string, reloadInterval int64) *ServerConfig {
+// ServerOptions configures the metadata server
+type ServerOptions struct {
+	Listen       string
+	ListenReload string
+	// serve the answers to mirror, if set, to the caches sending the token
+	ListenMirror string
+	MirrorToken  string
+	EnableXff    bool
+	// versions served under other names, and the deprecated versions with
+	// their sunset dates, if any
+	VersionAliases     map[string]string
+	DeprecatedVersions map[string]time.Time
+	PidFile            string
+	ShutdownTimeout    time.Duration
+	// reload when the answers files change
+	WatchAnswers bool
+	Controller   server.ControllerOptions
+}
+
+func NewServerConfig(opts ServerOptions) *ServerConfig {
 	router := mux.NewRouter()
 	reloadRouter := mux.NewRouter()
+	mirrorRouter := mux.NewRouter()
 	reloadChan := make(chan chan error)
+	metadataController := server.NewMetadataController(opts.Controller)
+	registerMetrics(metadataController)
+	ctx, cancel := context.WithCancel(context.Background())
 	return &ServerConfig{
-		listen:             listen,
-		listenReload:       listenReload,
-		enableXff:          enableXff,
+		listen:             opts.Listen,
+		listenReload:       opts.ListenReload,
+		listenMirror:       opts.ListenMirror,
+		mirrorToken:        opts.MirrorToken,
+		enableXff:          opts.EnableXff,
+		versionAliases:     opts.VersionAliases,
+		deprecatedVersions: opts.DeprecatedVersions,
 		router:             router,
 		reloadRouter:       reloadRouter,
+		mirrorRouter:       mirrorRouter,
 		reloadChan:         reloadChan,
-		metadataController: server.NewMetadataController(subscribe, answers, reloadInterval),
+		metadataController: metadataController,
+		answersFile:        opts.Controller.Answers,
+		watchAnswers:       opts.WatchAnswers,
+		pidFile:            opts.PidFile,
+		shutdownTimeout:    opts.ShutdownTimeout,
+		server:             &http.Server{Addr: opts.Listen, Handler: router},
+		reloadServer:       &http.Server{Addr: opts.ListenReload, Handler: reloadRouter},
+		mirrorServer:       &http.Server{Addr: opts.ListenMirror, Handler: mirrorRouter},
+		debugServer:        &http.Server{Addr: DEBUG_LISTEN},
+		ctx:                ctx,
+		cancel:             cancel,
+		stopped:            make(chan struct{}),
 	}
 }
 
 func (sc *ServerConfig) watchSignals() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGHUP)
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
 
 	go func() {
-		for _ = range c {
-			log.Info("Received HUP signal")
-			sc.reloadChan <- nil
+		for {
+			select {
+			case <-sc.ctx.Done():
+				return
+			case sig := <-c:
+				if sig != syscall.SIGHUP {
+					log.Infof("Received %v signal", sig)
+					sc.shutdown()
+					return
+				}
+				log.Info("Received HUP signal")
+				sc.reload(nil)
+			}
 		}
 	}()
 
 	go func() {
-		for resp := range sc.reloadChan {
-			err := sc.metadataController.LoadVersionsFromFile()
-			if resp != nil {
-				resp <- err
+		for {
+			select {
+			case <-sc.ctx.Done():
+				return
+			case resp := <-sc.reloadChan:
+				err := sc.metadataController.LoadVersionsFromFile()
+				if resp != nil {
+					resp <- err
+				} else if err != nil {
+					log.Errorf("Failed to reload: %v", err)
+				}
 			}
 		}
 	}()
 
 }
 
+// watchAnswersFiles reloads when the answers file, or the answers file of an
+// external environment, changes
+func (sc *ServerConfig) watchAnswersFiles() {
+	dir, name := filepath.Split(sc.answersFile)
+	if dir == "" {
+		dir = "."
+	}
+	log.Infof("Watching the answers files [%s] in [%s]", name, dir)
+	filewatch.Watch(sc.ctx, dir, func(file string) bool {
+		if file == name {
+			return true
+		}
+		// answers_<accessKey>, but not the temporary files written before
+		// renaming them
+		return strings.HasPrefix(file, name+"_") && !strings.Contains(file[len(name)+1:], ".")
+	}, ANSWERS_WATCH_DEBOUNCE, func() {
+		log.Info("Answers files changed, reloading")
+		sc.reload(nil)
+	})
+}
+
+// reload asks for the answers to be loaded from file, unless shutting down
+func (sc *ServerConfig) reload(resp chan error) bool {
+	select {
+	case <-sc.ctx.Done():
+		return false
+	case sc.reloadChan <- resp:
+		return true
+	}
+}
+
+// shutdown answers the pending requests, stops the subscribers, saves their
+// answers and removes the pid file, closing the connections still open after
+// the shutdown timeout
+func (sc *ServerConfig) shutdown() {
+	log.Infof("Shutting down within %v", sc.shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), sc.shutdownTimeout)
+	defer cancel()
+
+	// the servers stop listening right away, and wait for the long-polls the
+	// controller answers as it stops
+	servers := []*http.Server{sc.server, sc.reloadServer, sc.mirrorServer, sc.debugServer}
+	var wg sync.WaitGroup
+	wg.Add(1 + len(servers))
+	go func() {
+		defer wg.Done()
+		sc.metadataController.Stop()
+	}()
+	for _, s := range servers {
+		go func(s *http.Server) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Warnf("Failed to shut down the server on %s: %v", s.Addr, err)
+			}
+		}(s)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Info("Shut down")
+	case <-ctx.Done():
+		log.Errorf("Failed to shut down within %v, exiting anyway", sc.shutdownTimeout)
+		for _, s := range servers {
+			s.Close()
+		}
+	}
+	sc.cancel()
+	if sc.pidFile != "" {
+		if err := os.Remove(sc.pidFile); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Failed to remove pid file %s: %v", sc.pidFile, err)
+		}
+	}
+	close(sc.stopped)
+}
+
 func (sc *ServerConfig) watchHttp() {
 	sc.reloadRouter.HandleFunc("/favicon.ico", http.NotFound)
 	sc.reloadRouter.HandleFunc("/v1/reload", sc.httpReload).Methods("POST")
+	sc.reloadRouter.Handle("/metrics", metrics.Default).Methods("GET")
+	sc.reloadRouter.HandleFunc("/v1/status", sc.status).Methods("GET")
+	sc.reloadRouter.HandleFunc("/v1/sources", sc.listSources).Methods("GET")
+	sc.reloadRouter.HandleFunc("/v1/sources", sc.addSource).Methods("POST")
+	sc.reloadRouter.HandleFunc("/v1/sources/{accessKey}", sc.removeSource).Methods("DELETE")
+	sc.reloadRouter.HandleFunc("/v1/diff", sc.diff).Methods("GET")
+	sc.reloadRouter.HandleFunc("/v1/snapshots", sc.listSnapshots).Methods("GET")
+	sc.reloadRouter.HandleFunc("/v1/snapshots/unpin", sc.unpinSnapshot).Methods("POST")
+	sc.reloadRouter.HandleFunc("/v1/snapshots/{id}/diff", sc.diffSnapshot).Methods("GET")
+	sc.reloadRouter.HandleFunc("/v1/snapshots/{id}/rollback", sc.rollbackSnapshot).Methods("POST")
 
 	log.Info("Listening for Reload on ", sc.listenReload)
-	go http.ListenAndServe(sc.listenReload, sc.reloadRouter)
+	go func() {
+		if err := sc.reloadServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Failed to listen for reload on %s: %v", sc.listenReload, err)
+		}
+	}()
 }
 
+// watchMirror serves the answers to the caches mirroring them, apart from the
+// admin API
+func (sc *ServerConfig) watchMirror() {
+	sc.mirrorRouter.HandleFunc("/v1/answers", sc.authorizeMirror(sc.answers)).Methods("GET")
+
+	log.Info("Listening for mirrors on ", sc.listenMirror)
+	go func() {
+		if err := sc.mirrorServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Failed to listen for mirrors on %s: %v", sc.listenMirror, err)
+		}
+	}()
+}
+
+// RunServer serves until shut down by a signal
 func (sc *ServerConfig) RunServer() {
 	sc.watchSignals()
 	sc.watchHttp()
+	if sc.listenMirror != "" {
+		sc.watchMirror()
+	}
+	sc.routeHttp()
+
+	log.Info("Listening on ", sc.listen)
+	if err := sc.server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-sc.stopped
+}
 
+// routeHttp sets up the routes answering the clients
+func (sc *ServerConfig) routeHttp() {
 	sc.router.HandleFunc("/favicon.ico", http.NotFound)
-	sc.router.HandleFunc("/", sc.root).
+	sc.router.HandleFunc("/", sc.instrument(sc.root)).
 		Methods("GET", "HEAD").
 		Name("Root")
 
-	sc.router.HandleFunc("/{version}", sc.metadata).
+	sc.router.HandleFunc("/{version}", sc.instrument(sc.metadata)).
 		Methods("GET", "HEAD").
 		Name("Version")
 
-	sc.router.HandleFunc("/{version}/{key:.*}", sc.metadata).
+	sc.router.HandleFunc("/{version}/_lookup/{by:ip|uuid|name}/{key:.*}", sc.instrument(sc.lookup)).
+		Methods("GET", "HEAD").
+		Name("Lookup")
+
+	sc.router.HandleFunc("/{version}/{key:.*}", sc.instrument(sc.metadata)).
 		Queries("wait", "true", "value", "{oldValue}").
 		Methods("GET", "HEAD").
 		Name("Wait")
 
-	sc.router.HandleFunc("/{version}/{key:.*}", sc.metadata).
+	sc.router.HandleFunc("/{version}/{key:.*}", sc.instrument(sc.metadata)).
 		Methods("GET", "HEAD").
 		Name("Metadata")
-
-	log.Info("Listening on ", sc.listen)
-	log.Fatal(http.ListenAndServe(sc.listen, sc.router))
 }
 
 func (sc *ServerConfig) httpReload(w http.ResponseWriter, req *http.Request) {
 	log.Debugf("Received HTTP reload request")
-	respChan := make(chan error)
-	sc.reloadChan <- respChan
+	respChan := make(chan error, 1)
+	if !sc.reload(respChan) {
+		respondError(w, req, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
 	err := <-respChan
 
 	if err == nil {
@@ -249,6 +667,152 @@ func (sc *ServerConfig) httpReload(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (sc *ServerConfig) listSnapshots(w http.ResponseWriter, req *http.Request) {
+	snapshots, err := sc.metadataController.Snapshots()
+	if err != nil {
+		respondError(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respondAdmin(w, req, snapshots)
+}
+
+func (sc *ServerConfig) diffSnapshot(w http.ResponseWriter, req *http.Request) {
+	diff, err := sc.metadataController.Diff(mux.Vars(req)["id"], server.DIFF_LIVE)
+	if err != nil {
+		respondError(w, req, err.Error(), http.StatusNotFound)
+		return
+	}
+	respondAdmin(w, req, diff)
+}
+
+func (sc *ServerConfig) status(w http.ResponseWriter, req *http.Request) {
+	respondAdmin(w, req, sc.metadataController.Status())
+}
+
+// authorizeMirror answers 401 to the requests without the mirror token
+func (sc *ServerConfig) authorizeMirror(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		authorization := []byte(req.Header.Get("Authorization"))
+		if sc.mirrorToken == "" || subtle.ConstantTimeCompare(authorization, []byte("Bearer "+sc.mirrorToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			respondError(w, req, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// answers serves the merged answers, and their id, for the servers mirroring
+// this one.  With wait=true it waits up to
+// maxWait seconds for the id to differ from version, and answers 304 if it
+// doesn't.
+func (sc *ServerConfig) answers(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	version := query.Get("version")
+	maxWait := time.Duration(0)
+	if query.Get("wait") == "true" {
+		seconds, _ := strconv.Atoi(query.Get("maxWait"))
+		maxWait = time.Duration(seconds) * time.Second
+		if maxWait <= 0 || maxWait > 2*time.Minute {
+			maxWait = time.Minute
+		}
+	}
+
+	versions, current := sc.metadataController.WaitVersion(req.Context(), version, maxWait)
+	if current == version {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	respondAdmin(w, req, config.Mirror{Version: current, Versions: versions})
+}
+
+func (sc *ServerConfig) listSources(w http.ResponseWriter, req *http.Request) {
+	respondAdmin(w, req, sc.metadataController.Status().Sources)
+}
+
+// addSource subscribes to the environment in the JSON body, which has the
+// url, access_key and secret_key of the environment
+func (sc *ServerConfig) addSource(w http.ResponseWriter, req *http.Request) {
+	var source server.ExternalSource
+	if err := json.NewDecoder(req.Body).Decode(&source); err != nil {
+		respondError(w, req, "Invalid source: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := source.Validate(); err != nil {
+		respondError(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof("Received request to add source [%s] with url [%s]", source.AccessKey, source.URL)
+	if err := sc.metadataController.AddSource(source); err != nil {
+		respondError(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, "OK")
+}
+
+func (sc *ServerConfig) removeSource(w http.ResponseWriter, req *http.Request) {
+	accessKey := mux.Vars(req)["accessKey"]
+	log.Infof("Received request to remove source [%s]", accessKey)
+	found, err := sc.metadataController.RemoveSource(accessKey)
+	if !found {
+		respondError(w, req, "No source was added with access key "+accessKey, http.StatusNotFound)
+		return
+	} else if err != nil {
+		respondError(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, "OK")
+}
+
+// diff compares the answers named by the from and to query parameters, by
+// default those served before the last reload to the live ones
+func (sc *ServerConfig) diff(w http.ResponseWriter, req *http.Request) {
+	from, to := req.URL.Query().Get("from"), req.URL.Query().Get("to")
+	if from == "" {
+		from = server.DIFF_PREVIOUS
+	}
+	if to == "" {
+		to = server.DIFF_LIVE
+	}
+	diff, err := sc.metadataController.Diff(from, to)
+	if err != nil {
+		respondError(w, req, err.Error(), http.StatusNotFound)
+		return
+	}
+	respondAdmin(w, req, diff)
+}
+
+func (sc *ServerConfig) rollbackSnapshot(w http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+	log.Infof("Received rollback request to snapshot [%s]", id)
+	if err := sc.metadataController.RollbackSnapshot(id); err != nil {
+		respondError(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, "OK")
+}
+
+func (sc *ServerConfig) unpinSnapshot(w http.ResponseWriter, req *http.Request) {
+	log.Info("Received unpin request")
+	if err := sc.metadataController.UnpinSnapshot(); err != nil {
+		respondError(w, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	io.WriteString(w, "OK")
+}
+
+// respondAdmin answers the admin API in JSON, or YAML if asked for
+func respondAdmin(w http.ResponseWriter, req *http.Request, val interface{}) {
+	format := contentType(req)
+	if format != ContentYAML {
+		format = ContentJSON
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if err := writeAnswer(w, format, val); err != nil {
+		respondError(w, req, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func contentType(req *http.Request) int {
 	str := httputil.NegotiateContentType(req, []string{
 		"text/plain",
@@ -285,6 +849,15 @@ func (sc *ServerConfig) root(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
+	for alias := range sc.versionAliases {
+		url, err := sc.router.Get("Version").URL("version", alias)
+		if err == nil {
+			m[alias] = (*url).String()
+		} else {
+			log.Warn("Error: ", err.Error())
+		}
+	}
+
 	// If latest isn't in the list, pretend it is
 	_, ok := m["latest"]
 	if !ok {
@@ -310,43 +883,50 @@ func (sc *ServerConfig) metadata(w http.ResponseWriter, req *http.Request) {
 	oldValue := vars["oldValue"]
 	maxWait, _ := strconv.Atoi(req.URL.Query().Get("maxWait"))
 
-	answers := sc.metadataController.GetVersions()
-	_, ok := answers[version]
+	version, ok := sc.resolveVersion(version)
 	if !ok {
-		// If a `latest` key is not provided, pick the ASCII-betically highest version and call it that.
-		if version == "latest" {
-			version = ""
-			for _, k := range answers.Versions() {
-				if k > version {
-					version = k
-				}
-			}
-
-			log.Debugf("Picked %s for latest version because none provided", version)
-		} else {
-			respondError(w, req, "Invalid version", http.StatusNotFound)
-			return
-		}
+		respondError(w, req, "Invalid version", http.StatusNotFound)
+		return
 	}
+	recordVersion(w, version)
+	sc.setVersionHeaders(w, version)
 
-	path := strings.TrimRight(req.URL.EscapedPath()[1:], "/")
-	pathSegments := strings.Split(path, "/")[1:]
-	displayKey := ""
-	var err error
-	for i := 0; err == nil && i < len(pathSegments); i++ {
-		displayKey += "/" + pathSegments[i]
-		pathSegments[i], err = url.QueryUnescape(pathSegments[i])
+	pathSegments, displayKey, err := splitPath(req, 1)
+	if err != nil {
+		respondError(w, req, err.Error(), http.StatusBadRequest)
+		return
 	}
 
+	labels, err := selector.ParseLabels(req.URL.Query().Get("labelSelector"))
 	if err != nil {
 		respondError(w, req, err.Error(), http.StatusBadRequest)
 		return
 	}
+	fields, err := selector.ParseFields(req.URL.Query().Get("fieldSelector"))
+	if err != nil {
+		respondError(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var filter server.AnswerFilter
+	if !labels.Empty() || !fields.Empty() {
+		filter = func(val interface{}) interface{} {
+			if array, ok := val.([]interface{}); ok {
+				return selector.Filter(array, labels, fields)
+			}
+			return val
+		}
+	}
+
+	if !sc.metadataController.HasClientAnswers(version, clientIp) {
+		defaultFallbacks.Inc(version)
+	}
 
 	log.Debugf("Searching for: %s version=%v client=%v wait=%v oldValue=%v maxWait=%v", displayKey, version, clientIp, wait, oldValue, maxWait)
-	val, ok := sc.metadataController.LookupAnswer(wait, oldValue, version, clientIp, pathSegments, time.Duration(maxWait)*time.Second)
+	val, ok := sc.metadataController.LookupAnswer(req.Context(), wait, oldValue, version, clientIp, pathSegments, time.Duration(maxWait)*time.Second, filter)
 
-	if ok {
+	if _, isArray := val.([]interface{}); ok && filter != nil && !isArray {
+		respondError(w, req, "Selectors can only be applied to arrays", http.StatusBadRequest)
+	} else if ok {
 		log.Debugf("OK: %s version=%v client=%v", displayKey, version, clientIp)
 		respondSuccess(w, req, val)
 	} else {
@@ -355,6 +935,72 @@ func (sc *ServerConfig) metadata(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (sc *ServerConfig) lookup(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	vars := mux.Vars(req)
+	clientIp := sc.requestIp(req)
+	by := vars["by"]
+
+	version, ok := sc.resolveVersion(vars["version"])
+	if !ok {
+		respondError(w, req, "Invalid version", http.StatusNotFound)
+		return
+	}
+	recordVersion(w, version)
+	sc.setVersionHeaders(w, version)
+
+	keys, displayKey, err := splitPath(req, 3)
+	if err != nil {
+		respondError(w, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	val, ok := sc.metadataController.ReverseLookup(version, by, keys)
+	if ok {
+		log.Debugf("OK: lookup %s %s version=%v client=%v", by, displayKey, version, clientIp)
+		respondSuccess(w, req, map[string]interface{}{
+			"kind":   val.Kind,
+			"object": val.Object,
+		})
+	} else {
+		log.Infof("Error: lookup %s %s version=%v client=%v", by, displayKey, version, clientIp)
+		respondError(w, req, "Not found", http.StatusNotFound)
+	}
+}
+
+// resolveVersion returns the answers version to use for a requested version
+func (sc *ServerConfig) resolveVersion(version string) (string, bool) {
+	answers := sc.metadataController.GetVersions()
+	return answers.Resolve(version, sc.versionAliases)
+}
+
+// setVersionHeaders marks the response as deprecated if the version serving it is
+func (sc *ServerConfig) setVersionHeaders(w http.ResponseWriter, version string) {
+	sunset, ok := sc.deprecatedVersions[version]
+	if !ok {
+		return
+	}
+	w.Header().Set("Deprecation", "true")
+	if !sunset.IsZero() {
+		w.Header().Set("Sunset", sunset.Format(http.TimeFormat))
+	}
+}
+
+// splitPath unescapes the segments of the request path after the first skip
+// ones, and also returns them still escaped for logging.
+func splitPath(req *http.Request, skip int) ([]string, string, error) {
+	path := strings.TrimRight(req.URL.EscapedPath()[1:], "/")
+	pathSegments := strings.Split(path, "/")[skip:]
+	displayKey := ""
+	var err error
+	for i := 0; err == nil && i < len(pathSegments); i++ {
+		displayKey += "/" + pathSegments[i]
+		pathSegments[i], err = url.QueryUnescape(pathSegments[i])
+	}
+	return pathSegments, displayKey, err
+}
+
 func respondError(w http.ResponseWriter, req *http.Request, msg string, statusCode int) {
 	obj := make(map[string]interface{})
 	obj["message"] = msg
@@ -382,20 +1028,29 @@ func respondError(w http.ResponseWriter, req *http.Request, msg string, statusCo
 }
 
 func respondSuccess(w http.ResponseWriter, req *http.Request, val interface{}) {
-	switch contentType(req) {
-	case ContentText:
-		respondText(w, req, val)
+	if err := writeAnswer(w, contentType(req), val); err != nil {
+		respondError(w, req, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeAnswer writes val in a format of contentType, as the clients are
+// answered
+func writeAnswer(w io.Writer, format int, val interface{}) error {
+	switch format {
 	case ContentJSON:
-		respondJSON(w, req, val)
+		return writeJSON(w, val)
 	case ContentYAML:
-		respondYAML(w, req, val)
+		return writeYAML(w, val)
+	default:
+		return writeText(w, val)
 	}
 }
 
-func respondText(w http.ResponseWriter, req *http.Request, val interface{}) {
+// writeText writes val as the text answers list it: a value as is, and the
+// keys or indexes of a map or an array one per line
+func writeText(w io.Writer, val interface{}) error {
 	if val == nil {
-		fmt.Fprint(w, "")
-		return
+		return nil
 	}
 
 	switch v := val.(type) {
@@ -458,26 +1113,27 @@ func respondText(w http.ResponseWriter, req *http.Request, val interface{}) {
 			}
 		}
 	default:
-		http.Error(w, "Value is of a type I don't know how to handle", http.StatusInternalServerError)
+		return fmt.Errorf("Value is of a type I don't know how to handle")
 	}
+	return nil
 }
 
-func respondJSON(w http.ResponseWriter, req *http.Request, val interface{}) {
+func writeJSON(w io.Writer, val interface{}) error {
 	bytes, err := json.Marshal(val)
-	if err == nil {
-		w.Write(bytes)
-	} else {
-		respondError(w, req, "Error serializing to JSON: "+err.Error(), http.StatusInternalServerError)
+	if err != nil {
+		return fmt.Errorf("Error serializing to JSON: %v", err)
 	}
+	_, err = w.Write(bytes)
+	return err
 }
 
-func respondYAML(w http.ResponseWriter, req *http.Request, val interface{}) {
+func writeYAML(w io.Writer, val interface{}) error {
 	bytes, err := yaml.Marshal(val)
-	if err == nil {
-		w.Write(bytes)
-	} else {
-		respondError(w, req, "Error serializing to YAML: "+err.Error(), http.StatusInternalServerError)
+	if err != nil {
+		return fmt.Errorf("Error serializing to YAML: %v", err)
 	}
+	_, err = w.Write(bytes)
+	return err
 }
 
 func (sc *ServerConfig) requestIp(req *http.Request) string {
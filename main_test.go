@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rancher/rancher-metadata/config"
+	"github.com/rancher/rancher-metadata/pkg/metrics"
+	"github.com/rancher/rancher-metadata/server"
+)
+
+// staticSource is a local source serving fixed answers
+type staticSource struct {
+	update server.SourceUpdateFunc
+	server.SourceUpdate
+}
+
+func (s *staticSource) Load() error {
+	s.update(s.SourceUpdate)
+	return nil
+}
+
+func (s *staticSource) Start(ctx context.Context) error {
+	return nil
+}
+
+func (s *staticSource) Stop() {
+}
+
+func (s *staticSource) Status() server.SourceStatus {
+	return server.SourceStatus{Type: "static", Local: true}
+}
+
+func testObjects() []map[string]interface{} {
+	return []map[string]interface{}{
+		{"metadata_kind": "defaultData", "version": "1"},
+		{"metadata_kind": "stack", "uuid": "stack-1", "name": "Stack"},
+		{"metadata_kind": "service", "uuid": "service-1", "name": "Web", "stack_uuid": "stack-1",
+			"stack_name": "Stack", "primary_service_name": "Web"},
+		{"metadata_kind": "host", "uuid": "host-1", "name": "host1", "hostId": 1},
+		{"metadata_kind": "container", "uuid": "container-1", "name": "Stack-Web-1", "primary_ip": "10.42.0.1",
+			"host_uuid": "host-1", "stack_uuid": "stack-1", "service_uuid": "service-1", "service_name": "Web"},
+		{"metadata_kind": "serviceContainerLink", "service_uuid": "service-1", "service_name": "Web", "container_uuid": "container-1"},
+	}
+}
+
+// newTestServer routes the client requests to the answers generated from
+// objects, until stop is called
+func newTestServer(t *testing.T, objects []map[string]interface{}) (sc *ServerConfig, stop func()) {
+	dir, err := ioutil.TempDir("", "rancher-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, lookups, _, err := config.NewGenerator(true, "", false, 0).GenerateAnswers(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, stopServer := newControllerServer(t, server.ControllerOptions{
+		Answers: filepath.Join(dir, "answers.json"),
+		NewLocal: func(update server.SourceUpdateFunc) server.Source {
+			return &staticSource{update: update, SourceUpdate: server.SourceUpdate{Versions: versions, Lookups: lookups}}
+		},
+	})
+	return sc, func() {
+		stopServer()
+		os.RemoveAll(dir)
+	}
+}
+
+// newControllerServer routes the client requests to a started controller,
+// until stop is called
+func newControllerServer(t *testing.T, opts server.ControllerOptions) (sc *ServerConfig, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mc := server.NewMetadataController(opts)
+	if err := mc.Start(ctx); err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+
+	sc = &ServerConfig{
+		metadataController: mc,
+		router:             mux.NewRouter(),
+		versionAliases:     map[string]string{},
+		ctx:                ctx,
+		cancel:             cancel,
+	}
+	sc.routeHttp()
+	return sc, func() {
+		cancel()
+		mc.Stop()
+	}
+}
+
+func get(sc *ServerConfig, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	sc.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestLookupHandler(t *testing.T) {
+	sc, stop := newTestServer(t, testObjects())
+	defer stop()
+
+	tests := []struct {
+		path string
+		code int
+		kind string
+		uuid string
+	}{
+		{"/latest/_lookup/ip/10.42.0.1", http.StatusOK, "container", "container-1"},
+		{"/2016-07-29/_lookup/uuid/host-1", http.StatusOK, "host", "host-1"},
+		{"/latest/_lookup/name/stack", http.StatusOK, "stack", "stack-1"},
+		{"/latest/_lookup/name/Stack/Web", http.StatusOK, "service", "service-1"},
+		{"/latest/_lookup/name/Stack/Web/Stack-Web-1", http.StatusOK, "container", "container-1"},
+		{"/latest/_lookup/ip/10.42.9.9", http.StatusNotFound, "", ""},
+		{"/latest/_lookup/uuid/host-1/extra", http.StatusNotFound, "", ""},
+		{"/1999-01-01/_lookup/ip/10.42.0.1", http.StatusNotFound, "", ""},
+	}
+	for _, test := range tests {
+		w := get(sc, test.path)
+		if w.Code != test.code {
+			t.Errorf("%s: expected status %d, got %d: %s", test.path, test.code, w.Code, w.Body)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		if len(body) != 2 {
+			t.Errorf("%s: expected only a kind and an object, got %v", test.path, body)
+		}
+		object, _ := body["object"].(map[string]interface{})
+		if body["kind"] != test.kind || object["uuid"] != test.uuid {
+			t.Errorf("%s: expected %s %s, got %v", test.path, test.kind, test.uuid, body)
+		}
+	}
+}
+
+func TestParseVersionAliases(t *testing.T) {
+	aliases, err := parseVersionAliases([]string{"stable=2015-12-19", "newest=latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"stable": "2015-12-19", "newest": "latest"}
+	if !reflect.DeepEqual(aliases, want) {
+		t.Errorf("expected %v, got %v", want, aliases)
+	}
+
+	for _, value := range []string{"stable", "=2015-12-19", "stable="} {
+		if _, err := parseVersionAliases([]string{value}); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestVersionHeaders(t *testing.T) {
+	deprecated, err := parseDeprecatedVersions([]string{"2015-07-25=2017-06-30", "2015-12-19"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseDeprecatedVersions([]string{"2015-07-25=30/06/2017"}); err == nil {
+		t.Error("accepted a sunset date that isn't a version date")
+	}
+
+	sc := &ServerConfig{deprecatedVersions: deprecated}
+	tests := []struct {
+		version     string
+		deprecation string
+		sunset      string
+	}{
+		{"2015-07-25", "true", "Fri, 30 Jun 2017 00:00:00 GMT"},
+		{"2015-12-19", "true", ""},
+		{"2016-07-29", "", ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		sc.setVersionHeaders(w, test.version)
+		if got := w.Header().Get("Deprecation"); got != test.deprecation {
+			t.Errorf("%s: expected Deprecation %q, got %q", test.version, test.deprecation, got)
+		}
+		if got := w.Header().Get("Sunset"); got != test.sunset {
+			t.Errorf("%s: expected Sunset %q, got %q", test.version, test.sunset, got)
+		}
+	}
+}
+
+// sample returns the value of a series of the default registry, 0 if it
+// wasn't written yet
+func sample(t *testing.T, series string) float64 {
+	var buf strings.Builder
+	if _, err := metrics.Default.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			v, err := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestInstrument(t *testing.T) {
+	sc, stop := newTestServer(t, testObjects())
+	defer stop()
+
+	version := config.LATEST_KEY
+	series := []string{
+		`rancher_metadata_default_answers_total{version="` + version + `"}`,
+		`rancher_metadata_http_requests_total{route="Metadata",version="` + version + `",code="200"}`,
+		`rancher_metadata_http_requests_total{route="Lookup",version="` + version + `",code="200"}`,
+		`rancher_metadata_http_requests_total{route="Metadata",version="invalid",code="404"}`,
+	}
+	before := make([]float64, len(series))
+	for i, s := range series {
+		before[i] = sample(t, s)
+	}
+
+	for _, path := range []string{"/latest/stacks", "/latest/_lookup/uuid/host-1", "/1999-01-01/stacks"} {
+		get(sc, path)
+	}
+	for i, s := range series {
+		if got := sample(t, s) - before[i]; got != 1 {
+			t.Errorf("%s increased by %v, expected 1", s, got)
+		}
+	}
+}
+
+func TestAddSourceRequiresSubscribing(t *testing.T) {
+	sc, stop := newTestServer(t, testObjects())
+	defer stop()
+
+	err := sc.metadataController.AddSource(server.ExternalSource{URL: "http://rancher.example.com/v2-beta", AccessKey: "ak", SecretKey: "sk"})
+	if err == nil {
+		t.Fatal("added a source that nothing downloads")
+	}
+	if sources := sc.metadataController.Status().Sources; len(sources) != 1 {
+		t.Errorf("expected only the local source, got %v", sources)
+	}
+}
+
+// status answers GET /v1/status
+func status(t *testing.T, sc *ServerConfig) server.Status {
+	req := httptest.NewRequest("GET", "/v1/status", nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	sc.status(w, req)
+	var s server.Status
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	return s
+}
+
+// waitForStatus waits for the status of the local source to satisfy ok
+func waitForStatus(t *testing.T, sc *ServerConfig, ok func(server.SourceStatus) bool) server.Status {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s := status(t, sc)
+		if ok(s.Sources[0]) {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected status %+v", s.Sources[0])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rancher-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	objectCounts := map[string]int{"defaultData": 1, "stack": 1, "service": 1, "host": 1, "container": 1, "serviceContainerLink": 1}
+
+	t.Run("rancher", func(t *testing.T) {
+		answers := filepath.Join(dir, "rancher")
+		objects := append(testObjects(), map[string]interface{}{"metadata_kind": "credential",
+			"url": "http://other.example.com/v2-beta", "public_value": "OTHERKEY", "secret_value": "secret"})
+		saveAnswersFile(t, answers, objects)
+		os.Setenv("CATTLE_ACCESS_KEY", "LOCALKEY")
+		defer os.Unsetenv("CATTLE_ACCESS_KEY")
+		sc, stop := newControllerServer(t, server.ControllerOptions{Answers: answers})
+		defer stop()
+
+		s := status(t, sc)
+		if s.Version == "" || len(s.Sources) != 2 {
+			t.Fatalf("expected an id and two sources, got %+v", s)
+		}
+		local, external := s.Sources[0], s.Sources[1]
+		if local.Type != server.SOURCE_RANCHER || !local.Local || local.AccessKey != "LOCA****" || local.AppliedVersion != "1" ||
+			local.Subscribed || local.LastDownload != nil {
+			t.Errorf("unexpected local status %+v", local)
+		}
+		counts := map[string]int{"credential": 1}
+		for kind, count := range objectCounts {
+			counts[kind] = count
+		}
+		if !reflect.DeepEqual(local.Objects, counts) {
+			t.Errorf("expected objects %v, got %v", counts, local.Objects)
+		}
+		if external.Type != server.SOURCE_RANCHER || external.Local || external.AccessKey != "OTHE****" ||
+			external.URL != "http://other.example.com/v2-beta" || external.Added {
+			t.Errorf("unexpected external status %+v", external)
+		}
+		if strings.Contains(get(sc, "/v1/status").Body.String(), "secret") {
+			t.Error("the status has the secret key")
+		}
+	})
+
+	t.Run("poll", func(t *testing.T) {
+		delta := compressObjects(t, testObjects())
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(delta)
+		}))
+		defer ts.Close()
+		sc, stop := newControllerServer(t, server.ControllerOptions{
+			Answers: filepath.Join(dir, "poll"),
+			NewLocal: func(update server.SourceUpdateFunc) server.Source {
+				return server.NewPollSource(ts.URL, server.POLL_FORMAT_DELTA, time.Hour, filepath.Join(dir, "poll"), false, update)
+			},
+		})
+		defer stop()
+
+		s := waitForStatus(t, sc, func(s server.SourceStatus) bool { return s.LastDownload != nil })
+		local := s.Sources[0]
+		if local.Type != server.SOURCE_HTTP || local.URL != ts.URL || local.AppliedVersion != "1" || !local.Subscribed ||
+			local.LastError != "" || local.LastErrorTime != nil {
+			t.Errorf("unexpected status %+v", local)
+		}
+		if !reflect.DeepEqual(local.Objects, objectCounts) {
+			t.Errorf("expected objects %v, got %v", objectCounts, local.Objects)
+		}
+	})
+
+	t.Run("poll error", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		defer ts.Close()
+		sc, stop := newControllerServer(t, server.ControllerOptions{
+			Answers: filepath.Join(dir, "poll-error"),
+			NewLocal: func(update server.SourceUpdateFunc) server.Source {
+				return server.NewPollSource(ts.URL, server.POLL_FORMAT_DELTA, time.Hour, filepath.Join(dir, "poll-error"), false, update)
+			},
+		})
+		defer stop()
+
+		s := waitForStatus(t, sc, func(s server.SourceStatus) bool { return s.LastErrorTime != nil })
+		if local := s.Sources[0]; !strings.Contains(local.LastError, "500") || local.LastDownload != nil || local.AppliedVersion != "" {
+			t.Errorf("unexpected status %+v", local)
+		}
+	})
+
+	t.Run("upstream", func(t *testing.T) {
+		versions, _, _, err := config.NewGenerator(true, "", false, 0).GenerateAnswers(testObjects())
+		if err != nil {
+			t.Fatal(err)
+		}
+		mirror, err := json.Marshal(config.Mirror{Version: "m1", Versions: versions})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Query().Get("version") == "m1" {
+				time.Sleep(10 * time.Millisecond)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Write(mirror)
+		}))
+		defer ts.Close()
+		sc, stop := newControllerServer(t, server.ControllerOptions{
+			Answers: filepath.Join(dir, "upstream"),
+			NewLocal: func(update server.SourceUpdateFunc) server.Source {
+				return server.NewUpstream(ts.URL, "", filepath.Join(dir, "upstream"), update)
+			},
+		})
+		defer stop()
+
+		s := waitForStatus(t, sc, func(s server.SourceStatus) bool { return s.AppliedVersion == "m1" })
+		if local := s.Sources[0]; local.Type != server.SOURCE_UPSTREAM || local.URL != ts.URL || !local.Subscribed ||
+			local.LastError != "" {
+			t.Errorf("unexpected status %+v", local)
+		}
+	})
+}
+
+// stuckSource is a local source that doesn't stop until released
+type stuckSource struct {
+	staticSource
+	release chan struct{}
+}
+
+func (s *stuckSource) Stop() {
+	<-s.release
+}
+
+func TestShutdownGivesUpAfterTheTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rancher-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	release := make(chan struct{})
+	sc, stop := newControllerServer(t, server.ControllerOptions{
+		Answers: filepath.Join(dir, "answers"),
+		NewLocal: func(update server.SourceUpdateFunc) server.Source {
+			return &stuckSource{staticSource: staticSource{update: update}, release: release}
+		},
+	})
+	defer stop()
+	defer close(release)
+
+	// a request that doesn't end until its connection is closed
+	requested, handled := make(chan struct{}), make(chan struct{})
+	sc.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		close(requested)
+		<-req.Context().Done()
+		close(handled)
+	})}
+	sc.reloadServer, sc.mirrorServer, sc.debugServer = &http.Server{}, &http.Server{}, &http.Server{}
+	sc.shutdownTimeout = 100 * time.Millisecond
+	sc.stopped = make(chan struct{})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- sc.server.Serve(l)
+	}()
+	go http.Get("http://" + l.Addr().String())
+	<-requested
+
+	go sc.shutdown()
+	for what, done := range map[string]chan struct{}{"shut down": sc.stopped, "closed the connection": handled} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("not %s after the timeout", what)
+		}
+	}
+	select {
+	case err := <-served:
+		if err != http.ErrServerClosed {
+			t.Errorf("expected the server to be closed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("still serving after the timeout")
+	}
+}
+
+func TestMirrorHandler(t *testing.T) {
+	objects := testObjects()
+	objects[2]["token"] = "secret"
+	sc, stop := newTestServer(t, objects)
+	defer stop()
+	sc.mirrorToken = "mirror"
+	handler := sc.authorizeMirror(sc.answers)
+	mirror := func(query, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/v1/answers"+query, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	for _, authorization := range []string{"", "Bearer wrong", "mirror", "Bearer mirror "} {
+		if w := mirror("", authorization); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("expected 401 with the Authorization [%s], got %d", authorization, w.Code)
+		}
+	}
+
+	w := mirror("", "Bearer mirror")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var m config.Mirror
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Version == "" {
+		t.Error("the mirror has no version")
+	}
+	// the answers of each client keep the token of its service
+	token, _ := m.Versions.Matching(config.METADATA_VERSION3, "10.42.0.1", []string{"self", "service", "token"})
+	if token != "secret" {
+		t.Errorf("expected the token of the service, got %v", token)
+	}
+
+	if w := mirror("?wait=true&maxWait=1&version="+m.Version, "Bearer mirror"); w.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for an unchanged version, got %d", w.Code)
+	}
+
+	// without a token of its own, the mirror serves nobody
+	sc.mirrorToken = ""
+	if w := mirror("", "Bearer "); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a mirror token, got %d", w.Code)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rancher/rancher-metadata/pkg/metrics"
+	"github.com/rancher/rancher-metadata/server"
+)
+
+// How long a client counts as using a version after its last request
+const VERSION_CLIENTS_WINDOW = time.Hour
+
+var (
+	httpRequests = metrics.NewCounter("rancher_metadata_http_requests_total",
+		"Requests answered, by route, version and status code.", "route", "version", "code")
+	httpDuration = metrics.NewHistogram("rancher_metadata_http_request_duration_seconds",
+		"Time taken to answer requests, including long-polls, by route, version and status code.", nil, "route", "version", "code")
+	defaultFallbacks = metrics.NewCounter("rancher_metadata_default_answers_total",
+		"Requests answered from the default answers because there were none for the client, by version.", "version")
+	versionClients = &clientsByVersion{clients: make(map[string]map[string]time.Time)}
+)
+
+// clientsByVersion remembers when each client last asked for each version
+type clientsByVersion struct {
+	sync.Mutex
+	clients map[string]map[string]time.Time
+}
+
+func (c *clientsByVersion) seen(version, ip string, t time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if c.clients[version] == nil {
+		c.clients[version] = make(map[string]time.Time)
+	}
+	c.clients[version][ip] = t
+}
+
+// collect counts the clients seen within the window, forgetting the others
+func (c *clientsByVersion) collect(set func(v float64, labelValues ...string)) {
+	c.Lock()
+	defer c.Unlock()
+	since := time.Now().Add(-VERSION_CLIENTS_WINDOW)
+	for version, clients := range c.clients {
+		for ip, t := range clients {
+			if t.Before(since) {
+				delete(clients, ip)
+			}
+		}
+		if len(clients) == 0 {
+			delete(c.clients, version)
+			continue
+		}
+		set(float64(len(clients)), version)
+	}
+}
+
+func registerMetrics(mc *server.MetadataController) {
+	metrics.NewGaugeFunc("rancher_metadata_version_clients",
+		"Clients that asked for each version within the last hour.", []string{"version"}, versionClients.collect)
+	metrics.NewGaugeFunc("rancher_metadata_objects",
+		"Metadata objects the answers were last generated from, by source, its masked access key and kind.",
+		[]string{"source", "access_key", "kind"},
+		func(set func(v float64, labelValues ...string)) {
+			for _, source := range mc.Status().Sources {
+				for kind, count := range source.Objects {
+					set(float64(count), server.SourceLabel(source.Local), source.AccessKey, kind)
+				}
+			}
+		})
+}
+
+// statusRecorder keeps the status code of a response, and the version the
+// handler resolved the request to
+type statusRecorder struct {
+	http.ResponseWriter
+	code    int
+	version string
+}
+
+// recordVersion tells instrument the version a request resolved to
+func recordVersion(w http.ResponseWriter, version string) {
+	if r, ok := w.(*statusRecorder); ok {
+		r.version = version
+	}
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// instrument counts and times the requests to a route by the version they
+// resolve to
+func (sc *ServerConfig) instrument(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h(recorder, req)
+
+		route := ""
+		if r := mux.CurrentRoute(req); r != nil {
+			route = r.GetName()
+		}
+		version := recorder.version
+		if version != "" {
+			versionClients.seen(version, sc.requestIp(req), start)
+		} else if _, ok := mux.Vars(req)["version"]; ok {
+			version = "invalid"
+		}
+		code := strconv.Itoa(recorder.code)
+		httpRequests.Inc(route, version, code)
+		httpDuration.ObserveSince(start, route, version, code)
+	}
+}
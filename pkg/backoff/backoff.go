@@ -0,0 +1,68 @@
+package backoff
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// seeded apart for each process, so that hosts that failed together don't
+// retry together
+var (
+	random     = rand.New(rand.NewSource(time.Now().UnixNano()))
+	randomLock sync.Mutex
+)
+
+// Backoff computes the delays before retrying an operation that keeps
+// failing: doubling from min with each failure up to max, of which a random
+// part up to half is taken off.
+type Backoff struct {
+	min time.Duration
+	max time.Duration
+	sync.Mutex
+	failures int
+	retryAt  time.Time
+}
+
+func New(min, max time.Duration) *Backoff {
+	return &Backoff{
+		min: min,
+		max: max,
+	}
+}
+
+// Failure records a failure and returns how long to wait before retrying
+func (b *Backoff) Failure() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	delay := b.min
+	for i := 0; i < b.failures && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	b.failures++
+
+	randomLock.Lock()
+	delay -= time.Duration(random.Int63n(int64(delay/2) + 1))
+	randomLock.Unlock()
+	b.retryAt = time.Now().Add(delay)
+	return delay
+}
+
+// Success starts the delays over from min
+func (b *Backoff) Success() {
+	b.Lock()
+	defer b.Unlock()
+	b.failures = 0
+	b.retryAt = time.Time{}
+}
+
+// State returns the failures since the last success, and when the retry
+// after the last one is due, zero if there were none
+func (b *Backoff) State() (int, time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	return b.failures, b.retryAt
+}
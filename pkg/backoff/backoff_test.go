@@ -0,0 +1,28 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := New(time.Second, 10*time.Second)
+	for i, max := range []time.Duration{1, 2, 4, 8, 10, 10} {
+		max *= time.Second
+		delay := b.Failure()
+		if delay < max/2 || delay > max {
+			t.Fatalf("failure %d: expected a delay between %v and %v, got %v", i+1, max/2, max, delay)
+		}
+	}
+	if failures, retryAt := b.State(); failures != 6 || retryAt.IsZero() {
+		t.Fatalf("expected 6 failures and a retry time, got %d and %v", failures, retryAt)
+	}
+
+	b.Success()
+	if failures, retryAt := b.State(); failures != 0 || !retryAt.IsZero() {
+		t.Fatalf("expected no failures after a success, got %d and %v", failures, retryAt)
+	}
+	if delay := b.Failure(); delay > time.Second {
+		t.Fatalf("expected the delays to start over, got %v", delay)
+	}
+}
@@ -0,0 +1,113 @@
+package filewatch
+
+import (
+	"context"
+	"io/ioutil"
+	"time"
+
+	"github.com/rancher/log"
+)
+
+// How often files are checked when they can't be watched with inotify
+const POLL_INTERVAL = time.Second
+
+// MatchFunc tells whether a file of the watched directory is watched, by name
+type MatchFunc func(name string) bool
+
+// Watch calls changed once the watched files of dir were written and no other
+// write followed for debounce, until ctx is done.  Only complete files count:
+// those closed after writing or renamed into dir with inotify, and those
+// unchanged since the previous check when polling.
+func Watch(ctx context.Context, dir string, match MatchFunc, debounce time.Duration, changed func()) {
+	events, err := watchEvents(ctx, dir, match)
+	if err != nil {
+		log.Infof("Watching [%s] by polling every %v: %v", dir, POLL_INTERVAL, err)
+		events = pollEvents(ctx, dir, match, POLL_INTERVAL)
+	}
+	go debounced(ctx, events, debounce, changed)
+}
+
+func debounced(ctx context.Context, events <-chan struct{}, debounce time.Duration, changed func()) {
+	var fire <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			fire = time.After(debounce)
+		case <-fire:
+			fire = nil
+			changed()
+		}
+	}
+}
+
+// notify sends an event unless one is pending already
+func notify(events chan<- struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+func scan(dir string, match MatchFunc) map[string]fileState {
+	states := make(map[string]fileState)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return states
+	}
+	for _, f := range files {
+		if !f.IsDir() && match(f.Name()) {
+			states[f.Name()] = fileState{size: f.Size(), modTime: f.ModTime()}
+		}
+	}
+	return states
+}
+
+// pollEvents checks the files every interval.  A file that changed is only
+// reported once it was left unchanged for an interval, so that it is never
+// read half-written.  Removed files aren't reported.
+func pollEvents(ctx context.Context, dir string, match MatchFunc, interval time.Duration) <-chan struct{} {
+	events := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		reported := scan(dir, match)
+		previous := reported
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current := scan(dir, match)
+			if !changedFiles(reported, current) {
+				reported = current
+			} else if !changedFiles(previous, current) && len(previous) == len(current) {
+				reported = current
+				notify(events)
+			}
+			previous = current
+		}
+	}()
+	return events
+}
+
+// changedFiles tells whether a file of to was added or changed since from
+func changedFiles(from, to map[string]fileState) bool {
+	for name, state := range to {
+		if before, ok := from[name]; !ok || before.size != state.size || !before.modTime.Equal(state.modTime) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package filewatch
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func isAnswers(name string) bool {
+	return name == "answers"
+}
+
+func writeByRename(t *testing.T, dir, name, content string) {
+	tmp := filepath.Join(dir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectEvent(t *testing.T, events <-chan struct{}, timeout time.Duration) {
+	select {
+	case <-events:
+	case <-time.After(timeout):
+		t.Fatal("no change reported")
+	}
+}
+
+func expectNoEvent(t *testing.T, events <-chan struct{}, timeout time.Duration) {
+	select {
+	case <-events:
+		t.Fatal("unexpected change reported")
+	case <-time.After(timeout):
+	}
+}
+
+func TestPollEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interval := 20 * time.Millisecond
+	events := pollEvents(ctx, dir, isAnswers, interval)
+	writeByRename(t, dir, "other", "{}")
+	expectNoEvent(t, events, 5*interval)
+
+	writeByRename(t, dir, "answers", "{}")
+	expectEvent(t, events, 10*interval)
+	expectNoEvent(t, events, 5*interval)
+
+	os.Remove(filepath.Join(dir, "answers"))
+	expectNoEvent(t, events, 5*interval)
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := make(chan struct{}, 10)
+	Watch(ctx, dir, isAnswers, 50*time.Millisecond, func() {
+		changed <- struct{}{}
+	})
+	for i := 0; i < 3; i++ {
+		writeByRename(t, dir, "answers", "{}")
+	}
+	expectEvent(t, changed, 5*time.Second)
+	// the writes were debounced into one change
+	expectNoEvent(t, changed, 200*time.Millisecond)
+}
@@ -0,0 +1,59 @@
+//go:build linux
+// +build linux
+
+package filewatch
+
+import (
+	"context"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/rancher/log"
+)
+
+// watchEvents reports the watched files closed after writing or renamed into
+// dir, and any overflow of the inotify queue
+func watchEvents(ctx context.Context, dir string, match MatchFunc) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	// a non-blocking file is read through the runtime poller, so that closing
+	// it ends a pending read
+	f := os.NewFile(uintptr(fd), "inotify")
+
+	events := make(chan struct{}, 1)
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+	go func() {
+		defer close(events)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Errorf("Stopped watching [%s]: %v", dir, err)
+				}
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameStart := offset + syscall.SizeofInotifyEvent
+				name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+				if event.Mask&syscall.IN_Q_OVERFLOW != 0 || match(name) {
+					notify(events)
+				}
+				offset = nameStart + int(event.Len)
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package filewatch
+
+import (
+	"context"
+	"fmt"
+)
+
+func watchEvents(ctx context.Context, dir string, match MatchFunc) (<-chan struct{}, error) {
+	return nil, fmt.Errorf("inotify is only available on Linux")
+}
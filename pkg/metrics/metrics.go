@@ -0,0 +1,364 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	COUNTER   = "counter"
+	GAUGE     = "gauge"
+	HISTOGRAM = "histogram"
+
+	// ContentType is the Prometheus text exposition format
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// DefaultBuckets are the upper bounds of histograms, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry keeps metrics by name
+type Registry struct {
+	sync.RWMutex
+	families map[string]family
+}
+
+type family interface {
+	describe() *desc
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]family),
+	}
+}
+
+// Default is the registry the New functions register in
+var Default = NewRegistry()
+
+func (r *Registry) register(f family) {
+	r.Lock()
+	defer r.Unlock()
+	name := f.describe().name
+	if _, ok := r.families[name]; ok {
+		panic(fmt.Sprintf("metric [%s] registered twice", name))
+	}
+	r.families[name] = f
+}
+
+// WriteTo writes every metric in the text exposition format, sorted by name
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.RLock()
+	families := make([]family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.RUnlock()
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].describe().name < families[j].describe().name
+	})
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		d := f.describe()
+		fmt.Fprintf(bw, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", d.name, d.kind)
+		f.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the metrics for scraping
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+// series is the value of a metric for a set of label values
+type series struct {
+	labelValues []string
+	value       float64
+	// histograms only
+	counts []uint64
+	count  uint64
+}
+
+type vec struct {
+	desc
+	sync.Mutex
+	series map[string]*series
+}
+
+func newVec(name, help, kind string, labels []string) vec {
+	return vec{
+		desc:   desc{name: name, help: help, kind: kind, labels: labels},
+		series: make(map[string]*series),
+	}
+}
+
+func (v *vec) describe() *desc {
+	return &v.desc
+}
+
+// get returns the series of labelValues, with the lock held
+func (v *vec) get(labelValues []string) *series {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric [%s] takes labels %v, got values %v", v.name, v.labels, labelValues))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+// sorted returns the series sorted by label values, with the lock held
+func (v *vec) sorted() []*series {
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	out := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		out = append(out, v.series[key])
+	}
+	return out
+}
+
+func (v *vec) writeValues(w *bufio.Writer) {
+	v.Lock()
+	defer v.Unlock()
+	for _, s := range v.sorted() {
+		writeSample(w, v.name, v.labels, s.labelValues, "", "", s.value)
+	}
+}
+
+// Counter counts events, by label values
+type Counter struct {
+	vec
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec(name, help, COUNTER, labels)}
+	Default.register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter [%s] can't decrease", c.name))
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.get(labelValues).value += v
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeValues(w)
+}
+
+// Gauge is a value that goes up and down, by label values
+type Gauge struct {
+	vec
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(name, help, GAUGE, labels)}
+	Default.register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.Lock()
+	defer g.Unlock()
+	g.get(labelValues).value = v
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.Lock()
+	defer g.Unlock()
+	g.get(labelValues).value += v
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.writeValues(w)
+}
+
+// CollectFunc reports the values of a GaugeFunc by calling set once for each
+// set of label values
+type CollectFunc func(set func(v float64, labelValues ...string))
+
+// GaugeFunc is a gauge whose values are collected when it is written
+type GaugeFunc struct {
+	d       desc
+	collect CollectFunc
+}
+
+func NewGaugeFunc(name, help string, labels []string, collect CollectFunc) *GaugeFunc {
+	g := &GaugeFunc{
+		d:       desc{name: name, help: help, kind: GAUGE, labels: labels},
+		collect: collect,
+	}
+	Default.register(g)
+	return g
+}
+
+func (g *GaugeFunc) describe() *desc {
+	return &g.d
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	v := newVec(g.d.name, g.d.help, g.d.kind, g.d.labels)
+	g.collect(func(value float64, labelValues ...string) {
+		v.get(labelValues).value += value
+	})
+	v.writeValues(w)
+}
+
+// Histogram counts observations in buckets, by label values
+type Histogram struct {
+	vec
+	buckets []float64
+}
+
+// NewHistogram makes a histogram with the given bucket upper bounds, or
+// DefaultBuckets if nil
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{newVec(name, help, HISTOGRAM, labels), buckets}
+	Default.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.Lock()
+	defer h.Unlock()
+	s := h.get(labelValues)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.buckets))
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.value += v
+}
+
+// ObserveSince observes the seconds elapsed since start
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.Lock()
+	defer h.Unlock()
+	for _, s := range h.sorted() {
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			if s.counts != nil {
+				cumulative += s.counts[i]
+			}
+			writeSample(w, h.name+"_bucket", h.labels, s.labelValues, "le", formatFloat(bound), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, s.labelValues, "le", "+Inf", float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labelValues, "", "", s.value)
+		writeSample(w, h.name+"_count", h.labels, s.labelValues, "", "", float64(s.count))
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, extraLabel, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", label, escapeLabelValue(labelValues[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	requests := &Counter{newVec("requests_total", "Requests.", COUNTER, []string{"path"})}
+	r.register(requests)
+	waiters := &Gauge{newVec("waiters", "Waiting\nclients.", GAUGE, nil)}
+	r.register(waiters)
+	latency := &Histogram{newVec("latency_seconds", "Latency.", HISTOGRAM, []string{"path"}), []float64{0.1, 1}}
+	r.register(latency)
+	r.register(&GaugeFunc{
+		d: desc{name: "objects", help: "Objects.", kind: GAUGE, labels: []string{"kind"}},
+		collect: func(set func(v float64, labelValues ...string)) {
+			set(2, "host")
+			set(1, "host")
+		},
+	})
+
+	requests.Inc(`/a"b`)
+	requests.Add(2, "/")
+	waiters.Inc()
+	waiters.Inc()
+	waiters.Dec()
+	latency.Observe(0.05, "/")
+	latency.Observe(0.1, "/")
+	latency.Observe(3, "/")
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{path="/",le="0.1"} 2
+latency_seconds_bucket{path="/",le="1"} 2
+latency_seconds_bucket{path="/",le="+Inf"} 3
+latency_seconds_sum{path="/"} 3.15
+latency_seconds_count{path="/"} 3
+# HELP objects Objects.
+# TYPE objects gauge
+objects{kind="host"} 3
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{path="/"} 2
+requests_total{path="/a\"b"} 1
+# HELP waiters Waiting\nclients.
+# TYPE waiters gauge
+waiters 1
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteToWhileRegistering(t *testing.T) {
+	r := NewRegistry()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			r.register(&Gauge{newVec(fmt.Sprintf("gauge_%d", i), "Gauge.", GAUGE, nil)})
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if _, err := r.WriteTo(ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package selector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type Operator string
+
+const (
+	Equals       Operator = "="
+	NotEquals    Operator = "!="
+	In           Operator = "in"
+	NotIn        Operator = "notin"
+	Exists       Operator = "exists"
+	DoesNotExist Operator = "!"
+)
+
+// Requirement is a single comma separated term of a selector
+type Requirement struct {
+	Key      string
+	Operator Operator
+	Values   []string
+}
+
+// Selector matches a set of key/value pairs when all of its requirements do.
+// An empty selector matches everything.
+type Selector []Requirement
+
+// setTerm matches "key in (values)" and "key notin (values)"
+var setTerm = regexp.MustCompile(`^([^\s()!=,]+)\s+(?i:(in|notin))\s*\((.*)\)$`)
+
+// Getter returns the value of key and whether it is set
+type Getter func(key string) (string, bool)
+
+// ParseLabels parses a Kubernetes style label selector, for example
+// "a=b,c!=d,e in (x,y),f notin (z),g,!h".
+func ParseLabels(s string) (Selector, error) {
+	return parse(s, true)
+}
+
+// ParseFields parses a field selector, which only supports equality, for
+// example "state=running,host_uuid!=abc".
+func ParseFields(s string) (Selector, error) {
+	return parse(s, false)
+}
+
+func parse(s string, sets bool) (Selector, error) {
+	var sel Selector
+	for _, term := range splitTerms(s) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		r, err := parseTerm(term, sets)
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+// splitTerms splits on commas that aren't inside a parenthesized value set
+func splitTerms(s string) []string {
+	var terms []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				terms = append(terms, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, s[start:])
+}
+
+func parseTerm(term string, sets bool) (Requirement, error) {
+	// before the equalities, since the values of a set may contain "="
+	if m := setTerm.FindStringSubmatch(term); sets && m != nil {
+		var values []string
+		for _, v := range strings.Split(m[3], ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
+			return Requirement{}, fmt.Errorf("Invalid label selector %q: no values in parentheses", term)
+		}
+		return Requirement{Key: m[1], Operator: Operator(strings.ToLower(m[2])), Values: values}, nil
+	}
+
+	if i := strings.Index(term, "!="); i >= 0 {
+		return newRequirement(term, term[:i], NotEquals, term[i+2:])
+	}
+	if i := strings.Index(term, "=="); i >= 0 {
+		return newRequirement(term, term[:i], Equals, term[i+2:])
+	}
+	if i := strings.Index(term, "="); i >= 0 {
+		return newRequirement(term, term[:i], Equals, term[i+1:])
+	}
+	if !sets {
+		return Requirement{}, fmt.Errorf("Invalid field selector %q: expected key=value or key!=value", term)
+	}
+
+	if strings.HasPrefix(term, "!") {
+		return newRequirement(term, term[1:], DoesNotExist)
+	}
+	if fields := strings.Fields(term); len(fields) >= 2 {
+		op := Operator(strings.ToLower(strings.SplitN(fields[1], "(", 2)[0]))
+		if op == In || op == NotIn {
+			return Requirement{}, fmt.Errorf("Invalid label selector %q: values must be in parentheses", term)
+		}
+		return Requirement{}, fmt.Errorf("Invalid label selector %q: unknown operator %q", term, fields[1])
+	}
+
+	return newRequirement(term, term, Exists)
+}
+
+func newRequirement(term, key string, op Operator, values ...string) (Requirement, error) {
+	key = strings.TrimSpace(key)
+	if key == "" || strings.ContainsAny(key, " \t()!=") {
+		return Requirement{}, fmt.Errorf("Invalid selector %q: bad key %q", term, key)
+	}
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return Requirement{Key: key, Operator: op, Values: values}, nil
+}
+
+func (r Requirement) Matches(get Getter) bool {
+	value, ok := get(r.Key)
+	switch r.Operator {
+	case Exists:
+		return ok
+	case DoesNotExist:
+		return !ok
+	case Equals:
+		return ok && value == r.Values[0]
+	case NotEquals:
+		return !ok || value != r.Values[0]
+	case In:
+		return ok && contains(r.Values, value)
+	case NotIn:
+		return !ok || !contains(r.Values, value)
+	}
+	return false
+}
+
+func (s Selector) Matches(get Getter) bool {
+	for _, r := range s {
+		if !r.Matches(get) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s Selector) Empty() bool {
+	return len(s) == 0
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns the maps in values whose "labels" match labels and whose
+// top-level fields match fields.  Values that aren't maps never match a
+// non-empty selector.
+func Filter(values []interface{}, labels, fields Selector) []interface{} {
+	if labels.Empty() && fields.Empty() {
+		return values
+	}
+
+	out := []interface{}{}
+	for _, v := range values {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		objLabels, _ := obj["labels"].(map[string]interface{})
+		if labels.Matches(getter(objLabels)) && fields.Matches(getter(obj)) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func getter(m map[string]interface{}) Getter {
+	return func(key string) (string, bool) {
+		v, ok := m[key]
+		if !ok || v == nil {
+			return "", false
+		}
+		if s, ok := v.(string); ok {
+			return s, true
+		}
+		return fmt.Sprint(v), true
+	}
+}
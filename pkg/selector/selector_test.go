@@ -0,0 +1,137 @@
+package selector
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Selector
+	}{
+		{"", nil},
+		{" , ", nil},
+		{"a=b", Selector{{"a", Equals, []string{"b"}}}},
+		{"a==b", Selector{{"a", Equals, []string{"b"}}}},
+		{"a!=b", Selector{{"a", NotEquals, []string{"b"}}}},
+		{"a=", Selector{{"a", Equals, []string{""}}}},
+		{"a=b=c", Selector{{"a", Equals, []string{"b=c"}}}},
+		{" a = b , c != d ", Selector{{"a", Equals, []string{"b"}}, {"c", NotEquals, []string{"d"}}}},
+		{"e in (x,y)", Selector{{"e", In, []string{"x", "y"}}}},
+		{"e IN ( x , y )", Selector{{"e", In, []string{"x", "y"}}}},
+		{"e in(x)", Selector{{"e", In, []string{"x"}}}},
+		{"e in (a=b)", Selector{{"e", In, []string{"a=b"}}}},
+		{"e notin (a!=b,c)", Selector{{"e", NotIn, []string{"a!=b", "c"}}}},
+		{"f notin (z)", Selector{{"f", NotIn, []string{"z"}}}},
+		{"g", Selector{{"g", Exists, nil}}},
+		{"!h", Selector{{"h", DoesNotExist, nil}}},
+		{" ! h ", Selector{{"h", DoesNotExist, nil}}},
+		{"a=b,e in (x,y),g,!h", Selector{
+			{"a", Equals, []string{"b"}},
+			{"e", In, []string{"x", "y"}},
+			{"g", Exists, nil},
+			{"h", DoesNotExist, nil},
+		}},
+	}
+	for _, test := range tests {
+		got, err := ParseLabels(test.in)
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: expected %v, got %v", test.in, test.want, got)
+		}
+	}
+}
+
+func TestParseLabelsRejectsMalformed(t *testing.T) {
+	for _, in := range []string{
+		"=b",
+		"!=b",
+		"a b=c",
+		"e in x",
+		"e in (x",
+		"e in ()",
+		"e in ( , )",
+		"e within (x)",
+		"a b",
+		"!",
+		"a(b",
+	} {
+		if got, err := ParseLabels(in); err == nil {
+			t.Errorf("%q: expected an error, got %v", in, got)
+		}
+	}
+}
+
+func TestParseFields(t *testing.T) {
+	got, err := ParseFields("state=running, host_uuid != abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Selector{{"state", Equals, []string{"running"}}, {"host_uuid", NotEquals, []string{"abc"}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	for _, in := range []string{"state", "!state", "state in (running)", "e in (a=b)"} {
+		if got, err := ParseFields(in); err == nil {
+			t.Errorf("%q: expected an error, got %v", in, got)
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	labels := map[string]interface{}{"a": "b", "n": 1, "nil": nil}
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{"", true},
+		{"a=b", true},
+		{"a=c", false},
+		{"n=1", true},
+		{"a!=c", true},
+		{"a!=b", false},
+		{"missing!=b", true},
+		{"a in (x,b)", true},
+		{"a in (x)", false},
+		{"missing in (b)", false},
+		{"a notin (x)", true},
+		{"a notin (b)", false},
+		{"missing notin (b)", true},
+		{"a", true},
+		{"nil", false},
+		{"!missing", true},
+		{"!a", false},
+		{"a=b,!a", false},
+	}
+	for _, test := range tests {
+		sel, err := ParseLabels(test.selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sel.Matches(getter(labels)); got != test.want {
+			t.Errorf("%q: expected %v, got %v", test.selector, test.want, got)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	values := []interface{}{
+		map[string]interface{}{"name": "a", "state": "running", "labels": map[string]interface{}{"tier": "web"}},
+		map[string]interface{}{"name": "b", "state": "stopped", "labels": map[string]interface{}{"tier": "web"}},
+		map[string]interface{}{"name": "c", "state": "running"},
+		"not a map",
+	}
+	labels, _ := ParseLabels("tier in (web)")
+	fields, _ := ParseFields("state=running")
+
+	got := Filter(values, labels, fields)
+	if len(got) != 1 || got[0].(map[string]interface{})["name"] != "a" {
+		t.Errorf("expected only a, got %v", got)
+	}
+	if got := Filter(values, nil, nil); len(got) != len(values) {
+		t.Errorf("empty selectors filtered %v", got)
+	}
+}
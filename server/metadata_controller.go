@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"sync"
@@ -11,60 +12,141 @@ import (
 	uuid "github.com/satori/go.uuid"
 )
 
+const (
+	// the answers compared by Diff, besides snapshots
+	DIFF_LIVE     = "live"
+	DIFF_PREVIOUS = "previous"
+)
+
+// AnswerFilter transforms an answer before it is compared or returned
+type AnswerFilter func(interface{}) interface{}
+
 type MetadataController struct {
-	metadataServers map[string]*MetadataServer
-	versions        config.Versions
-	version         string
+	// the source of the local answers, and its last answers
+	local       Source
+	localUpdate SourceUpdate
+	startLocal  bool
+	// the external environments
+	sources  *sourceRegistry
+	versions config.Versions
+	index    *config.PathIndex
+	lookups  config.Lookups
+	version  string
 	sync.Mutex
-	versionCond           *sync.Cond
+	watchers              *watchers
+	ctx                   context.Context
 	subscribe             bool
 	answersFileNamePrefix string
 	reloadInterval        int64
+	strictKeys            bool
+	strictSchema          bool
+	historySize           int
+	// the external sources added through the admin API
+	addedSources map[string]ExternalSource
+	// the static answers merged on top of those of the sources
+	overlays []*config.Overlay
+	// closed, and replaced, whenever the answers are merged again
+	reloaded chan struct{}
+	// the number of times the answers were merged
+	generation uint64
+	stopped    bool
+}
+
+// ControllerOptions configures a MetadataController
+type ControllerOptions struct {
+	// subscribe to the local Rancher environment and those it advertises
+	Subscribe bool
+	// the answers file, and the prefix of the files of the other sources
+	Answers string
+	// the minimum time between downloads, in milliseconds
+	ReloadInterval int64
+	StrictKeys     bool
+	StrictSchema   bool
+	// the snapshots kept for rollback by each Rancher source
+	HistorySize int
+	Overlays    []*config.Overlay
+	// makes the local source, the local Rancher environment if nil
+	NewLocal NewSourceFunc
 }
 
-func NewMetadataController(subscribe bool, answersFileNamePrefix string, reloadInterval int64) *MetadataController {
-	return &MetadataController{
+func NewMetadataController(opts ControllerOptions) *MetadataController {
+	mc := &MetadataController{
 		versions:              (config.Versions)(nil),
 		version:               "0",
-		subscribe:             subscribe,
-		answersFileNamePrefix: answersFileNamePrefix,
-		reloadInterval:        reloadInterval,
+		subscribe:             opts.Subscribe,
+		answersFileNamePrefix: opts.Answers,
+		reloadInterval:        opts.ReloadInterval,
+		strictKeys:            opts.StrictKeys,
+		strictSchema:          opts.StrictSchema,
+		historySize:           opts.HistorySize,
+		watchers:              newWatchers(),
+		sources:               newSourceRegistry(),
+		addedSources:          make(map[string]ExternalSource),
+		overlays:              opts.Overlays,
+		reloaded:              make(chan struct{}),
+	}
+	if opts.NewLocal == nil {
+		// the local Rancher environment, subscribed to if asked
+		mc.local = NewMetaDataServer(os.Getenv("CATTLE_URL"), os.Getenv("CATTLE_ACCESS_KEY"), os.Getenv("CATTLE_SECRET_KEY"),
+			true, opts.Answers, opts.ReloadInterval, opts.StrictSchema, opts.HistorySize, mc.updateLocal)
+		mc.startLocal = opts.Subscribe
+	} else {
+		mc.local = opts.NewLocal(mc.updateLocal)
+		mc.startLocal = true
 	}
+	return mc
 }
 
-func (mc *MetadataController) Start() error {
-	//register default metadata server
-	mc.RegisterMetaDataServer(os.Getenv("CATTLE_URL"),
-		os.Getenv("CATTLE_ACCESS_KEY"),
-		os.Getenv("CATTLE_SECRET_KEY"), true, false)
+// Start loads the answers and subscribes to Rancher until ctx is done
+func (mc *MetadataController) Start(ctx context.Context) error {
+	mc.ctx = ctx
+	if err := mc.loadSources(); err != nil {
+		return err
+	}
 
-	mc.versionCond = sync.NewCond(mc)
 	if err := mc.LoadVersionsFromFile(); err != nil {
 		return err
 	}
 
-	go func() {
-		for {
-			time.Sleep(5 * time.Second)
-			mc.versionCond.Broadcast()
-		}
-	}()
-
-	if mc.subscribe {
-		for _, m := range mc.metadataServers {
-			if err := m.Start(); err != nil {
-				return err
-			}
+	// external sources were started as they were registered
+	if mc.startLocal {
+		if err := mc.local.Start(ctx); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// Stop answers the pending long-polls with their current values, and stops
+// every subscriber after saving its last answers
+func (mc *MetadataController) Stop() {
+	mc.Lock()
+	mc.watchers.stop()
+	if !mc.stopped {
+		mc.stopped = true
+		close(mc.reloaded)
+	}
+	mc.Unlock()
+
+	// the sources save their answers, without blocking the lookups
+	mc.local.Stop()
+	for _, m := range mc.sources.list() {
+		m.Stop()
+	}
+}
+
+// LoadVersionsFromFile reads the overlays and the answers of every source
+// again
 func (mc *MetadataController) LoadVersionsFromFile() error {
-	for _, m := range mc.metadataServers {
-		err := m.loadVersionsFromFile()
-		if err != nil {
+	if err := mc.loadOverlays(); err != nil {
+		return err
+	}
+	if err := mc.local.Load(); err != nil {
+		return fmt.Errorf("Failed to load answers from file: %v", err)
+	}
+	for _, m := range mc.sources.list() {
+		if err := m.Load(); err != nil {
 			return fmt.Errorf("Failed to load answers from file: %v", err)
 		}
 	}
@@ -73,22 +155,119 @@ func (mc *MetadataController) LoadVersionsFromFile() error {
 	return nil
 }
 
+// loadOverlays reads every overlay, keeping the previous ones if any fails
+func (mc *MetadataController) loadOverlays() error {
+	mc.Lock()
+	overlays := mc.overlays
+	mc.Unlock()
+
+	loaded := make([]*config.Overlay, 0, len(overlays))
+	for _, o := range overlays {
+		l, err := o.Load()
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, l)
+	}
+	if len(loaded) > 0 {
+		log.Infof("Loaded %d overlays", len(loaded))
+	}
+
+	mc.Lock()
+	mc.overlays = loaded
+	mc.Unlock()
+	return nil
+}
+
 func (mc *MetadataController) resetVersion() {
 	mc.version = uuid.NewV4().String()
 }
 
+// updateLocal merges the answers again with the new ones of the local source
+func (mc *MetadataController) updateLocal(update SourceUpdate) {
+	mc.Lock()
+	mc.localUpdate = update
+	changes := mc.reloadVersionsLocked()
+	mc.Unlock()
+	mc.applyChanges(changes)
+}
+
 func (mc *MetadataController) mergeVersions() config.Versions {
-	var external []config.Versions
-	var local config.Versions
-	for _, m := range mc.metadataServers {
-		if m.local {
-			local = m.GetVersions()
-		} else {
-			external = append(external, m.GetVersions())
-		}
+	if mc.localUpdate.Merged {
+		return config.ApplyOverlays(mc.localUpdate.Versions, mc.overlays)
+	}
+	merged := config.MergeVersions(mc.localUpdate.Versions, mc.sources.versions(), mc.version)
+	return config.ApplyOverlays(merged, mc.overlays)
+}
+
+// localServer returns the local source if it is a Rancher environment, the
+// only kind keeping snapshots
+func (mc *MetadataController) localServer() *MetadataServer {
+	m, _ := mc.local.(*MetadataServer)
+	return m
+}
+
+// Snapshots lists the history of the local environment
+func (mc *MetadataController) Snapshots() ([]config.Snapshot, error) {
+	m := mc.localServer()
+	if m == nil {
+		return nil, fmt.Errorf("No local metadata server")
+	}
+	return m.Snapshots()
+}
+
+// RollbackSnapshot serves a snapshot of the local environment until
+// UnpinSnapshot
+func (mc *MetadataController) RollbackSnapshot(id string) error {
+	m := mc.localServer()
+	if m == nil {
+		return fmt.Errorf("No local metadata server")
+	}
+	return m.Rollback(id)
+}
+
+func (mc *MetadataController) UnpinSnapshot() error {
+	m := mc.localServer()
+	if m == nil {
+		return fmt.Errorf("No local metadata server")
+	}
+	return m.Unpin()
+}
+
+// Diff compares two sets of answers of the local environment: the live
+// answers, those served before the last reload, or a snapshot
+func (mc *MetadataController) Diff(from, to string) (config.AnswersDiff, error) {
+	fromVersions, err := mc.diffedVersions(from)
+	if err != nil {
+		return config.AnswersDiff{}, err
+	}
+	toVersions, err := mc.diffedVersions(to)
+	if err != nil {
+		return config.AnswersDiff{}, err
 	}
+	return config.AnswersDiff{
+		From:     from,
+		To:       to,
+		Versions: config.DiffVersions(fromVersions, toVersions),
+	}, nil
+}
 
-	return config.MergeVersions(local, external, mc.version)
+func (mc *MetadataController) diffedVersions(name string) (config.Versions, error) {
+	m := mc.localServer()
+	if m == nil {
+		return nil, fmt.Errorf("No local metadata server")
+	}
+	switch name {
+	case DIFF_LIVE:
+		return m.GetVersions(), nil
+	case DIFF_PREVIOUS:
+		previous := m.GetPreviousVersions()
+		if previous == nil {
+			return nil, fmt.Errorf("No answers were served before the last reload")
+		}
+		return previous, nil
+	}
+	return m.SnapshotVersions(name)
 }
 
 func (mc *MetadataController) GetVersions() config.Versions {
@@ -97,78 +276,126 @@ func (mc *MetadataController) GetVersions() config.Versions {
 	return mc.versions
 }
 
-func (mc *MetadataController) RegisterMetaDataServer(url string, accessKey string, secretKey string, local bool, subscribe bool) error {
-	create := false
-	if mc.metadataServers == nil {
-		mc.metadataServers = make(map[string]*MetadataServer)
-		create = true
-	} else {
-		existing, ok := mc.metadataServers[accessKey]
-		if !ok {
-			create = true
-		} else if existing.accessKey != accessKey {
-			create = true
-		}
+// HasClientAnswers returns whether there are answers for ip in version,
+// rather than only the default ones
+func (mc *MetadataController) HasClientAnswers(version string, ip string) bool {
+	_, ok := mc.GetVersions()[version][ip]
+	return ok
+}
 
-	}
+func (mc *MetadataController) getIndexedVersions() (config.Versions, *config.PathIndex) {
+	mc.Lock()
+	defer mc.Unlock()
+	return mc.versions, mc.index
+}
 
-	if !create {
+// reloadChanges is what a reload leaves to do once the controller lock is
+// released: starting and stopping the external sources it registered and
+// unregistered blocks on the network and the disk, and comparing the answers
+// long-polls wait on takes time with many of them.
+type reloadChanges struct {
+	started []*MetadataServer
+	stopped []*MetadataServer
+	// the merged answers, and the number of the reload
+	versions   config.Versions
+	index      *config.PathIndex
+	generation uint64
+}
+
+// registerSource adds the source of an external environment, and returns it
+// unless it was registered already
+func (mc *MetadataController) registerSource(url string, accessKey string, secretKey string) *MetadataServer {
+	if _, ok := mc.sources.get(accessKey); ok {
 		return nil
 	}
 	log.Infof("Registering metadata server [%s] with url [%s]", accessKey, url)
 
-	m := NewMetaDataServer(url,
-		accessKey, secretKey, local, mc.answersFileNamePrefix, mc.reloadInterval, mc.reloadVersions)
+	var m *MetadataServer
+	m = NewMetaDataServer(url,
+		accessKey, secretKey, false, mc.answersFileNamePrefix, mc.reloadInterval, mc.strictSchema, mc.historySize,
+		func(update SourceUpdate) {
+			mc.Lock()
+			if !mc.sources.setUpdate(m, update) {
+				mc.Unlock()
+				return
+			}
+			changes := mc.reloadVersionsLocked()
+			mc.Unlock()
+			mc.applyChanges(changes)
+		})
 
-	if subscribe && mc.subscribe {
-		if err := m.Start(); err != nil {
-			return fmt.Errorf("Failed to register metadata server [%s] with url [%s]: [%v]", accessKey, url, err)
-		}
+	if !mc.sources.add(m) {
+		// registered meanwhile
+		return nil
 	}
-	mc.metadataServers[accessKey] = m
-	log.Infof("Registered metadata server for [%s] with url [%s]", accessKey, url)
-	return nil
+	return m
 }
 
-func (mc *MetadataController) UnregisterMetaDataServer(UUID string) {
-	if _, ok := mc.metadataServers[UUID]; !ok {
-		return
+// unregisterSource removes the source of an external environment, and
+// returns it if it was registered
+func (mc *MetadataController) unregisterSource(UUID string) *MetadataServer {
+	m, ok := mc.sources.remove(UUID)
+	if !ok {
+		return nil
 	}
 	log.Infof("Deregestring metadata server [%s]", UUID)
+	return m
+}
+
+// applyChanges wakes the long-polls whose answer a reload changed, stops the
+// sources it unregistered and starts those it registered, and returns the
+// errors starting them by access key
+func (mc *MetadataController) applyChanges(changes reloadChanges) map[string]error {
+	mc.watchers.notify(changes.versions, changes.index, mc.strictKeys, changes.generation)
 
-	if mc.subscribe {
-		mc.metadataServers[UUID].Stop()
+	for _, m := range changes.stopped {
+		if mc.subscribe {
+			m.Stop()
+		}
+		log.Infof("Deregistered metadata server [%s]", m.accessKey)
 	}
-	delete(mc.metadataServers, UUID)
-	log.Infof("Deregistered metadata server [%s]", UUID)
-}
 
-func (mc *MetadataController) getExternalCredentials() []config.Credential {
-	for _, s := range mc.metadataServers {
-		if s.local {
-			return s.GetExternalCredentials()
+	errs := make(map[string]error)
+	for _, m := range changes.started {
+		if mc.subscribe {
+			if err := m.Start(mc.ctx); err != nil {
+				mc.sources.removeServer(m)
+				errs[m.accessKey] = fmt.Errorf("Failed to register metadata server [%s] with url [%s]: [%v]", m.accessKey, m.URL, err)
+				log.Error(errs[m.accessKey])
+				continue
+			}
 		}
+		log.Infof("Registered metadata server for [%s] with url [%s]", m.accessKey, m.URL)
 	}
-	return []config.Credential{}
+	return errs
 }
 
 func (mc *MetadataController) reloadVersions() {
 	mc.Lock()
-	defer mc.Unlock()
-	creds := mc.getExternalCredentials()
+	changes := mc.reloadVersionsLocked()
+	mc.Unlock()
+	mc.applyChanges(changes)
+}
+
+// reloadVersionsLocked merges the answers again, and returns what is left to
+// do after releasing the lock
+func (mc *MetadataController) reloadVersionsLocked() reloadChanges {
+	creds := mc.localUpdate.Credentials
 	// sync subscribers here
 	toAdd := make(map[string]config.Credential)
 
 	for _, cred := range creds {
 		toAdd[cred.PublicValue] = cred
 	}
+	for key, s := range mc.addedSources {
+		if _, ok := toAdd[key]; !ok {
+			toAdd[key] = s.credential()
+		}
+	}
 
 	toRemove := []string{}
-	for key, server := range mc.metadataServers {
-		if server.local {
-			continue
-		}
-		if val, ok := toAdd[key]; !ok {
+	for _, server := range mc.sources.list() {
+		if val, ok := toAdd[server.accessKey]; !ok {
 			toRemove = append(toRemove, server.accessKey)
 		} else if server.URL != val.URL {
 			toRemove = append(toRemove, server.accessKey)
@@ -176,28 +403,90 @@ func (mc *MetadataController) reloadVersions() {
 	}
 
 	// 1. Deregister obsolete subscribers
+	var changes reloadChanges
 	for _, UUID := range toRemove {
-		mc.UnregisterMetaDataServer(UUID)
+		if m := mc.unregisterSource(UUID); m != nil {
+			changes.stopped = append(changes.stopped, m)
+		}
 	}
 
 	// 2. Merge versions
+	start := time.Now()
 	mc.versions = mc.mergeVersions()
+	mc.index = config.NewPathIndex(mc.versions)
+	mc.lookups = mc.localUpdate.Lookups
 	mc.resetVersion()
-	// 3. Register new subscribers
-	for _, cred := range toAdd {
-		err := mc.RegisterMetaDataServer(cred.URL, cred.PublicValue, cred.SecretValue, false, true)
-		if err != nil {
-			log.Error(err)
+	mc.generation++
+	changes.versions, changes.index, changes.generation = mc.versions, mc.index, mc.generation
+	reloadDuration.ObserveSince(start)
+	// 3. Register new subscribers, unless shutting down
+	if !mc.stopped {
+		for _, cred := range toAdd {
+			if m := mc.registerSource(cred.URL, cred.PublicValue, cred.SecretValue); m != nil {
+				changes.started = append(changes.started, m)
+			}
+		}
+	}
+
+	if !mc.stopped {
+		close(mc.reloaded)
+		mc.reloaded = make(chan struct{})
+	}
+	return changes
+}
+
+// WaitVersion waits, up to maxWait or until ctx is done, for the id of the
+// merged answers to differ from version, and returns the answers and their id
+func (mc *MetadataController) WaitVersion(ctx context.Context, version string, maxWait time.Duration) (config.Versions, string) {
+	mc.Lock()
+	reloaded := mc.reloaded
+	current := mc.version
+	mc.Unlock()
+
+	if current == version {
+		timeout := time.NewTimer(maxWait)
+		defer timeout.Stop()
+		select {
+		case <-reloaded:
+		case <-timeout.C:
+		case <-ctx.Done():
 		}
 	}
 
-	mc.versionCond.Broadcast()
+	mc.Lock()
+	defer mc.Unlock()
+	return mc.versions, mc.version
+}
+
+// ReverseLookup finds the object owning an IP address, a UUID or a
+// stack/service/container name in the given version of the local answers.
+func (mc *MetadataController) ReverseLookup(version string, by string, keys []string) (config.LookupResult, bool) {
+	mc.Lock()
+	l := mc.lookups[version]
+	mc.Unlock()
+
+	switch by {
+	case "ip":
+		if len(keys) == 1 {
+			return l.IP(keys[0])
+		}
+	case "uuid":
+		if len(keys) == 1 {
+			return l.UUID(keys[0])
+		}
+	case "name":
+		return l.Name(keys...)
+	}
+	return config.LookupResult{}, false
 }
 
-func (mc *MetadataController) LookupAnswer(wait bool, oldValue, version string, ip string, path []string, maxWait time.Duration) (interface{}, bool) {
+// LookupAnswer returns the answer at path.  With wait it waits, up to maxWait
+// or until ctx is done, for the answer to differ from oldValue, and is woken
+// only by the reloads that change the answer.
+func (mc *MetadataController) LookupAnswer(ctx context.Context, wait bool, oldValue, version string, ip string, path []string, maxWait time.Duration,
+	filter AnswerFilter) (interface{}, bool) {
 	if !wait {
-		v := mc.GetVersions()
-		return v.Matching(version, ip, path)
+		return mc.lookupFiltered(version, ip, path, filter)
 	}
 
 	if maxWait == time.Duration(0) {
@@ -208,20 +497,48 @@ func (mc *MetadataController) LookupAnswer(wait bool, oldValue, version string,
 		maxWait = 2 * time.Minute
 	}
 
-	start := time.Now()
+	longPollWaiters.Inc()
+	defer longPollWaiters.Dec()
+	timeout := time.NewTimer(maxWait)
+	defer timeout.Stop()
 
 	for {
-		v := mc.GetVersions()
-		val, ok := v.Matching(version, ip, path)
-		if time.Now().Sub(start) > maxWait {
-			return val, ok
+		// watch before looking up, so that no change is missed in between
+		waiter, ok := mc.watchers.add(version, ip, path, mc.strictKeys)
+		if !ok {
+			// shutting down
+			return mc.lookupFiltered(version, ip, path, filter)
 		}
+
+		val, ok := lookupIndexed(waiter.versions, waiter.index, mc.strictKeys, version, ip, path, filter)
 		if ok && fmt.Sprint(val) != oldValue {
+			mc.watchers.remove(waiter)
 			return val, ok
 		}
 
-		mc.versionCond.L.Lock()
-		mc.versionCond.Wait()
-		mc.versionCond.L.Unlock()
+		select {
+		case <-waiter.changed:
+			mc.watchers.remove(waiter)
+		case <-timeout.C:
+			mc.watchers.remove(waiter)
+			return mc.lookupFiltered(version, ip, path, filter)
+		case <-ctx.Done():
+			mc.watchers.remove(waiter)
+			return val, ok
+		}
+	}
+}
+
+func (mc *MetadataController) lookupFiltered(version string, ip string, path []string, filter AnswerFilter) (interface{}, bool) {
+	v, idx := mc.getIndexedVersions()
+	return lookupIndexed(v, idx, mc.strictKeys, version, ip, path, filter)
+}
+
+func lookupIndexed(v config.Versions, idx *config.PathIndex, strict bool, version string, ip string, path []string,
+	filter AnswerFilter) (interface{}, bool) {
+	val, ok := v.MatchingIndexed(idx, strict, version, ip, path)
+	if ok && filter != nil {
+		val = filter(val)
 	}
+	return val, ok
 }
@@ -1,29 +1,43 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rancher/log"
 
 	"github.com/rancher/rancher-metadata/config"
 )
 
-type GlobalReloadFunc func()
-
+// MetadataServer is the Source of the answers of a Rancher environment
 type MetadataServer struct {
-	URL                 string
-	accessKey           string
-	secretKey           string
-	subscriber          *Subscriber
-	versions            config.Versions
-	globalReload        GlobalReloadFunc
-	generator           *config.Generator
-	local               bool
-	version             string
-	externalCredentials []config.Credential
-	reloadInterval      int64
+	URL       string
+	accessKey string
+	secretKey string
+	// serializes Start with Stop, so that a source stopped before it
+	// started is never started
+	startLock sync.Mutex
+	stopped   bool
+	// guards subscriber, set by Start
+	subscriberLock   sync.Mutex
+	subscriber       *Subscriber
+	versionsLock     sync.RWMutex
+	versions         config.Versions
+	previousVersions config.Versions
+	version          string
+	update           SourceUpdateFunc
+	generator        *config.Generator
+	local            bool
+	reloadInterval   int64
+	// serializes applying downloaded answers with rollbacks
+	applyLock sync.Mutex
 }
 
 func NewMetaDataServer(URL string, accessKey string, secretKey string,
-	local bool, answersFilePathPrefix string, reloadInterval int64, globalReload GlobalReloadFunc) *MetadataServer {
+	local bool, answersFilePathPrefix string, reloadInterval int64, strictSchema bool, historySize int,
+	update SourceUpdateFunc) *MetadataServer {
 
 	return &MetadataServer{
 		URL:            URL,
@@ -31,10 +45,10 @@ func NewMetaDataServer(URL string, accessKey string, secretKey string,
 		secretKey:      secretKey,
 		local:          local,
 		versions:       (config.Versions)(nil),
-		globalReload:   globalReload,
+		update:         update,
 		reloadInterval: reloadInterval,
 		generator: config.NewGenerator(local, getAnswersFileName(answersFilePathPrefix,
-			accessKey, local)),
+			accessKey, local), strictSchema, historySize),
 	}
 }
 
@@ -45,46 +59,136 @@ func getAnswersFileName(answersFilePathPrefix string, accessKey string, isLocal
 	return fmt.Sprintf("%s_%s", answersFilePathPrefix, accessKey)
 }
 
-func (ms *MetadataServer) Start() error {
+func (ms *MetadataServer) Start(ctx context.Context) error {
+	ms.startLock.Lock()
+	defer ms.startLock.Unlock()
+	if ms.stopped {
+		return nil
+	}
 
-	ms.subscriber = NewSubscriber(
+	subscriber := NewSubscriber(
 		ms.URL,
 		ms.accessKey,
 		ms.secretKey,
 		ms.generator,
 		ms.reloadInterval,
-		ms.setVersions,
+		SourceLabel(ms.local),
+		ms.applyDownloaded,
 	)
-	if err := ms.subscriber.Subscribe(); err != nil {
+	if err := subscriber.Subscribe(ctx); err != nil {
 		return fmt.Errorf("Failed to subscribe to url [%s]: %v", ms.URL, err)
 	}
+	ms.subscriberLock.Lock()
+	ms.subscriber = subscriber
+	ms.subscriberLock.Unlock()
 	return nil
 }
 
+// Stop unsubscribes and saves the last answers downloaded
 func (ms *MetadataServer) Stop() {
-	ms.subscriber.Unsubscribe()
+	ms.startLock.Lock()
+	defer ms.startLock.Unlock()
+	ms.stopped = true
+	subscriber := ms.getSubscriber()
+	if subscriber == nil {
+		return
+	}
+	subscriber.Unsubscribe()
+	ms.generator.SaveToFile(time.Now())
 }
 
-func (ms *MetadataServer) loadVersionsFromFile() (err error) {
-	neu, creds, err := ms.generator.LoadVersionsFromFile(true)
+func (ms *MetadataServer) getSubscriber() *Subscriber {
+	ms.subscriberLock.Lock()
+	defer ms.subscriberLock.Unlock()
+	return ms.subscriber
+}
+
+// Load reads the answers saved in the answers file, or the pinned snapshot
+func (ms *MetadataServer) Load() (err error) {
+	if id, ok := ms.generator.Pinned(); ok {
+		log.Infof("Loading pinned snapshot [%s] for [%s]", id, ms.accessKey)
+		return ms.Rollback(id)
+	}
+	neu, lookups, creds, err := ms.generator.LoadVersionsFromFile(true)
 	if err != nil {
 		return err
 	}
-	ms.setVersions(neu, creds, "")
+	ms.generator.RecordSnapshot(time.Now())
+	ms.setVersions(neu, lookups, creds, ms.generator.DeltaVersion())
 	return nil
 }
 
 func (ms *MetadataServer) GetVersions() config.Versions {
+	ms.versionsLock.RLock()
+	defer ms.versionsLock.RUnlock()
 	return ms.versions
 }
 
-func (ms *MetadataServer) setVersions(versions config.Versions, creds []config.Credential, version string) {
+// GetPreviousVersions returns the answers served before the last reload
+func (ms *MetadataServer) GetPreviousVersions() config.Versions {
+	ms.versionsLock.RLock()
+	defer ms.versionsLock.RUnlock()
+	return ms.previousVersions
+}
+
+func (ms *MetadataServer) setVersions(versions config.Versions, lookups config.Lookups, creds []config.Credential, version string) {
+	ms.versionsLock.Lock()
+	ms.previousVersions = ms.versions
 	ms.versions = versions
 	ms.version = version
-	ms.externalCredentials = creds
-	ms.globalReload()
+	ms.versionsLock.Unlock()
+	ms.update(SourceUpdate{
+		Versions:    versions,
+		Lookups:     lookups,
+		Credentials: creds,
+		Version:     version,
+	})
 }
 
-func (ms *MetadataServer) GetExternalCredentials() []config.Credential {
-	return ms.externalCredentials
+// Rollback serves the answers of a snapshot from the history, and keeps
+// serving them until Unpin
+func (ms *MetadataServer) Rollback(id string) error {
+	ms.applyLock.Lock()
+	defer ms.applyLock.Unlock()
+	versions, lookups, creds, version, err := ms.generator.Rollback(id)
+	if err != nil {
+		return fmt.Errorf("Failed to roll back to snapshot [%s]: %v", id, err)
+	}
+	log.Infof("Rolled back [%s] to snapshot [%s] of version [%s]", ms.accessKey, id, version)
+	ms.setVersions(versions, lookups, creds, version)
+	return nil
+}
+
+// Unpin lets the answers from Rancher be applied again
+func (ms *MetadataServer) Unpin() error {
+	if err := ms.generator.Unpin(); err != nil {
+		return err
+	}
+	log.Infof("Unpinned [%s]", ms.accessKey)
+	if s := ms.getSubscriber(); s != nil {
+		s.kicker.Kick()
+	}
+	return nil
+}
+
+func (ms *MetadataServer) Snapshots() ([]config.Snapshot, error) {
+	return ms.generator.Snapshots()
+}
+
+func (ms *MetadataServer) SnapshotVersions(id string) (config.Versions, error) {
+	return ms.generator.SnapshotVersions(id)
+}
+
+// applyDownloaded serves the answers of a delta from Rancher, and keeps the
+// delta to save it, unless a snapshot is pinned
+func (ms *MetadataServer) applyDownloaded(delta *config.Delta, versions config.Versions, lookups config.Lookups, creds []config.Credential) {
+	ms.applyLock.Lock()
+	defer ms.applyLock.Unlock()
+	if id, ok := ms.generator.Pinned(); ok {
+		log.Infof("Discarding version [%s] of [%s] while snapshot [%s] is pinned", delta.Version, ms.accessKey, id)
+		return
+	}
+	ms.generator.ApplyDelta(delta)
+	ms.setVersions(versions, lookups, creds, delta.Version)
+	ms.generator.RecordSnapshot(time.Now())
 }
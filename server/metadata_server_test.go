@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/rancher-metadata/config"
+)
+
+func testDelta(t *testing.T, version string, valid bool) []byte {
+	objects := []map[string]interface{}{
+		{"metadata_kind": "defaultData", "version": version},
+		{"metadata_kind": "host", "uuid": "host-1", "name": "host1", "hostId": 1},
+	}
+	if !valid {
+		objects = append(objects, map[string]interface{}{"metadata_kind": "host", "name": "nameless"})
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range objects {
+		if err := json.NewEncoder(w).Encode(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+// rancherStub serves the delta set last as the metadata answers
+type rancherStub struct {
+	sync.Mutex
+	delta []byte
+}
+
+func (r *rancherStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	defer r.Unlock()
+	if req.Method == "GET" {
+		w.Write(r.delta)
+	}
+}
+
+func (r *rancherStub) set(delta []byte) {
+	r.Lock()
+	r.delta = delta
+	r.Unlock()
+}
+
+func TestOnlyServedDeltasAreKept(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stub := &rancherStub{}
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+
+	var served []string
+	answersFile := filepath.Join(dir, "answers")
+	ms := NewMetaDataServer(ts.URL, "ak", "sk", true, answersFile, 1, true, 2, func(u SourceUpdate) {
+		served = append(served, u.Version)
+	})
+	s := NewSubscriber(ms.URL, ms.accessKey, ms.secretKey, ms.generator, ms.reloadInterval, "local", ms.applyDownloaded)
+
+	download := func(version string, valid bool) error {
+		stub.set(testDelta(t, version, valid))
+		return s.downloadAndReload()
+	}
+	saved := func() string {
+		ms.generator.SaveToFile(time.Now())
+		_, version, err := ms.generator.DecodeFile(answersFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return version
+	}
+
+	if err := download("1", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := download("2", false); err == nil {
+		t.Fatal("a strict generator accepted an invalid delta")
+	}
+	if version := saved(); version != "1" {
+		t.Errorf("saved the rejected version, %s", version)
+	}
+	if status := ms.Status(); status.AppliedVersion != "1" {
+		t.Errorf("reported the rejected version, %s", status.AppliedVersion)
+	}
+
+	snapshots, err := ms.Snapshots()
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("expected a snapshot of version 1, got %v, %v", snapshots, err)
+	}
+	if err := download("3", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.Rollback(snapshots[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := download("4", true); err != nil {
+		t.Fatal(err)
+	}
+	if version := saved(); version != "1" {
+		t.Errorf("saved version %s while version 1 is pinned", version)
+	}
+	if status := ms.Status(); status.AppliedVersion != "1" {
+		t.Errorf("reported version %s while version 1 is pinned", status.AppliedVersion)
+	}
+	if want := []string{"1", "3", "1"}; !reflect.DeepEqual(served, want) {
+		t.Errorf("served versions %v, want %v", served, want)
+	}
+}
+
+func TestVersionsAreReadWhileSet(t *testing.T) {
+	ms := NewMetaDataServer("", "ak", "sk", true, "", 1, false, 0, func(SourceUpdate) {})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			ms.GetVersions()
+			ms.GetPreviousVersions()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		ms.setVersions(config.Versions{}, nil, nil, "1")
+	}
+	<-done
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"io"
+
+	"github.com/rancher/rancher-metadata/pkg/metrics"
+)
+
+var (
+	longPollWaiters = metrics.NewGauge("rancher_metadata_long_poll_waiters",
+		"Requests waiting for their answer to change.")
+	reloadDuration = metrics.NewHistogram("rancher_metadata_reload_duration_seconds",
+		"Time taken to merge the answers of every source.", nil)
+	downloadBytes = metrics.NewCounter("rancher_metadata_download_bytes_total",
+		"Bytes of metadata downloaded from Rancher, by source.", "source")
+	subscriberReconnects = metrics.NewCounter("rancher_metadata_subscriber_reconnects_total",
+		"Times the subscription to Rancher events was set up again after it ended, by source.", "source")
+	downloadRetries = metrics.NewCounter("rancher_metadata_download_retries_total",
+		"Downloads retried after a failed one, by source.", "source")
+	kickerGenerations = metrics.NewCounter("rancher_metadata_kicker_generations_total",
+		"Downloads run for the update requests from Rancher, by source.", "source")
+)
+
+// SourceLabel is the source label of the metrics of a metadata server
+func SourceLabel(local bool) string {
+	if local {
+		return "local"
+	}
+	return "external"
+}
+
+// countingReader counts the bytes read into a counter
+type countingReader struct {
+	r       io.Reader
+	counter *metrics.Counter
+	labels  []string
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.counter.Add(float64(n), c.labels...)
+	}
+	return n, err
+}
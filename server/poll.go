@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rancher/log"
+	"github.com/rancher/rancher-metadata/config"
+)
+
+// the formats of the documents a PollSource downloads
+const (
+	// a compressed delta, like Rancher's metadata-answers
+	POLL_FORMAT_DELTA = "delta"
+	// a JSON answers document, by version then client
+	POLL_FORMAT_ANSWERS = "answers"
+)
+
+// PollSource is the Source of the answers at a URL, downloaded every
+// interval unless their ETag didn't change.  The last download is saved, and
+// served as long as the URL can't be reached.
+type PollSource struct {
+	URL       string
+	format    string
+	interval  time.Duration
+	filePath  string
+	update    SourceUpdateFunc
+	generator *config.Generator
+	client    *http.Client
+	sync.Mutex
+	cancel        context.CancelFunc
+	etag          string
+	checksum      [sha256.Size]byte
+	version       string
+	lastDownload  time.Time
+	lastError     string
+	lastErrorTime time.Time
+}
+
+func NewPollSource(URL string, format string, interval time.Duration, answersFilePathPrefix string, strictSchema bool,
+	update SourceUpdateFunc) *PollSource {
+	return &PollSource{
+		URL:       URL,
+		format:    format,
+		interval:  interval,
+		filePath:  answersFilePathPrefix + ".poll",
+		update:    update,
+		generator: config.NewGenerator(true, "", strictSchema, 0),
+		client:    &http.Client{Timeout: time.Minute},
+	}
+}
+
+// Load reads the document saved by a previous run, if any
+func (p *PollSource) Load() error {
+	content, err := ioutil.ReadFile(p.filePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to read answers from [%s]: %v", p.filePath, err)
+	}
+	if err := p.apply(content, ""); err != nil {
+		log.Warnf("Ignoring the answers saved in [%s]: %v", p.filePath, err)
+		return nil
+	}
+	log.Infof("Loaded the answers of [%s] from [%s]", p.URL, p.filePath)
+	return nil
+}
+
+// apply reports the answers of a document, unless it is the one reported last
+func (p *PollSource) apply(content []byte, etag string) error {
+	sum := sha256.Sum256(content)
+	p.Lock()
+	unchanged := sum == p.checksum
+	p.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	update := SourceUpdate{Version: etag}
+	switch p.format {
+	case POLL_FORMAT_ANSWERS:
+		versions, err := config.DecodeVersions(content)
+		if err != nil {
+			return err
+		}
+		update.Versions = versions
+		update.Lookups = config.NewLookups(versions)
+	default:
+		delta, err := p.generator.DecodeDelta(bytes.NewReader(content))
+		if err != nil {
+			return fmt.Errorf("Failed to decode delta: %v", err)
+		}
+		update.Versions, update.Lookups, update.Credentials, err = p.generator.GenerateAnswers(delta.Objects)
+		if err != nil {
+			return err
+		}
+		p.generator.ApplyDelta(delta)
+		update.Version = delta.Version
+	}
+
+	p.Lock()
+	p.checksum = sum
+	p.version = update.Version
+	p.Unlock()
+	p.update(update)
+	return nil
+}
+
+// Start polls the URL every interval until ctx is done or Stop
+func (p *PollSource) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	p.Lock()
+	p.cancel = cancel
+	p.Unlock()
+	go func() {
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+		for {
+			err := p.poll(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			p.recordDownload(err)
+			if err != nil {
+				log.Error(err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *PollSource) Stop() {
+	p.Lock()
+	cancel := p.cancel
+	p.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// poll downloads the document at the URL, unless its ETag didn't change, and
+// reports its answers
+func (p *PollSource) poll(ctx context.Context) error {
+	req, err := http.NewRequest("GET", p.URL, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to download answers from [%s]: %v", p.URL, err)
+	}
+	p.Lock()
+	if p.etag != "" {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+	p.Unlock()
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("Failed to download answers from [%s]: %v", p.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to download answers from [%s]: %s", p.URL, resp.Status)
+	}
+	content, err := ioutil.ReadAll(&countingReader{r: resp.Body, counter: downloadBytes, labels: []string{SOURCE_HTTP}})
+	if err != nil {
+		return fmt.Errorf("Failed to download answers from [%s]: %v", p.URL, err)
+	}
+
+	etag := resp.Header.Get("ETag")
+	if err := p.apply(content, etag); err != nil {
+		return fmt.Errorf("Failed to apply answers from [%s]: %v", p.URL, err)
+	}
+	p.Lock()
+	p.etag = etag
+	p.Unlock()
+
+	if err := config.WriteFileAtomic(p.filePath, content, 0600); err != nil {
+		log.Errorf("Failed to save answers to [%s]: %v", p.filePath, err)
+	}
+	return nil
+}
+
+func (p *PollSource) recordDownload(err error) {
+	p.Lock()
+	defer p.Unlock()
+	if err != nil {
+		p.lastError = err.Error()
+		p.lastErrorTime = time.Now()
+	} else {
+		p.lastDownload = time.Now()
+	}
+}
+
+func (p *PollSource) Status() SourceStatus {
+	p.Lock()
+	defer p.Unlock()
+	status := SourceStatus{
+		Type:           SOURCE_HTTP,
+		URL:            p.URL,
+		Local:          true,
+		Subscribed:     p.cancel != nil,
+		AppliedVersion: p.version,
+		LastDownload:   optionalTime(p.lastDownload),
+		LastError:      p.lastError,
+		LastErrorTime:  optionalTime(p.lastErrorTime),
+	}
+	if p.format == POLL_FORMAT_DELTA {
+		status.Objects = p.generator.ObjectCounts()
+	}
+	return status
+}
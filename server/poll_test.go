@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/rancher-metadata/config"
+)
+
+// pollStub serves a document with its ETag, unless the request has it in
+// If-None-Match, after failing the first failures requests
+type pollStub struct {
+	sync.Mutex
+	document    []byte
+	etag        string
+	failures    int
+	ifNoneMatch []string
+}
+
+func (p *pollStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.Lock()
+	defer p.Unlock()
+	p.ifNoneMatch = append(p.ifNoneMatch, req.Header.Get("If-None-Match"))
+	if p.failures > 0 {
+		p.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if req.Header.Get("If-None-Match") == p.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", p.etag)
+	w.Write(p.document)
+}
+
+// requests returns the If-None-Match header of every request so far
+func (p *pollStub) requests() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string(nil), p.ifNoneMatch...)
+}
+
+// waitFor waits up to 5 seconds for ok
+func waitFor(t *testing.T, what string, ok func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPollSourceDownloadsChangedDocumentsOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rancher-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stub := &pollStub{document: testDelta(t, "1", true), etag: `"a"`}
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+
+	updates := make(chan SourceUpdate, 10)
+	p := NewPollSource(ts.URL, POLL_FORMAT_DELTA, 10*time.Millisecond, filepath.Join(dir, "answers"), false,
+		func(update SourceUpdate) { updates <- update })
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	update := <-updates
+	if update.Version != "1" || update.Versions[config.METADATA_VERSION3][config.DEFAULT_KEY] == nil {
+		t.Errorf("unexpected update %+v", update)
+	}
+
+	// the polls after the first one find the document unchanged
+	waitFor(t, "polls", func() bool { return len(stub.requests()) >= 4 })
+	// a new ETag with the same document changes nothing either
+	stub.Lock()
+	stub.etag = `"b"`
+	stub.Unlock()
+	waitFor(t, "polls", func() bool {
+		requests := stub.requests()
+		return requests[len(requests)-1] == `"b"`
+	})
+	p.Stop()
+
+	if len(updates) != 0 {
+		t.Errorf("an unchanged document was reported, %+v", <-updates)
+	}
+	requests := stub.requests()
+	if requests[0] != "" {
+		t.Errorf("the first request has If-None-Match %s", requests[0])
+	}
+	for _, etag := range requests[1:] {
+		if etag != `"a"` && etag != `"b"` {
+			t.Errorf("expected If-None-Match to be the last ETag, got [%s]", etag)
+		}
+	}
+	saved, err := ioutil.ReadFile(filepath.Join(dir, "answers.poll"))
+	if err != nil || !bytes.Equal(saved, stub.document) {
+		t.Errorf("the document wasn't saved, %v", err)
+	}
+	status := p.Status()
+	if status.AppliedVersion != "1" || status.LastDownload == nil || status.LastError != "" ||
+		!reflect.DeepEqual(status.Objects, map[string]int{"defaultData": 1, "host": 1}) {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestPollSourceFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rancher-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		format   string
+		document []byte
+		version  string
+		hosts    int
+		err      string
+	}{
+		{POLL_FORMAT_DELTA, testDelta(t, "1", true), "1", 1, ""},
+		{POLL_FORMAT_DELTA, []byte("{}"), "", 0, "Failed to decode delta"},
+		{POLL_FORMAT_ANSWERS, []byte(`{"` + config.METADATA_VERSION3 + `": {"default": {"hosts": [{"name": "a"}, {"name": "b"}]}}}`),
+			`"etag"`, 2, ""},
+		{POLL_FORMAT_ANSWERS, []byte(`{"` + config.METADATA_VERSION3 + `": {"default": []}}`), "", 0, "must be a map"},
+		{POLL_FORMAT_ANSWERS, testDelta(t, "1", true), "", 0, "Failed to parse answers"},
+	}
+	for i, test := range tests {
+		ts := httptest.NewServer(&pollStub{document: test.document, etag: `"etag"`})
+		updates := make(chan SourceUpdate, 1)
+		p := NewPollSource(ts.URL, test.format, time.Hour, filepath.Join(dir, test.format), false,
+			func(update SourceUpdate) { updates <- update })
+		err := p.poll(context.Background())
+		ts.Close()
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%d: expected error [%s], got %v", i, test.err, err)
+			}
+			if len(updates) != 0 {
+				t.Errorf("%d: an invalid document was reported", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		update := <-updates
+		if update.Version != test.version {
+			t.Errorf("%d: expected version [%s], got [%s]", i, test.version, update.Version)
+		}
+		hosts, _ := update.Versions[config.METADATA_VERSION3][config.DEFAULT_KEY].(map[string]interface{})["hosts"].([]interface{})
+		if len(hosts) != test.hosts {
+			t.Errorf("%d: expected %d hosts, got %v", i, test.hosts, hosts)
+		}
+	}
+}
+
+func TestPollSourceRetriesFailedDownloads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rancher-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stub := &pollStub{document: testDelta(t, "1", true), etag: `"a"`, failures: 2}
+	ts := httptest.NewServer(stub)
+
+	updates := make(chan SourceUpdate, 10)
+	update := func(update SourceUpdate) { updates <- update }
+	p := NewPollSource(ts.URL, POLL_FORMAT_DELTA, 10*time.Millisecond, filepath.Join(dir, "answers"), false, update)
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-updates
+	waitFor(t, "the download", func() bool { return p.Status().LastDownload != nil })
+	p.Stop()
+	ts.Close()
+
+	// retried every interval, without a download to ask If-None-Match for
+	if requests := stub.requests(); len(requests) < 3 || requests[0] != "" || requests[1] != "" || requests[2] != "" {
+		t.Errorf("unexpected requests %q", requests)
+	}
+	status := p.Status()
+	if !strings.Contains(status.LastError, "500") || status.LastErrorTime == nil || status.LastDownload == nil ||
+		status.LastDownload.Before(*status.LastErrorTime) {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// the saved document is served while the URL is unreachable
+	p = NewPollSource(ts.URL, POLL_FORMAT_DELTA, 10*time.Millisecond, filepath.Join(dir, "answers"), false, update)
+	if err := p.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if loaded := <-updates; loaded.Version != "1" {
+		t.Errorf("unexpected update %+v", loaded)
+	}
+	if err := p.poll(context.Background()); err == nil {
+		t.Error("downloaded from a closed server")
+	}
+}
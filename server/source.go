@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+
+	"github.com/rancher/rancher-metadata/config"
+)
+
+// the types of sources reported in their status
+const (
+	SOURCE_RANCHER  = "rancher"
+	SOURCE_UPSTREAM = "upstream"
+	SOURCE_HTTP     = "http"
+)
+
+// SourceUpdate is the answers of a source, as last loaded or downloaded
+type SourceUpdate struct {
+	Versions config.Versions
+	Lookups  config.Lookups
+	// Credentials are the other environments the source advertises
+	Credentials []config.Credential
+	// Version identifies the answers at the source
+	Version string
+	// Merged is set when the answers were merged with their environments
+	// already, by the server they are mirrored from
+	Merged bool
+}
+
+// SourceUpdateFunc is called by a source whenever its answers change
+type SourceUpdateFunc func(update SourceUpdate)
+
+// Source feeds answers to the MetadataController
+type Source interface {
+	// Load reads the answers the source saved, if any, and reports them
+	Load() error
+	// Start reports the answers as they change, until ctx is done or Stop
+	Start(ctx context.Context) error
+	// Stop stops reporting answers, and saves the last ones
+	Stop()
+	Status() SourceStatus
+}
+
+// NewSourceFunc makes the source of the local answers, reporting to update
+type NewSourceFunc func(update SourceUpdateFunc) Source
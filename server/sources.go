@@ -0,0 +1,230 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/rancher/log"
+	"github.com/rancher/rancher-metadata/config"
+)
+
+// ExternalSource is an environment added through the admin API, served like
+// the environments Rancher advertises
+type ExternalSource struct {
+	URL       string `json:"url"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+func (s ExternalSource) Validate() error {
+	if s.URL == "" || s.AccessKey == "" || s.SecretKey == "" {
+		return fmt.Errorf("Invalid source: url, access_key and secret_key are required")
+	}
+	return nil
+}
+
+func (s ExternalSource) credential() config.Credential {
+	return config.Credential{URL: s.URL, PublicValue: s.AccessKey, SecretValue: s.SecretKey}
+}
+
+// sourceRegistry holds the metadata servers of the external environments,
+// and their last answers, by access key
+type sourceRegistry struct {
+	sync.RWMutex
+	servers map[string]*MetadataServer
+	updates map[string]SourceUpdate
+}
+
+func newSourceRegistry() *sourceRegistry {
+	return &sourceRegistry{
+		servers: make(map[string]*MetadataServer),
+		updates: make(map[string]SourceUpdate),
+	}
+}
+
+func (r *sourceRegistry) get(accessKey string) (*MetadataServer, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	m, ok := r.servers[accessKey]
+	return m, ok
+}
+
+// add registers m unless a server with its access key already is
+func (r *sourceRegistry) add(m *MetadataServer) bool {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.servers[m.accessKey]; ok {
+		return false
+	}
+	r.servers[m.accessKey] = m
+	return true
+}
+
+func (r *sourceRegistry) remove(accessKey string) (*MetadataServer, bool) {
+	r.Lock()
+	defer r.Unlock()
+	m, ok := r.servers[accessKey]
+	delete(r.servers, accessKey)
+	delete(r.updates, accessKey)
+	return m, ok
+}
+
+// removeServer removes m, unless another server replaced it meanwhile
+func (r *sourceRegistry) removeServer(m *MetadataServer) {
+	r.Lock()
+	defer r.Unlock()
+	if r.servers[m.accessKey] == m {
+		delete(r.servers, m.accessKey)
+		delete(r.updates, m.accessKey)
+	}
+}
+
+// setUpdate records the answers of m, unless it was removed meanwhile
+func (r *sourceRegistry) setUpdate(m *MetadataServer, update SourceUpdate) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.servers[m.accessKey] != m {
+		return false
+	}
+	r.updates[m.accessKey] = update
+	return true
+}
+
+// versions returns the last answers of every environment
+func (r *sourceRegistry) versions() []config.Versions {
+	r.RLock()
+	defer r.RUnlock()
+	out := make([]config.Versions, 0, len(r.updates))
+	for _, update := range r.updates {
+		out = append(out, update.Versions)
+	}
+	return out
+}
+
+func (r *sourceRegistry) list() []*MetadataServer {
+	r.RLock()
+	defer r.RUnlock()
+	out := make([]*MetadataServer, 0, len(r.servers))
+	for _, m := range r.servers {
+		out = append(out, m)
+	}
+	return out
+}
+
+func (mc *MetadataController) sourcesFilePath() string {
+	return mc.answersFileNamePrefix + ".sources"
+}
+
+// loadSources reads the sources added through the admin API by a previous
+// run
+func (mc *MetadataController) loadSources() error {
+	content, err := ioutil.ReadFile(mc.sourcesFilePath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to read sources from [%s]: %v", mc.sourcesFilePath(), err)
+	}
+	var sources []ExternalSource
+	if err := json.Unmarshal(content, &sources); err != nil {
+		return fmt.Errorf("Failed to parse sources from [%s]: %v", mc.sourcesFilePath(), err)
+	}
+
+	mc.Lock()
+	defer mc.Unlock()
+	for _, s := range sources {
+		if err := s.Validate(); err != nil {
+			log.Warnf("Skipping source [%s] from [%s]: %v", s.AccessKey, mc.sourcesFilePath(), err)
+			continue
+		}
+		mc.addedSources[s.AccessKey] = s
+	}
+	log.Infof("Loaded %d sources from [%s]", len(mc.addedSources), mc.sourcesFilePath())
+	return nil
+}
+
+// saveSources writes the sources added through the admin API, readable only
+// by the owner since they include secret keys
+func (mc *MetadataController) saveSources() error {
+	sources := []ExternalSource{}
+	for _, s := range mc.addedSources {
+		sources = append(sources, s)
+	}
+	content, err := json.MarshalIndent(sources, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := config.WriteFileAtomic(mc.sourcesFilePath(), content, 0600); err != nil {
+		return fmt.Errorf("Failed to save sources to [%s]: %v", mc.sourcesFilePath(), err)
+	}
+	return nil
+}
+
+// AddSource subscribes to an external environment and serves it until
+// RemoveSource, across restarts.  It requires subscribing to Rancher.
+func (mc *MetadataController) AddSource(s ExternalSource) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	mc.Lock()
+	if _, ok := mc.local.(*Upstream); ok {
+		mc.Unlock()
+		return fmt.Errorf("Sources can't be added when mirroring an upstream")
+	}
+	if !mc.subscribe {
+		// nothing would download the answers of the source
+		mc.Unlock()
+		return fmt.Errorf("Sources can only be added when subscribing to Rancher")
+	}
+	if local := mc.localServer(); local != nil && local.accessKey == s.AccessKey {
+		mc.Unlock()
+		return fmt.Errorf("Source [%s] is the local environment", s.AccessKey)
+	}
+	previous, replaced := mc.addedSources[s.AccessKey]
+	mc.addedSources[s.AccessKey] = s
+	changes := mc.reloadVersionsLocked()
+	mc.Unlock()
+
+	if err := mc.applyChanges(changes)[s.AccessKey]; err != nil {
+		mc.Lock()
+		if replaced {
+			mc.addedSources[s.AccessKey] = previous
+		} else {
+			delete(mc.addedSources, s.AccessKey)
+		}
+		changes := mc.reloadVersionsLocked()
+		mc.Unlock()
+		mc.applyChanges(changes)
+		return err
+	}
+
+	mc.Lock()
+	defer mc.Unlock()
+	if err := mc.saveSources(); err != nil {
+		return err
+	}
+	log.Infof("Added source [%s] with url [%s]", s.AccessKey, s.URL)
+	return nil
+}
+
+// RemoveSource stops serving an environment added by AddSource, unless
+// Rancher advertises it too.  It returns false if no such source was added.
+func (mc *MetadataController) RemoveSource(accessKey string) (bool, error) {
+	mc.Lock()
+	if _, ok := mc.addedSources[accessKey]; !ok {
+		mc.Unlock()
+		return false, nil
+	}
+	delete(mc.addedSources, accessKey)
+	if err := mc.saveSources(); err != nil {
+		mc.Unlock()
+		return true, err
+	}
+	log.Infof("Removed source [%s]", accessKey)
+	changes := mc.reloadVersionsLocked()
+	mc.Unlock()
+	mc.applyChanges(changes)
+	return true, nil
+}
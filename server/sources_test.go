@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// staticSource is a local source without answers
+type staticSource struct{}
+
+func (staticSource) Load() error                     { return nil }
+func (staticSource) Start(ctx context.Context) error { return nil }
+func (staticSource) Stop()                           {}
+func (staticSource) Status() SourceStatus            { return SourceStatus{Type: SOURCE_HTTP, Local: true} }
+
+func TestSourcesAreStartedOutsideTheLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rancher-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mc := NewMetadataController(ControllerOptions{
+		Subscribe:      true,
+		Answers:        filepath.Join(dir, "answers"),
+		ReloadInterval: 1000,
+		NewLocal:       func(update SourceUpdateFunc) Source { return staticSource{} },
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := mc.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Stop()
+
+	// a Rancher that hangs, then fails
+	requested := make(chan struct{}, 1)
+	release := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer hanging.Close()
+
+	added := make(chan error)
+	go func() {
+		added <- mc.AddSource(ExternalSource{URL: hanging.URL, AccessKey: "hanging", SecretKey: "sk"})
+	}()
+	<-requested
+	status := make(chan Status)
+	go func() {
+		status <- mc.Status()
+	}()
+	select {
+	case s := <-status:
+		if len(s.Sources) != 2 {
+			t.Errorf("expected the source being added, got %+v", s.Sources)
+		}
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("the status waited for the source to start")
+	}
+	close(release)
+	if err := <-added; err == nil {
+		t.Fatal("added a source that failed to start")
+	}
+	if s := mc.Status(); len(s.Sources) != 1 {
+		t.Errorf("expected only the local source, got %+v", s.Sources)
+	}
+	if _, err := os.Stat(mc.sourcesFilePath()); !os.IsNotExist(err) {
+		t.Errorf("saved the source that failed to start, %v", err)
+	}
+
+	ts := cattleStub()
+	defer ts.Close()
+	if err := mc.AddSource(ExternalSource{URL: ts.URL, AccessKey: "added", SecretKey: "sk"}); err != nil {
+		t.Fatal(err)
+	}
+	if s := mc.Status(); len(s.Sources) != 2 || !s.Sources[1].Added || !s.Sources[1].Subscribed {
+		t.Errorf("expected the added source, got %+v", s.Sources)
+	}
+	if removed, err := mc.RemoveSource("added"); !removed || err != nil {
+		t.Fatalf("failed to remove the source, %v", err)
+	}
+	if s := mc.Status(); len(s.Sources) != 1 {
+		t.Errorf("expected only the local source, got %+v", s.Sources)
+	}
+}
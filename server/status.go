@@ -0,0 +1,108 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rancher/rancher-metadata/pkg/backoff"
+)
+
+// Status is the state of the metadata sources and of the answers merged from
+// them
+type Status struct {
+	// Version identifies the merged answers, as seen by long-polling clients
+	Version string         `json:"version" yaml:"version"`
+	Sources []SourceStatus `json:"sources" yaml:"sources"`
+}
+
+// SourceStatus is the state of a local or external metadata source
+type SourceStatus struct {
+	Type             string         `json:"type" yaml:"type"`
+	AccessKey        string         `json:"access_key" yaml:"access_key"`
+	URL              string         `json:"url" yaml:"url"`
+	Local            bool           `json:"local" yaml:"local"`
+	Added            bool           `json:"added" yaml:"added"`
+	Subscribed       bool           `json:"subscribed" yaml:"subscribed"`
+	AppliedVersion   string         `json:"applied_version" yaml:"applied_version"`
+	RequestedVersion string         `json:"requested_version" yaml:"requested_version"`
+	LastDownload     *time.Time     `json:"last_download" yaml:"last_download,omitempty"`
+	LastError        string         `json:"last_error,omitempty" yaml:"last_error,omitempty"`
+	LastErrorTime    *time.Time     `json:"last_error_time,omitempty" yaml:"last_error_time,omitempty"`
+	FailedDownloads  int            `json:"failed_downloads" yaml:"failed_downloads"`
+	NextRetry        *time.Time     `json:"next_retry,omitempty" yaml:"next_retry,omitempty"`
+	FailedReconnects int            `json:"failed_reconnects" yaml:"failed_reconnects"`
+	NextReconnect    *time.Time     `json:"next_reconnect,omitempty" yaml:"next_reconnect,omitempty"`
+	Objects          map[string]int `json:"objects" yaml:"objects"`
+}
+
+// maskKey keeps the first characters of an access key, enough to tell keys
+// apart
+func maskKey(key string) string {
+	const shown = 4
+	if key == "" {
+		return ""
+	}
+	if len(key) <= shown {
+		return strings.Repeat("*", len(key))
+	}
+	return key[:shown] + strings.Repeat("*", len(key)-shown)
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func backoffState(b *backoff.Backoff) (int, *time.Time) {
+	failures, retryAt := b.State()
+	return failures, optionalTime(retryAt)
+}
+
+// Status reports the state of the source
+func (ms *MetadataServer) Status() SourceStatus {
+	ms.versionsLock.RLock()
+	version := ms.version
+	ms.versionsLock.RUnlock()
+	status := SourceStatus{
+		Type:           SOURCE_RANCHER,
+		AccessKey:      maskKey(ms.accessKey),
+		URL:            ms.URL,
+		Local:          ms.local,
+		AppliedVersion: version,
+		Objects:        ms.generator.ObjectCounts(),
+	}
+	if s := ms.getSubscriber(); s != nil {
+		status.Subscribed = s.Subscribed()
+		status.RequestedVersion = s.GetRequestedVersion()
+		s.statusLock.Lock()
+		status.LastDownload = optionalTime(s.lastDownload)
+		status.LastError = s.lastError
+		status.LastErrorTime = optionalTime(s.lastErrorTime)
+		s.statusLock.Unlock()
+		status.FailedDownloads, status.NextRetry = backoffState(s.retries)
+		status.FailedReconnects, status.NextReconnect = backoffState(s.reconnects)
+	}
+	return status
+}
+
+// Status reports the state of every source, the local one first
+func (mc *MetadataController) Status() Status {
+	mc.Lock()
+	defer mc.Unlock()
+	var external []SourceStatus
+	for _, m := range mc.sources.list() {
+		s := m.Status()
+		_, s.Added = mc.addedSources[m.accessKey]
+		external = append(external, s)
+	}
+	sort.Slice(external, func(i, j int) bool {
+		return external[i].AccessKey < external[j].AccessKey
+	})
+	return Status{
+		Version: mc.version,
+		Sources: append([]SourceStatus{mc.local.Status()}, external...),
+	}
+}
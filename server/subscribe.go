@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -15,10 +16,21 @@ import (
 	"github.com/rancher/go-rancher/v2"
 	"github.com/rancher/log"
 	"github.com/rancher/rancher-metadata/config"
+	"github.com/rancher/rancher-metadata/pkg/backoff"
 	"github.com/rancher/rancher-metadata/pkg/kicker"
 )
 
-type ReloadFunc func(versions config.Versions, creds []config.Credential, version string)
+const (
+	// the delays before subscribing again after the subscription ended, and
+	// before downloading again after a download failed, double with each
+	// failure between these
+	RETRY_BACKOFF_MIN = time.Second
+	RETRY_BACKOFF_MAX = 2 * time.Minute
+)
+
+// ReloadFunc serves the answers generated from a delta, and applies the delta
+// to the generator if it does
+type ReloadFunc func(delta *config.Delta, versions config.Versions, lookups config.Lookups, creds []config.Credential)
 
 type Subscriber struct {
 	url                  string
@@ -33,7 +45,23 @@ type Subscriber struct {
 	requestedVersionLock sync.Mutex
 	reloadInterval       int64
 	limiter              *ratelimit.Bucket
-	stopCh               chan struct{}
+	// the subscription, read by the retry timer too
+	subscriptionLock sync.Mutex
+	// cancels the goroutines of the subscription
+	cancel context.CancelFunc
+	ctx    context.Context
+	// the source label of the metrics
+	source string
+	// outcome of the downloads, for the status
+	statusLock    sync.Mutex
+	lastDownload  time.Time
+	lastError     string
+	lastErrorTime time.Time
+	// delays between the attempts to subscribe, reset by any event
+	reconnects *backoff.Backoff
+	// delays between the downloads retried after a failure
+	retries    *backoff.Backoff
+	retryTimer *time.Timer
 }
 
 func formatUrl(url string) string {
@@ -46,7 +74,8 @@ func formatUrl(url string) string {
 	return fmt.Sprintf("%s%s", url, "/v2-beta")
 }
 
-func NewSubscriber(url string, accessKey string, secretKey string, generator *config.Generator, reloadInterval int64, reload ReloadFunc) *Subscriber {
+func NewSubscriber(url string, accessKey string, secretKey string, generator *config.Generator, reloadInterval int64, source string,
+	reload ReloadFunc) *Subscriber {
 	s := &Subscriber{
 		url:            formatUrl(url),
 		accessKey:      accessKey,
@@ -56,12 +85,21 @@ func NewSubscriber(url string, accessKey string, secretKey string, generator *co
 		generator:      generator,
 		reloadInterval: reloadInterval,
 		limiter:        ratelimit.NewBucketWithQuantum(time.Duration(reloadInterval)*time.Millisecond, 1.0, 1),
-		stopCh:         make(chan struct{}),
+		source:         source,
+		reconnects:     backoff.New(RETRY_BACKOFF_MIN, RETRY_BACKOFF_MAX),
+		retries:        backoff.New(RETRY_BACKOFF_MIN, RETRY_BACKOFF_MAX),
 	}
 	s.kicker = kicker.New(func() {
-		if err := s.downloadAndReload(); err != nil {
+		if id, ok := s.generator.Pinned(); ok {
+			log.Infof("Not downloading metadata while snapshot [%s] is pinned", id)
+			return
+		}
+		kickerGenerations.Inc(s.source)
+		err := s.downloadAndReload()
+		if err != nil {
 			log.Errorf("Failed to download and reload metadata: %v url=%v access_key=%v", err, s.url, s.accessKey)
 		}
+		s.recordDownload(err)
 	})
 	return s
 }
@@ -81,7 +119,41 @@ func (s *Subscriber) GetRequestedVersion() string {
 	return s.requestedVersion
 }
 
-func (s *Subscriber) Subscribe() error {
+// recordDownload records the outcome of a download, and schedules a retry
+// after a failure
+func (s *Subscriber) recordDownload(err error) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	if s.retryTimer != nil {
+		s.retryTimer.Stop()
+		s.retryTimer = nil
+	}
+	if err == nil {
+		s.lastDownload = time.Now()
+		s.retries.Success()
+		return
+	}
+	s.lastError = err.Error()
+	s.lastErrorTime = time.Now()
+	delay := s.retries.Failure()
+	log.Infof("Retrying the download in %v url=%v access_key=%v", delay, s.url, s.accessKey)
+	s.retryTimer = time.AfterFunc(delay, func() {
+		if s.Subscribed() {
+			downloadRetries.Inc(s.source)
+			s.kicker.Kick()
+		}
+	})
+}
+
+// Subscribed returns whether the subscriber is listening for updates
+func (s *Subscriber) Subscribed() bool {
+	s.subscriptionLock.Lock()
+	defer s.subscriptionLock.Unlock()
+	return s.ctx != nil && s.ctx.Err() == nil
+}
+
+// Subscribe listens for updates until ctx is done or Unsubscribe
+func (s *Subscriber) Subscribe(ctx context.Context) error {
 	handlers := map[string]revents.EventHandler{
 		"ping":          s.noOp,
 		"config.update": s.configUpdate,
@@ -92,32 +164,38 @@ func (s *Subscriber) Subscribe() error {
 		return err
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+	s.subscriptionLock.Lock()
 	s.router = router
+	s.ctx, s.cancel = ctx, cancel
+	s.subscriptionLock.Unlock()
 
 	go func() {
 		sp := revents.SkippingWorkerPool(3, nil)
 		for {
 			s.kicker.Kick()
-			if err := s.router.RunWithWorkerPool(sp); err != nil {
+			if err := router.RunWithWorkerPool(sp); err != nil {
 				log.Errorf("Exiting subscriber: %v url=%v access_key=%v", err, s.url, s.accessKey)
 			}
+			delay := s.reconnects.Failure()
 			select {
-			case <-s.stopCh:
+			case <-ctx.Done():
 				return
-			default:
-				time.Sleep(time.Second)
+			case <-time.After(delay):
 			}
+			subscriberReconnects.Inc(s.source)
 		}
 	}()
 
 	go func() {
-		for t := range time.Tick(30 * time.Second) {
-			s.generator.SaveToFile(t)
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
 			select {
-			case <-s.stopCh:
+			case <-ctx.Done():
 				return
-			default:
-				time.Sleep(time.Second)
+			case t := <-ticker.C:
+				s.generator.SaveToFile(t)
 			}
 		}
 	}()
@@ -125,15 +203,33 @@ func (s *Subscriber) Subscribe() error {
 	return nil
 }
 
+// Unsubscribe stops listening for updates and closes the connection to
+// Rancher
 func (s *Subscriber) Unsubscribe() {
-	close(s.stopCh)
+	s.subscriptionLock.Lock()
+	cancel, router := s.cancel, s.router
+	s.subscriptionLock.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	s.statusLock.Lock()
+	if s.retryTimer != nil {
+		s.retryTimer.Stop()
+	}
+	s.statusLock.Unlock()
+	if router.GetWebSocketConn() != nil {
+		router.Stop()
+	}
 }
 
 func (s *Subscriber) noOp(event *revents.Event, c *client.RancherClient) error {
+	s.reconnects.Success()
 	return nil
 }
 
 func (s *Subscriber) configUpdate(event *revents.Event, c *client.RancherClient) error {
+	s.reconnects.Success()
 	update := ConfigUpdateData{}
 	if err := mapstructure.Decode(event.Data, &update); err != nil {
 		return err
@@ -186,22 +282,23 @@ func (s *Subscriber) downloadAndReload() error {
 
 	// 2. Decode the delta
 	log.Infof("Generating and reloading answers")
-	delta, version, err := s.generator.GenerateDelta(resp.Body)
+	delta, err := s.generator.DecodeDelta(&countingReader{r: resp.Body, counter: downloadBytes, labels: []string{s.source}})
 	if err != nil {
 		log.Errorf("Failed to decode delta")
 		return err
 	}
+	version := delta.Version
 
 	log.Infof("Generating answers")
 	// 3. Geneate answers
-	versions, creds, err := s.generator.GenerateAnswers(delta)
+	versions, lookups, creds, err := s.generator.GenerateAnswers(delta.Objects)
 	if err != nil {
 		log.Errorf("Failed to generate answers")
 		return err
 	}
 
 	// 4. Reload
-	s.reload(versions, creds, version)
+	s.reload(delta, versions, lookups, creds)
 	log.Infof("Generated and reloaded answers")
 
 	// 5. Generate a reply
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rancher/rancher-metadata/config"
+)
+
+// cattleStub answers the API root and schemas of Rancher, and fails the rest
+func cattleStub() *httptest.Server {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body interface{}
+		switch {
+		case strings.TrimSuffix(req.URL.Path, "/") == "/v2-beta":
+			body = map[string]interface{}{"type": "apiRoot", "links": map[string]string{"schemas": ts.URL + "/v2-beta/schemas"}}
+		case strings.HasPrefix(req.URL.Path, "/v2-beta/schemas"):
+			body = map[string]interface{}{"type": "collection", "resourceType": "schema", "data": []interface{}{}}
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-API-Schemas", ts.URL+"/v2-beta/schemas")
+		json.NewEncoder(w).Encode(body)
+	}))
+	return ts
+}
+
+func TestSubscribedWhileSubscribing(t *testing.T) {
+	ts := cattleStub()
+	defer ts.Close()
+	s := NewSubscriber(ts.URL, "ak", "sk", config.NewGenerator(true, "", false, 0), 1, "local",
+		func(*config.Delta, config.Versions, config.Lookups, []config.Credential) {})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			s.Subscribed()
+		}
+	}()
+	if err := s.Subscribe(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if !s.Subscribed() {
+		t.Error("not subscribed after Subscribe")
+	}
+	s.Unsubscribe()
+	if s.Subscribed() {
+		t.Error("still subscribed after Unsubscribe")
+	}
+}
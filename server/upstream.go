@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher/log"
+	"github.com/rancher/rancher-metadata/config"
+	"github.com/rancher/rancher-metadata/pkg/backoff"
+)
+
+// how long a request to the upstream waits for its answers to change
+const UPSTREAM_MAX_WAIT = time.Minute
+
+// Upstream is the Source of the answers of another rancher-metadata,
+// mirrored by long-polling the address it serves them on for changes.  The
+// last mirror is saved, and served as long as the upstream can't be reached.
+type Upstream struct {
+	URL            string
+	token          string
+	mirrorFilePath string
+	update         SourceUpdateFunc
+	client         *http.Client
+	// delays before asking an unreachable upstream again
+	retries *backoff.Backoff
+	sync.Mutex
+	cancel        context.CancelFunc
+	mirror        *config.Mirror
+	lastDownload  time.Time
+	lastError     string
+	lastErrorTime time.Time
+}
+
+func NewUpstream(URL string, token string, answersFilePathPrefix string, update SourceUpdateFunc) *Upstream {
+	return &Upstream{
+		URL:            strings.TrimRight(URL, "/"),
+		token:          token,
+		mirrorFilePath: answersFilePathPrefix + ".mirror",
+		update:         update,
+		client:         &http.Client{Timeout: UPSTREAM_MAX_WAIT + 30*time.Second},
+		retries:        backoff.New(RETRY_BACKOFF_MIN, RETRY_BACKOFF_MAX),
+	}
+}
+
+// Load reads the mirror saved by a previous run, if any
+func (u *Upstream) Load() error {
+	mirror, err := config.ReadMirrorFile(u.mirrorFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		log.Warnf("Ignoring the mirror saved in [%s]: %v", u.mirrorFilePath, err)
+		return nil
+	}
+	log.Infof("Loaded the mirror of [%s] from [%s]", u.URL, u.mirrorFilePath)
+	u.setMirror(mirror)
+	return nil
+}
+
+func (u *Upstream) setMirror(mirror *config.Mirror) {
+	u.Lock()
+	u.mirror = mirror
+	u.Unlock()
+	u.update(SourceUpdate{
+		Versions: mirror.Versions,
+		Lookups:  config.NewLookups(mirror.Versions),
+		Version:  mirror.Version,
+		Merged:   true,
+	})
+}
+
+// Start mirrors the upstream until ctx is done or Stop
+func (u *Upstream) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	u.Lock()
+	u.cancel = cancel
+	u.Unlock()
+	go func() {
+		for {
+			err := u.download(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			u.recordDownload(err)
+			if err != nil {
+				delay := u.retries.Failure()
+				log.Errorf("%v, retrying in %v", err, delay)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(delay):
+				}
+			} else {
+				u.retries.Success()
+			}
+		}
+	}()
+	return nil
+}
+
+func (u *Upstream) Stop() {
+	u.Lock()
+	cancel := u.cancel
+	u.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// download waits for the answers of the upstream to differ from the mirror,
+// and mirrors them if they do
+func (u *Upstream) download(ctx context.Context) error {
+	version := u.Version()
+	query := url.Values{
+		"wait":    {"true"},
+		"version": {version},
+		"maxWait": {strconv.Itoa(int(UPSTREAM_MAX_WAIT / time.Second))},
+	}
+	req, err := http.NewRequest("GET", u.URL+"/v1/answers?"+query.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("Failed to download answers from upstream [%s]: %v", u.URL, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if u.token != "" {
+		req.Header.Set("Authorization", "Bearer "+u.token)
+	}
+	resp, err := u.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("Failed to download answers from upstream [%s]: %v", u.URL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to download answers from upstream [%s]: %s", u.URL, resp.Status)
+	}
+	content, err := ioutil.ReadAll(&countingReader{r: resp.Body, counter: downloadBytes, labels: []string{SOURCE_UPSTREAM}})
+	if err != nil {
+		return fmt.Errorf("Failed to download answers from upstream [%s]: %v", u.URL, err)
+	}
+	mirror, err := config.DecodeMirror(content)
+	if err != nil {
+		return fmt.Errorf("Failed to download answers from upstream [%s]: %v", u.URL, err)
+	}
+	if mirror.Version == version {
+		return nil
+	}
+
+	log.Infof("Mirroring answers [%s] of upstream [%s]", mirror.Version, u.URL)
+	if err := config.WriteMirrorFile(u.mirrorFilePath, mirror); err != nil {
+		log.Error(err)
+	}
+	u.setMirror(mirror)
+	return nil
+}
+
+func (u *Upstream) recordDownload(err error) {
+	u.Lock()
+	defer u.Unlock()
+	if err != nil {
+		u.lastError = err.Error()
+		u.lastErrorTime = time.Now()
+	} else {
+		u.lastDownload = time.Now()
+	}
+}
+
+// Version is the id of the mirrored answers, empty until there are some
+func (u *Upstream) Version() string {
+	u.Lock()
+	defer u.Unlock()
+	if u.mirror == nil {
+		return ""
+	}
+	return u.mirror.Version
+}
+
+func (u *Upstream) Status() SourceStatus {
+	u.Lock()
+	defer u.Unlock()
+	status := SourceStatus{
+		Type:          SOURCE_UPSTREAM,
+		URL:           u.URL,
+		Local:         true,
+		Subscribed:    u.cancel != nil,
+		LastDownload:  optionalTime(u.lastDownload),
+		LastError:     u.lastError,
+		LastErrorTime: optionalTime(u.lastErrorTime),
+	}
+	status.FailedDownloads, status.NextRetry = backoffState(u.retries)
+	if u.mirror != nil {
+		status.AppliedVersion = u.mirror.Version
+	}
+	return status
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher/rancher-metadata/config"
+)
+
+// mirrorStub serves a mirror to the requests with the token, or 304 to
+// those asking for a mirror of another version
+type mirrorStub struct {
+	sync.Mutex
+	token    string
+	mirror   []byte
+	version  string
+	requests []*http.Request
+}
+
+func (m *mirrorStub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	m.Lock()
+	m.requests = append(m.requests, req)
+	m.Unlock()
+	if req.Header.Get("Authorization") != "Bearer "+m.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if req.URL.Query().Get("version") == m.version {
+		// the upstream long-polls for a while before answering
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(m.mirror)
+}
+
+func (m *mirrorStub) requested() []*http.Request {
+	m.Lock()
+	defer m.Unlock()
+	return append([]*http.Request(nil), m.requests...)
+}
+
+// serviceToken returns the token the answers give to the client at ip
+func serviceToken(versions config.Versions, ip string) interface{} {
+	token, _ := versions.Matching(config.METADATA_VERSION3, ip, []string{"self", "service", "token"})
+	return token
+}
+
+func TestUpstreamMirrorsEveryClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rancher-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	versions, _, _, err := config.NewGenerator(true, "", false, 0).GenerateAnswers([]map[string]interface{}{
+		{"metadata_kind": "defaultData", "version": "1"},
+		{"metadata_kind": "stack", "uuid": "stack-1", "name": "Stack"},
+		{"metadata_kind": "service", "uuid": "service-1", "name": "Web", "stack_uuid": "stack-1", "stack_name": "Stack",
+			"primary_service_name": "Web", "token": "secret"},
+		{"metadata_kind": "container", "uuid": "container-1", "name": "Stack-Web-1", "primary_ip": "10.42.0.1",
+			"stack_uuid": "stack-1", "service_uuid": "service-1", "service_name": "Web"},
+		{"metadata_kind": "serviceContainerLink", "service_uuid": "service-1", "service_name": "Web", "container_uuid": "container-1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror, err := json.Marshal(config.Mirror{Version: "m1", Versions: versions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &mirrorStub{token: "mirror-token", mirror: mirror, version: "m1"}
+	ts := httptest.NewServer(stub)
+
+	updates := make(chan SourceUpdate, 10)
+	update := func(update SourceUpdate) { updates <- update }
+	u := NewUpstream(ts.URL, "mirror-token", filepath.Join(dir, "answers"), update)
+	if err := u.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mirrored := <-updates
+	if mirrored.Version != "m1" || !mirrored.Merged || serviceToken(mirrored.Versions, "10.42.0.1") != "secret" ||
+		serviceToken(mirrored.Versions, config.DEFAULT_KEY) != nil {
+		t.Errorf("unexpected update of version [%s] with the tokens [%v] and [%v]", mirrored.Version,
+			serviceToken(mirrored.Versions, "10.42.0.1"), serviceToken(mirrored.Versions, config.DEFAULT_KEY))
+	}
+	// the next requests wait for another version, and find none
+	waitFor(t, "requests", func() bool { return len(stub.requested()) >= 3 })
+	u.Stop()
+	ts.Close()
+	if len(updates) != 0 {
+		t.Errorf("an unchanged mirror was reported, %s", (<-updates).Version)
+	}
+	for i, req := range stub.requested() {
+		version := ""
+		if i > 0 {
+			version = "m1"
+		}
+		if req.URL.Query().Get("version") != version || req.URL.Query().Get("wait") != "true" {
+			t.Errorf("%d: unexpected request %v", i, req.URL)
+		}
+	}
+	if status := u.Status(); status.AppliedVersion != "m1" || status.LastDownload == nil || status.LastError != "" {
+		t.Errorf("unexpected status %+v", status)
+	}
+	info, err := os.Stat(filepath.Join(dir, "answers.mirror"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the mirror is readable by others, %v", info.Mode())
+	}
+
+	// the saved mirror is served while the upstream is unreachable
+	u = NewUpstream(ts.URL, "mirror-token", filepath.Join(dir, "answers"), update)
+	if err := u.Load(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := <-updates
+	if loaded.Version != "m1" || serviceToken(loaded.Versions, "10.42.0.1") != "secret" {
+		t.Errorf("unexpected update of version [%s] with the token [%v]", loaded.Version, serviceToken(loaded.Versions, "10.42.0.1"))
+	}
+	if err := u.download(context.Background()); err == nil {
+		t.Error("downloaded from a closed upstream")
+	}
+	if u.Version() != "m1" || len(updates) != 0 {
+		t.Error("a failed download replaced the mirror")
+	}
+}
+
+func TestUpstreamSendsItsToken(t *testing.T) {
+	stub := &mirrorStub{token: "mirror-token", version: "m1"}
+	ts := httptest.NewServer(stub)
+	defer ts.Close()
+
+	u := NewUpstream(ts.URL, "other-token", "", func(SourceUpdate) {
+		t.Error("mirrored without the token")
+	})
+	if err := u.download(context.Background()); err == nil {
+		t.Error("downloaded with the wrong token")
+	}
+	if requests := stub.requested(); len(requests) != 1 || requests[0].Header.Get("Authorization") != "Bearer other-token" {
+		t.Errorf("unexpected requests %v", requests)
+	}
+}
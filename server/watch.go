@@ -0,0 +1,167 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rancher/rancher-metadata/config"
+)
+
+// watchKey is the answer a long-poll waits on.  client is the IP whose
+// answers are served, or DEFAULT_KEY for the clients without answers of
+// their own, which all share a watch.
+type watchKey struct {
+	version string
+	client  string
+	path    string
+}
+
+// watch is shared by the waiters on the same answer.  changed is closed, and
+// replaced, when a reload changes the answer.
+type watch struct {
+	path    []string
+	waiters int
+	// the IPs waiting on the default answers, which are woken once they
+	// have answers of their own
+	ips map[string]int
+	// the answer, and its formatted value
+	found   bool
+	node    interface{}
+	value   string
+	changed chan struct{}
+}
+
+// watching is a waiter registered by add
+type watching struct {
+	key     watchKey
+	ip      string
+	changed <-chan struct{}
+	// the answers the watch was read from
+	versions config.Versions
+	index    *config.PathIndex
+}
+
+// watchers keeps the answers long-polls wait on, so that a reload only wakes
+// the waiters whose answer changed
+type watchers struct {
+	sync.Mutex
+	byKey   map[watchKey]*watch
+	stopped bool
+	// the answers notify was last called with, and the number of their
+	// reload
+	versions   config.Versions
+	index      *config.PathIndex
+	generation uint64
+}
+
+func newWatchers() *watchers {
+	return &watchers{
+		byKey: make(map[watchKey]*watch),
+	}
+}
+
+// read sets the answer of watched from versions, and returns whether it
+// changed.  An answer that is the same map or array as before is unchanged,
+// without formatting it.
+func (watched *watch) read(versions config.Versions, idx *config.PathIndex, strict bool, key watchKey) bool {
+	val, found := versions.MatchingIndexed(idx, strict, key.version, key.client, watched.path)
+	if found == watched.found && config.Same(val, watched.node) {
+		return false
+	}
+	value := fmt.Sprint(found, val)
+	watched.found, watched.node = found, val
+	if value == watched.value {
+		return false
+	}
+	watched.value = value
+	return true
+}
+
+// add registers a waiter on the answer at path for ip, and returns it, or
+// false once stopped.  The answer is read from the answers notify was last
+// called with, which the waiter should look up its answer in.
+func (w *watchers) add(version, ip string, path []string, strict bool) (*watching, bool) {
+	w.Lock()
+	defer w.Unlock()
+	if w.stopped {
+		return nil, false
+	}
+	key := watchKey{version: version, client: ip, path: strings.Join(path, "/")}
+	if _, ok := w.versions[version][ip]; !ok {
+		key.client = config.DEFAULT_KEY
+	}
+	watched, ok := w.byKey[key]
+	if !ok {
+		watched = &watch{
+			path:    path,
+			ips:     make(map[string]int),
+			changed: make(chan struct{}),
+		}
+		watched.read(w.versions, w.index, strict, key)
+		w.byKey[key] = watched
+	}
+	watched.waiters++
+	if ip != key.client {
+		watched.ips[ip]++
+	}
+	return &watching{key: key, ip: ip, changed: watched.changed, versions: w.versions, index: w.index}, true
+}
+
+func (w *watchers) remove(waiter *watching) {
+	w.Lock()
+	defer w.Unlock()
+	watched, ok := w.byKey[waiter.key]
+	if !ok {
+		return
+	}
+	watched.waiters--
+	if waiter.ip != waiter.key.client {
+		watched.ips[waiter.ip]--
+		if watched.ips[waiter.ip] <= 0 {
+			delete(watched.ips, waiter.ip)
+		}
+	}
+	if watched.waiters <= 0 {
+		delete(w.byKey, waiter.key)
+	}
+}
+
+// notify wakes the waiters whose answer differs in versions, the answers of
+// reload generation, unless it notified those of a later reload already
+func (w *watchers) notify(versions config.Versions, idx *config.PathIndex, strict bool, generation uint64) {
+	w.Lock()
+	defer w.Unlock()
+	if w.stopped || generation <= w.generation {
+		return
+	}
+	w.versions, w.index, w.generation = versions, idx, generation
+	for key, watched := range w.byKey {
+		changed := watched.read(versions, idx, strict, key)
+		for ip := range watched.ips {
+			if _, ok := versions[key.version][ip]; ok {
+				// the waiters move to a watch of their own answers
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			continue
+		}
+		close(watched.changed)
+		watched.changed = make(chan struct{})
+	}
+}
+
+// stop wakes every waiter, and makes add fail from then on
+func (w *watchers) stop() {
+	w.Lock()
+	defer w.Unlock()
+	if w.stopped {
+		return
+	}
+	w.stopped = true
+	for _, watched := range w.byKey {
+		close(watched.changed)
+	}
+}
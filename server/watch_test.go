@@ -0,0 +1,124 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/rancher/rancher-metadata/config"
+)
+
+func answersWithName(name string) config.Versions {
+	return config.Versions{
+		config.METADATA_VERSION3: config.Answers{
+			config.DEFAULT_KEY: map[string]interface{}{
+				"name":    name,
+				"version": "1",
+			},
+		},
+	}
+}
+
+func woken(changed <-chan struct{}) bool {
+	select {
+	case <-changed:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestWatchersWakeOnlyOnChange(t *testing.T) {
+	w := newWatchers()
+	w.notify(answersWithName("a"), nil, false, 1)
+	name, _ := w.add(config.METADATA_VERSION3, "10.42.0.1", []string{"name"}, false)
+	version, _ := w.add(config.METADATA_VERSION3, "10.42.0.1", []string{"version"}, false)
+
+	w.notify(answersWithName("a"), nil, false, 2)
+	w.notify(answersWithName("b"), nil, false, 3)
+	if !woken(name.changed) {
+		t.Error("waiter on the changed answer wasn't woken")
+	}
+	if woken(version.changed) {
+		t.Error("waiter on an unchanged answer was woken")
+	}
+
+	// a waiter joining after the change waits for the next one
+	joined, _ := w.add(config.METADATA_VERSION3, "10.42.0.1", []string{"name"}, false)
+	if woken(joined.changed) {
+		t.Error("got the channel of the last change")
+	}
+	w.remove(name)
+	w.remove(joined)
+	if len(w.byKey) != 1 {
+		t.Errorf("watches left without waiters: %v", w.byKey)
+	}
+
+	w.stop()
+	if !woken(version.changed) {
+		t.Error("waiter wasn't woken on stop")
+	}
+	if _, ok := w.add(config.METADATA_VERSION3, "10.42.0.1", []string{"name"}, false); ok {
+		t.Error("added a waiter after stop")
+	}
+}
+
+func TestWatchersShareTheDefaultAnswers(t *testing.T) {
+	w := newWatchers()
+	w.notify(answersWithName("a"), nil, false, 1)
+	first, _ := w.add(config.METADATA_VERSION3, "10.42.0.1", []string{"name"}, false)
+	second, _ := w.add(config.METADATA_VERSION3, "10.42.0.2", []string{"name"}, false)
+	if len(w.byKey) != 1 || first.key.client != config.DEFAULT_KEY {
+		t.Fatalf("expected a single watch of the default answers, got %v", w.byKey)
+	}
+
+	// once a client has answers of its own, its waiters move to them
+	versions := answersWithName("a")
+	versions[config.METADATA_VERSION3]["10.42.0.2"] = map[string]interface{}{"name": "a"}
+	w.notify(versions, nil, false, 2)
+	if !woken(second.changed) {
+		t.Error("waiter of the client with answers of its own wasn't woken")
+	}
+	w.remove(first)
+	w.remove(second)
+	own, _ := w.add(config.METADATA_VERSION3, "10.42.0.2", []string{"name"}, false)
+	if own.key.client != "10.42.0.2" {
+		t.Errorf("expected a watch of the answers of the client, got %v", own.key)
+	}
+}
+
+func TestWatchersIgnoreEarlierReloads(t *testing.T) {
+	w := newWatchers()
+	w.notify(answersWithName("a"), nil, false, 1)
+	name, _ := w.add(config.METADATA_VERSION3, "10.42.0.1", []string{"name"}, false)
+
+	w.notify(answersWithName("b"), nil, false, 3)
+	w.remove(name)
+	name, _ = w.add(config.METADATA_VERSION3, "10.42.0.1", []string{"name"}, false)
+	// a reload notifying after a later one
+	w.notify(answersWithName("a"), nil, false, 2)
+	if woken(name.changed) {
+		t.Error("woken by the answers of an earlier reload")
+	}
+	if val, _ := name.versions.Matching(config.METADATA_VERSION3, "10.42.0.1", []string{"name"}); val != "b" {
+		t.Errorf("expected the answers of the last reload, got %v", val)
+	}
+}
+
+func TestWatchersSkipTheSameAnswers(t *testing.T) {
+	w := newWatchers()
+	versions := answersWithName("a")
+	w.notify(versions, nil, false, 1)
+	root, _ := w.add(config.METADATA_VERSION3, config.DEFAULT_KEY, nil, false)
+	watched := w.byKey[root.key]
+
+	// the same map isn't formatted again, even when its values were
+	// changed, which generated answers never are
+	versions[config.METADATA_VERSION3][config.DEFAULT_KEY].(map[string]interface{})["name"] = "b"
+	w.notify(versions, nil, false, 2)
+	if woken(root.changed) || watched.value != "true map[name:a version:1]" {
+		t.Errorf("the same answers were compared, %s", watched.value)
+	}
+	w.notify(answersWithName("b"), nil, false, 3)
+	if !woken(root.changed) {
+		t.Error("waiter on the changed answer wasn't woken")
+	}
+}